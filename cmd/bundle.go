@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+var bundleOutputPath string
+var bundleIncludeImages bool
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Manages bundles for installing OpenUnison without internet access",
+	Long:  ``,
+}
+
+// bundleCreateCmd represents the bundle create command
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Packages the charts and the images they use into a bundle, requires one argument: The path to the values.yaml",
+	Long: `Locates every chart install-auth-portal and install-satelite deploy at its pinned version and writes them to a tgz along with:
+	1.  bundle.yaml, listing the charts and images
+	2.  images.txt, the images found in the charts rendered with the values.yaml
+	3.  images/, an OCI layout with every image when --include-images is set
+Install from the bundle with --bundle, the charts are loaded from it without contacting any repository.  The bundled charts are recorded in the lock file so the bundle can be installed with --locked.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("Requires one argument: The path to the values.yaml")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToValuesYaml = args[0]
+
+		// the bundled charts are always recorded so the bundle can be installed with --locked
+		chartLock.Record = true
+
+		builder, err := openunison.NewBundleBuilder(namespace, operatorChart, orchestraChart, orchestraLoginPortalChart, clusterManagementChart, addClusterChart, pathToValuesYaml, parseChartSlices(&additionalCharts), parseChartSlices(&preCharts), skipCharts, registryOptions, repositoryOptions, chartVerification, chartLock, bundleIncludeImages)
+		if err != nil {
+			panic(err)
+		}
+
+		err = builder.Create(bundleOutputPath)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleCreateCmd)
+
+	bundleCreateCmd.PersistentFlags().StringVarP(&bundleOutputPath, "output", "f", "ouctl-bundle.tgz", "Path to write the bundle to")
+	bundleCreateCmd.PersistentFlags().BoolVar(&bundleIncludeImages, "include-images", false, "Pull every image into the bundle as an OCI layout, using the credentials in your docker configuration")
+	bundleCreateCmd.PersistentFlags().StringVar(&chartLock.Path, "lock-file", openunison.DefaultLockFile, "Path to the lock file the version, repository and digest of each bundled chart are recorded in, set to '' to disable")
+
+	bundleCreateCmd.PersistentFlags().StringVarP(&operatorChart, "operator-chart", "o", "tremolo/openunison-operator", "Helm chart for OpenUnison's operator, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringVarP(&orchestraChart, "orchestra-chart", "c", "tremolo/orchestra", "Helm chart of the orchestra portal, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringVarP(&orchestraLoginPortalChart, "orchestra-login-portal-chart", "l", "tremolo/orchestra-login-portal", "Helm chart for the orchestra login portal, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringVarP(&clusterManagementChart, "cluster-management-chart", "m", "tremolo/openunison-k8s-cluster-management", "Helm chart for enabling cluster management, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringVarP(&addClusterChart, "add-cluster-chart", "a", "tremolo/openunison-k8s-add-cluster", "Helm chart for adding a cluster to OpenUnison, adding '@version' bundles the specific version")
+
+	bundleCreateCmd.PersistentFlags().StringSliceVarP(&preCharts, "prerun-helm-charts", "u", []string{}, "Comma separated list of chart=path to deploy charts before OpenUnison is deployed, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringSliceVarP(&additionalCharts, "additional-helm-charts", "r", []string{}, "Comma separated list of chart=path to deploy additional charts after OpenUnison is deployed, adding '@version' bundles the specific version")
+	bundleCreateCmd.PersistentFlags().StringSliceVarP(&skipCharts, "skip-charts", "i", []string{}, "Comma separated list of charts to leave out of the bundle, such as cluster-management or add-cluster")
+
+	addChartVerificationFlags(bundleCreateCmd)
+
+	addRegistryFlags(bundleCreateCmd)
+	addRepositoryFlags(bundleCreateCmd)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+var integrationAccountName string
+var integrationAccountContextName string
+var integrationAccountServer string
+var integrationAccountTokenDuration time.Duration
+var integrationAccountOutputPath string
+
+// controlPlaneCmd represents the control-plane command
+var controlPlaneCmd = &cobra.Command{
+	Use:   "control-plane",
+	Short: "Manages a control plane OpenUnison",
+	Long:  ``,
+}
+
+// controlPlaneCreateIntegrationAccountCmd represents the control-plane create-integration-account command
+var controlPlaneCreateIntegrationAccountCmd = &cobra.Command{
+	Use:   "create-integration-account",
+	Short: "Creates a ServiceAccount satelite admins can use to integrate satelites with the control plane in the current context",
+	Long: `Creates or updates the following in the control plane's namespace so install-satelite can be run without an admin context for the control plane:
+	1.  A ServiceAccount
+	2.  The Secret satelite client secrets are stored in, --control-plane-secret-name
+	3.  A Role that can read and update only that Secret, read, create and update ConfigMaps for helm's release storage, read Ingresses and openunisons, and write the other openunison.tremolo.io objects the add-cluster chart creates
+	4.  A RoleBinding for the ServiceAccount
+	5.  A kubeconfig with the ServiceAccount's token, written to --output
+Anyone with the kubeconfig can read every satelite's client secret, so protect it.
+Pass the kubeconfig, or a Secret containing it, to install-satelite with --control-plane-kubeconfig, --control-plane-helm-driver configmap and --fetch-control-plane-chain, since the account can't list Secrets or read TLS secrets.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		account, err := openunison.NewIntegrationAccount(namespace, integrationAccountName, controlPlaneSecretName, integrationAccountContextName, integrationAccountServer, integrationAccountTokenDuration)
+		if err != nil {
+			panic(err)
+		}
+
+		err = account.Create(integrationAccountOutputPath)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(controlPlaneCmd)
+	controlPlaneCmd.AddCommand(controlPlaneCreateIntegrationAccountCmd)
+
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().StringVar(&integrationAccountName, "service-account-name", "ouctl-satelite-integration", "The name of the ServiceAccount, Role and RoleBinding")
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().StringVarP(&controlPlaneSecretName, "control-plane-secret-name", "w", openunison.SateliteClientSecretName, "The name of the Secret satelite client secrets are stored in, the only Secret the account can read")
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().StringVar(&integrationAccountContextName, "context-name", "", "The name of the context in the kubeconfig, defaults to the current context's name")
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().StringVar(&integrationAccountServer, "server", "", "The control plane's API server url in the kubeconfig, defaults to the current context's")
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().DurationVar(&integrationAccountTokenDuration, "token-duration", 0, "How long the token is valid for, such as 720h.  If 0 a token that doesn't expire is stored in a Secret")
+	controlPlaneCreateIntegrationAccountCmd.PersistentFlags().StringVarP(&integrationAccountOutputPath, "output", "f", "control-plane-kubeconfig.yaml", "Path to write the kubeconfig to")
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+var gitOpsOptions openunison.GitOpsOptions
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Writes the charts install-auth-portal would deploy as Argo CD Applications or Flux HelmReleases, requires one argument: The path to the values.yaml",
+	Long: `Locates the same charts install-auth-portal deploys, in the same order, and writes a manifest for each to --output-dir with the chart version pinned to the version that was located.
+	argocd - an Application per chart, with sync waves that keep ouctl's order when synced by a parent Application
+	flux   - a HelmRepository per repository and a HelmRelease per chart, each depending on the chart before it
+Charts must come from a helm repository, an OCI registry or git.  Charts from git (git+) are pinned to the commit they were checked out from, as an Application's git source or a Flux GitRepository.  Local charts (file://) and chart archive urls (https://) can't be read by Argo CD or Flux, so they can't be exported.
+orchestra-secrets-source is only exported when --secret-output is sealedsecret or externalsecret.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("Requires one argument: The path to the values.yaml")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+
+		pathToValuesYaml = args[0]
+
+		openunisonDeployment, err := openunison.NewOpenUnisonDeployment(parseDeploymentOptions(cmd))
+
+		if err != nil {
+			panic(err)
+		}
+
+		err = openunisonDeployment.ExportGitOps(gitOpsOptions)
+		if err != nil {
+			panic(err)
+		}
+
+		err = openunisonDeployment.SaveLockFile()
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	addGitOpsFlags(exportCmd)
+
+	exportCmd.PersistentFlags().StringVarP(&operatorChart, "operator-chart", "o", "tremolo/openunison-operator", "Helm chart for OpenUnison's operator, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringVarP(&orchestraChart, "orchestra-chart", "c", "tremolo/orchestra", "Helm chart of the orchestra portal, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringVarP(&orchestraLoginPortalChart, "orchestra-login-portal-chart", "l", "tremolo/orchestra-login-portal", "Helm chart for the orchestra login portal, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringVarP(&secretFile, "secrets-file-path", "s", "", "Path to file containing the authentication secret, or a secret source (env:VAR, file:path, exec:command, k8s:context/namespace/name/key)")
+	exportCmd.PersistentFlags().StringVar(&pathToSecrets, "secrets", "", "Path to a YAML or dotenv file of keys to add to orchestra-secrets-source, such as OIDC_CLIENT_SECRET, AD_BIND_PASSWORD, OU_JDBC_PASSWORD and SMTP_PASSWORD.  Use '-' to read from stdin, or a secret source")
+	exportCmd.PersistentFlags().StringArrayVar(&secretSources, "secret", []string{}, "KEY=source to add to orchestra-secrets-source, where source is one of env:VAR, file:path, exec:command or k8s:context/namespace/name/key, may be repeated")
+
+	exportCmd.PersistentFlags().StringVarP(&clusterManagementChart, "cluster-management-chart", "m", "tremolo/openunison-k8s-cluster-management", "Helm chart for enabling cluster management, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringVarP(&pathToDbPassword, "database-secret-path", "b", "", "Path to file containing the database password, or a secret source")
+	exportCmd.PersistentFlags().StringVarP(&pathToSmtpPassword, "smtp-secret-path", "t", "", "Path to file containing the smtp password, or a secret source")
+
+	exportCmd.PersistentFlags().BoolVarP(&skipClusterManagement, "skip-cluster-management", "k", false, "Set to true if skipping the cluster management chart when openunison.enable_provisioning is true")
+
+	exportCmd.PersistentFlags().StringSliceVarP(&preCharts, "prerun-helm-charts", "u", []string{}, "Comma separated list of chart=path to deploy charts before OpenUnison is deployed, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringSliceVarP(&additionalCharts, "additional-helm-charts", "r", []string{}, "Comma separated list of chart=path to deploy additional charts after OpenUnison is deployed, adding '@version' installs the specific version")
+	exportCmd.PersistentFlags().StringSliceVarP(&skipCharts, "skip-charts", "i", []string{}, "Comma separated list of charts to leave out of the export")
+
+	exportCmd.PersistentFlags().StringSliceVarP(&namespaceLabels, "namespace-labels", "j", []string{}, "Comma separated list of name=value of labels to add to the openunison namespace")
+	addSecretOutputFlags(exportCmd)
+	addChartLockFlags(exportCmd)
+	addChartVerificationFlags(exportCmd)
+
+	addRegistryFlags(exportCmd)
+	addRepositoryFlags(exportCmd)
+}
+
+// adds the flags for the format and location of exported manifests
+func addGitOpsFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.Format, "format", openunison.GitOpsFormatArgoCD, "Format of the exported manifests, one of argocd or flux")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.OutputDir, "output-dir", ".", "Directory to write the manifests to")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.ValuesMode, "values-mode", openunison.GitOpsValuesInline, "How values are added to each release, one of inline or configmap (flux only)")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.ArgoCDNamespace, "argocd-namespace", "argocd", "Namespace Argo CD Applications are created in")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.ArgoCDProject, "argocd-project", "default", "Argo CD project for the Applications")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.DestinationServer, "destination-server", "https://kubernetes.default.svc", "API server Argo CD deploys the Applications to")
+	cmd.PersistentFlags().StringVar(&gitOpsOptions.FluxNamespace, "flux-namespace", "flux-system", "Namespace Flux HelmRepositories, HelmReleases and ConfigMaps are created in")
+}
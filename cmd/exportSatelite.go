@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+// exportSateliteCmd represents the export-satelite command
+var exportSateliteCmd = &cobra.Command{
+	Use:   "export-satelite",
+	Short: "Writes a satelite and its control plane integration as GitOps bundles instead of deploying them",
+	Long: `This command generates the same configuration as install-satelite, but instead of deploying it writes a bundle for each cluster to a directory named for its context in --output-dir:
+	1.  The control plane's bundle has the add-cluster release and the Secret with the satelite's client secret
+	2.  The satelite's bundle has its releases and orchestra-secrets-source
+The clusters are only read from, so --secret-output must be sealedsecret or externalsecret.  Commit each bundle to the cluster's repository to deploy the satelite.
+Charts must come from a helm repository, an OCI registry or git, local charts (file://) and chart archive urls (https://) can't be exported.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 3 {
+			return errors.New("requires three arguments: The path to the values.yaml, the control plane context name and the satelite context name")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToValuesYaml = args[0]
+		controlPlaneCtxName := args[1]
+		sateliteCtxName := args[2]
+
+		openunisonDeployment, err := openunison.NewSateliteDeployment(parseDeploymentOptions(cmd), parseSateliteOptions(controlPlaneCtxName, sateliteCtxName))
+
+		if err != nil {
+			panic(err)
+		}
+
+		err = openunisonDeployment.ExportSateliteGitOps(gitOpsOptions)
+		if err != nil {
+			panic(err)
+		}
+
+		err = openunisonDeployment.SaveLockFile()
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportSateliteCmd)
+
+	addGitOpsFlags(exportSateliteCmd)
+
+	exportSateliteCmd.PersistentFlags().StringVarP(&operatorChart, "operator-chart", "o", "tremolo/openunison-operator", "Helm chart for OpenUnison's operator, adding '@version' installs the specific version")
+	exportSateliteCmd.PersistentFlags().StringVarP(&orchestraChart, "orchestra-chart", "c", "tremolo/orchestra", "Helm chart of the orchestra portal, adding '@version' installs the specific version")
+	exportSateliteCmd.PersistentFlags().StringVarP(&orchestraLoginPortalChart, "orchestra-login-portal-chart", "l", "tremolo/orchestra-login-portal", "Helm chart for the orchestra login portal, adding '@version' installs the specific version")
+	exportSateliteCmd.PersistentFlags().StringVarP(&addClusterChart, "add-cluster-chart", "a", "tremolo/openunison-k8s-add-cluster", "Helm chart for adding a cluster to OpenUnison, adding '@version' installs the specific version")
+
+	exportSateliteCmd.PersistentFlags().StringVar(&pathToSecrets, "secrets", "", "Path to a YAML or dotenv file of keys to add to orchestra-secrets-source on the satelite.  Use '-' to read from stdin, or a secret source")
+	exportSateliteCmd.PersistentFlags().StringArrayVar(&secretSources, "secret", []string{}, "KEY=source to add to orchestra-secrets-source on the satelite, where source is one of env:VAR, file:path, exec:command or k8s:context/namespace/name/key, may be repeated")
+
+	exportSateliteCmd.PersistentFlags().StringVarP(&pathToSateliteYaml, "save-satelite-values-path", "s", "", "If specified, the values generated for the satelite integration on the control plane are saved to this path")
+
+	exportSateliteCmd.PersistentFlags().StringSliceVarP(&preCharts, "prerun-helm-charts", "u", []string{}, "Comma separated list of chart=path to deploy charts before OpenUnison is deployed, adding '@version' installs the specific version")
+	exportSateliteCmd.PersistentFlags().StringSliceVarP(&additionalCharts, "additional-helm-charts", "r", []string{}, "Comma separated list of chart=path to deploy additional charts after OpenUnison is deployed, adding '@version' installs the specific version")
+
+	exportSateliteCmd.PersistentFlags().StringSliceVarP(&namespaceLabels, "namespace-labels", "j", []string{}, "Comma separated list of name=value of labels to add to the openunison namespace")
+	exportSateliteCmd.PersistentFlags().StringVar(&controlPlaneNamespace, "control-plane-namespace", "", "The namespace of OpenUnison on the control plane, defaults to --namespace")
+	exportSateliteCmd.PersistentFlags().StringVarP(&controlPlaneOrchestraChartName, "control-plane-orchestra-chart-name", "q", "orchestra", "The name of the orchestra chart on the control plane")
+	exportSateliteCmd.PersistentFlags().StringVarP(&controlPlaneSecretName, "control-plane-secret-name", "w", openunison.SateliteClientSecretName, "The name of the secret on the control plane to store client secrets in.  Client secrets in orchestra-secrets-source are moved to it")
+	exportSateliteCmd.PersistentFlags().StringVar(&controlPlaneKubeconfig, "control-plane-kubeconfig", "", "Path to a kubeconfig, or a secret source such as k8s:context/namespace/name/key, to reach the control plane with instead of your kubeconfig.  The control plane context name is a context in this kubeconfig")
+
+	exportSateliteCmd.PersistentFlags().BoolVarP(&skipCPIntegration, "skip-controlplane-integration", "k", false, "Set to true to only export the satelite's bundle")
+	exportSateliteCmd.PersistentFlags().BoolVar(&forceTakeover, "force-takeover", false, "Set to true to replace the control plane registration of another cluster that uses the same k8s_cluster_name")
+	exportSateliteCmd.PersistentFlags().StringVar(&controlPlaneHost, "control-plane-host", "", "Host name of the control plane to use as the satelite's issuer, required when the control plane has more than one OU_HOST name")
+	exportSateliteCmd.PersistentFlags().BoolVar(&fetchControlPlaneChain, "fetch-control-plane-chain", false, "Set to true to find the control plane's CA from the certificate chain its host serves instead of its ingress TLS secret")
+	exportSateliteCmd.PersistentFlags().StringVar(&controlPlaneCAFingerprint, "control-plane-ca-fingerprint", "", "SHA-256 fingerprint the CA read with --fetch-control-plane-chain must have, otherwise the fingerprint is confirmed interactively.  Also pins an intermediate CA when the root CA isn't in the chain or the system's CAs")
+	exportSateliteCmd.PersistentFlags().StringSliceVarP(&skipCharts, "skip-charts", "i", []string{}, "Comma separated list of charts to leave out of the satelite's bundle")
+
+	addSecretOutputFlags(exportSateliteCmd)
+	addChartLockFlags(exportSateliteCmd)
+	addChartVerificationFlags(exportSateliteCmd)
+
+	addRegistryFlags(exportSateliteCmd)
+	addRepositoryFlags(exportSateliteCmd)
+}
@@ -28,7 +28,12 @@ var installAuthPortalCmd = &cobra.Command{
 
 		pathToValuesYaml = args[0]
 
-		openunisonDeployment, err := openunison.NewOpenUnisonDeployment(namespace, operatorChart, orchestraChart, orchestraLoginPortalChart, pathToValuesYaml, secretFile, clusterManagementChart, pathToDbPassword, pathToSmtpPassword, skipClusterManagement, parseChartSlices(&additionalCharts), parseChartSlices(&preCharts), parseNamespaceLabels(&namespaceLabels), skipCharts, ociCaCertPath)
+		options := parseDeploymentOptions(cmd)
+		options.PathToBundle = pathToBundle
+		options.ImageRelocation = parseImageRelocation()
+		options.PostRenderers = parsePostRenderers()
+
+		openunisonDeployment, err := openunison.NewOpenUnisonDeployment(options)
 
 		if err != nil {
 			panic(err)
@@ -57,6 +62,11 @@ var installAuthPortalCmd = &cobra.Command{
 			}
 		}
 
+		err = openunisonDeployment.SaveLockFile()
+		if err != nil {
+			panic(err)
+		}
+
 	},
 }
 
@@ -72,11 +82,13 @@ func init() {
 
 	installAuthPortalCmd.PersistentFlags().StringVarP(&orchestraChart, "orchestra-chart", "c", "tremolo/orchestra", "Helm chart of the orchestra portal, adding '@version' installs the specific version")
 	installAuthPortalCmd.PersistentFlags().StringVarP(&orchestraLoginPortalChart, "orchestra-login-portal-chart", "l", "tremolo/orchestra-login-portal", "Helm chart for the orchestra login portal, adding '@version' installs the specific version")
-	installAuthPortalCmd.PersistentFlags().StringVarP(&secretFile, "secrets-file-path", "s", "", "Path to file containing the authentication secret")
+	installAuthPortalCmd.PersistentFlags().StringVarP(&secretFile, "secrets-file-path", "s", "", "Path to file containing the authentication secret, or a secret source (env:VAR, file:path, exec:command, k8s:context/namespace/name/key)")
+	installAuthPortalCmd.PersistentFlags().StringVar(&pathToSecrets, "secrets", "", "Path to a YAML or dotenv file of keys to add to orchestra-secrets-source, such as OIDC_CLIENT_SECRET, AD_BIND_PASSWORD, OU_JDBC_PASSWORD and SMTP_PASSWORD.  Use '-' to read from stdin, or a secret source")
+	installAuthPortalCmd.PersistentFlags().StringArrayVar(&secretSources, "secret", []string{}, "KEY=source to add to orchestra-secrets-source, where source is one of env:VAR, file:path, exec:command or k8s:context/namespace/name/key, may be repeated")
 
 	installAuthPortalCmd.PersistentFlags().StringVarP(&clusterManagementChart, "cluster-management-chart", "m", "tremolo/openunison-k8s-cluster-management", "Helm chart for enabling cluster management, adding '@version' installs the specific version")
-	installAuthPortalCmd.PersistentFlags().StringVarP(&pathToDbPassword, "database-secret-path", "b", "", "Path to file containing the database password")
-	installAuthPortalCmd.PersistentFlags().StringVarP(&pathToSmtpPassword, "smtp-secret-path", "t", "", "Path to file containing the smtp password")
+	installAuthPortalCmd.PersistentFlags().StringVarP(&pathToDbPassword, "database-secret-path", "b", "", "Path to file containing the database password, or a secret source")
+	installAuthPortalCmd.PersistentFlags().StringVarP(&pathToSmtpPassword, "smtp-secret-path", "t", "", "Path to file containing the smtp password, or a secret source")
 
 	installAuthPortalCmd.PersistentFlags().BoolVarP(&skipClusterManagement, "skip-cluster-management", "k", false, "Set to true if skipping the cluster management chart when openunison.enable_provisioning is true")
 
@@ -87,7 +99,15 @@ func init() {
 	installAuthPortalCmd.PersistentFlags().StringSliceVarP(&additionalCharts, "additional-helm-charts", "r", []string{}, "Comma separated list of chart=path to deploy additional charts after OpenUnison is deployed, adding '@version' installs the specific version")
 
 	installAuthPortalCmd.PersistentFlags().StringSliceVarP(&namespaceLabels, "namespace-labels", "j", []string{}, "Comma separated list of name=value of labels to add to the openunison namespace")
-	installAuthPortalCmd.PersistentFlags().StringVarP(&ociCaCertPath, "oci-cacert-path", "p", "", "Path to a PEM file containing the CA certificate")
+	addSecretOutputFlags(installAuthPortalCmd)
+	addChartLockFlags(installAuthPortalCmd)
+	addChartVerificationFlags(installAuthPortalCmd)
+	addPostRendererFlags(installAuthPortalCmd)
+	addImageRelocationFlags(installAuthPortalCmd)
+
+	addRegistryFlags(installAuthPortalCmd)
+	addRepositoryFlags(installAuthPortalCmd)
+	installAuthPortalCmd.PersistentFlags().StringVar(&pathToBundle, "bundle", "", "Path to a bundle created with 'bundle create', charts are loaded from the bundle instead of their repositories")
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// installAuthPortalCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -15,7 +15,7 @@ var installSateliteCmd = &cobra.Command{
 	Use:   "install-satelite",
 	Short: "Installs a satelite OpenUnison that relies on a control-plane openunison for authentication",
 	Long: `This command will deploy an OpenUnison into a satelite cluster for authentication into that cluster using openid connect, using a control-plane OpenUnison as the identity provider.  It will:
-	1.  Verify that a cluster with the same name isn't in use
+	1.  Verify that a cluster with the same name isn't in use by another cluster, unless --force-takeover is set
 	2.  Create the appropriate Secret in the control plane
 	3.  Generate the correct oidc configuration for the satelite and write it to the values file supplied by this command
 	4.  Deploy openunison into the satelite cluster
@@ -32,7 +32,12 @@ var installSateliteCmd = &cobra.Command{
 		controlPlaneCtxName := args[1]
 		sateliteCtxName := args[2]
 
-		openunisonDeployment, err := openunison.NewSateliteDeployment(namespace, operatorChart, orchestraChart, orchestraLoginPortalChart, pathToValuesYaml, secretFile, controlPlaneCtxName, sateliteCtxName, addClusterChart, pathToSateliteYaml, parseChartSlices(&additionalCharts), parseChartSlices(&preCharts), parseNamespaceLabels(&namespaceLabels), controlPlaneOrchestraChartName, controlPlaneSecretName, skipCPIntegration, skipCharts, ociCaCertPath)
+		options := parseDeploymentOptions(cmd)
+		options.PathToBundle = pathToBundle
+		options.ImageRelocation = parseImageRelocation()
+		options.PostRenderers = parsePostRenderers()
+
+		openunisonDeployment, err := openunison.NewSateliteDeployment(options, parseSateliteOptions(controlPlaneCtxName, sateliteCtxName))
 
 		if err != nil {
 			panic(err)
@@ -42,6 +47,11 @@ var installSateliteCmd = &cobra.Command{
 		if err != nil {
 			panic(err)
 		}
+
+		err = openunisonDeployment.SaveLockFile()
+		if err != nil {
+			panic(err)
+		}
 	},
 }
 
@@ -54,6 +64,9 @@ func init() {
 	installSateliteCmd.PersistentFlags().StringVarP(&orchestraLoginPortalChart, "orchestra-login-portal-chart", "l", "tremolo/orchestra-login-portal", "Helm chart for the orchestra login portal, adding '@version' installs the specific version")
 	installSateliteCmd.PersistentFlags().StringVarP(&addClusterChart, "add-cluster-chart", "a", "tremolo/openunison-k8s-add-cluster", "Helm chart for adding a cluster to OpenUnison, adding '@version' installs the specific version")
 
+	installSateliteCmd.PersistentFlags().StringVar(&pathToSecrets, "secrets", "", "Path to a YAML or dotenv file of keys to add to orchestra-secrets-source on the satelite.  Use '-' to read from stdin, or a secret source")
+	installSateliteCmd.PersistentFlags().StringArrayVar(&secretSources, "secret", []string{}, "KEY=source to add to orchestra-secrets-source on the satelite, where source is one of env:VAR, file:path, exec:command or k8s:context/namespace/name/key, may be repeated")
+
 	installSateliteCmd.PersistentFlags().StringVarP(&pathToSateliteYaml, "save-satelite-values-path", "s", "", "If specified, the values generated for the satelite integration on the control plane are saved to this path")
 
 	preCharts = make([]string, 0)
@@ -63,11 +76,26 @@ func init() {
 	installSateliteCmd.PersistentFlags().StringSliceVarP(&additionalCharts, "additional-helm-charts", "r", []string{}, "Comma separated list of chart=path to deploy additional charts after OpenUnison is deployed, adding '@version' installs the specific version")
 
 	installSateliteCmd.PersistentFlags().StringSliceVarP(&namespaceLabels, "namespace-labels", "j", []string{}, "Comma separated list of name=value of labels to add to the openunison namespace")
+	installSateliteCmd.PersistentFlags().StringVar(&controlPlaneNamespace, "control-plane-namespace", "", "The namespace of OpenUnison on the control plane, defaults to --namespace")
 	installSateliteCmd.PersistentFlags().StringVarP(&controlPlaneOrchestraChartName, "control-plane-orchestra-chart-name", "q", "orchestra", "The name of the orchestra chart on the control plane")
-	installSateliteCmd.PersistentFlags().StringVarP(&controlPlaneSecretName, "control-plane-secret-name", "w", "orchestra-secrets-source", "The name of the secret on the control plane to store client secrets in")
+	installSateliteCmd.PersistentFlags().StringVarP(&controlPlaneSecretName, "control-plane-secret-name", "w", openunison.SateliteClientSecretName, "The name of the secret on the control plane to store client secrets in.  Client secrets in orchestra-secrets-source are moved to it")
+	installSateliteCmd.PersistentFlags().StringVar(&controlPlaneHelmDriver, "control-plane-helm-driver", "", "The helm storage driver for the satelite's release on the control plane, defaults to HELM_DRIVER.  Set to configmap with an integration account")
+	installSateliteCmd.PersistentFlags().StringVar(&controlPlaneKubeconfig, "control-plane-kubeconfig", "", "Path to a kubeconfig, or a secret source such as k8s:context/namespace/name/key, to reach the control plane with instead of your kubeconfig.  The control plane context name is a context in this kubeconfig")
 
 	installSateliteCmd.PersistentFlags().BoolVarP(&skipCPIntegration, "skip-controlplane-integration", "k", false, "Set to true if skipping the control plane integration step.  Used when upgrading a satelite.")
+	installSateliteCmd.PersistentFlags().BoolVar(&forceTakeover, "force-takeover", false, "Set to true to replace the control plane registration of another cluster that uses the same k8s_cluster_name")
+	installSateliteCmd.PersistentFlags().StringVar(&controlPlaneHost, "control-plane-host", "", "Host name of the control plane to use as the satelite's issuer, required when the control plane has more than one OU_HOST name")
+	installSateliteCmd.PersistentFlags().BoolVar(&fetchControlPlaneChain, "fetch-control-plane-chain", false, "Set to true to find the control plane's CA from the certificate chain its host serves instead of its ingress TLS secret")
+	installSateliteCmd.PersistentFlags().StringVar(&controlPlaneCAFingerprint, "control-plane-ca-fingerprint", "", "SHA-256 fingerprint the CA read with --fetch-control-plane-chain must have, otherwise the fingerprint is confirmed interactively.  Also pins an intermediate CA when the root CA isn't in the chain or the system's CAs")
 	installSateliteCmd.PersistentFlags().StringSliceVarP(&skipCharts, "skip-charts", "i", []string{}, "Comma separated list of charts to skip during the deployment.  May be used to run 'hot upgrades' that doesn't require restarts")
 
-	installSateliteCmd.PersistentFlags().StringVarP(&ociCaCertPath, "oci-cacert-path", "p", "", "Path to a PEM file containing the CA certificate")
+	addSecretOutputFlags(installSateliteCmd)
+	addChartLockFlags(installSateliteCmd)
+	addChartVerificationFlags(installSateliteCmd)
+	addPostRendererFlags(installSateliteCmd)
+	addImageRelocationFlags(installSateliteCmd)
+
+	addRegistryFlags(installSateliteCmd)
+	addRepositoryFlags(installSateliteCmd)
+	installSateliteCmd.PersistentFlags().StringVar(&pathToBundle, "bundle", "", "Path to a bundle created with 'bundle create', charts are loaded from the bundle instead of their repositories")
 }
@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -35,6 +36,8 @@ var pathToValuesYaml string
 var addClusterChart string
 
 var clusterManagementChart string
+var pathToSecrets string
+var secretSources []string
 var pathToDbPassword string
 var pathToSmtpPassword string
 
@@ -47,13 +50,40 @@ var preCharts []string
 
 var namespaceLabels []string
 
+var controlPlaneNamespace string
 var controlPlaneOrchestraChartName string
 var controlPlaneSecretName string
+var controlPlaneHelmDriver string
+var controlPlaneKubeconfig string
 
 var skipCPIntegration bool
+var forceTakeover bool
+var controlPlaneHost string
+var fetchControlPlaneChain bool
+var controlPlaneCAFingerprint string
 var skipCharts []string
 
-var ociCaCertPath string
+var registryOptions openunison.RegistryOptions
+
+var repositoryOptions openunison.RepositoryOptions
+
+var pathToBundle string
+
+var imageRegistry string
+var pathToImageRelocationMap string
+var imagePullSecretDockerConfig string
+var imagePullSecretName string
+
+var postRenderers []string
+
+var chartLock openunison.ChartLock
+
+var chartVerification openunison.ChartVerification
+
+var secretOutput openunison.SecretOutput
+
+var secretLength int
+var secretCharset string
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
@@ -70,12 +100,67 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "openunison", "namespace to deploy openunison into")
+	rootCmd.PersistentFlags().IntVar(&secretLength, "secret-length", 64, "Length of secrets generated by ouctl")
+	rootCmd.PersistentFlags().StringVar(&secretCharset, "secret-charset", "alphanumeric", "Characters used in secrets generated by ouctl, one of alphanumeric, alphanumeric-symbols, hex or a literal list of at least 16 characters")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// the deployment options from the flags shared by the install and export commands, bundles, image relocation and post
+// renderers are only set by the install commands
+func parseDeploymentOptions(cmd *cobra.Command) openunison.DeploymentOptions {
+	// charts are only recorded when asked for, so a run doesn't leave an ouctl.lock behind
+	chartLock.Record = cmd.Flags().Changed("lock-file")
+
+	return openunison.DeploymentOptions{
+		Namespace:                 namespace,
+		OperatorChart:             operatorChart,
+		OrchestraChart:            orchestraChart,
+		OrchestraLoginPortalChart: orchestraLoginPortalChart,
+		ClusterManagementChart:    clusterManagementChart,
+		PathToValuesYaml:          pathToValuesYaml,
+		SecretFile:                secretFile,
+		PathToSecrets:             pathToSecrets,
+		SecretSources:             parseSecretSources(&secretSources),
+		PathToDbPassword:          pathToDbPassword,
+		PathToSmtpPassword:        pathToSmtpPassword,
+		SkipClusterManagement:     skipClusterManagement,
+		AdditionalCharts:          parseChartSlices(&additionalCharts),
+		PreCharts:                 parseChartSlices(&preCharts),
+		NamespaceLabels:           parseNamespaceLabels(&namespaceLabels),
+		SkipCharts:                skipCharts,
+		RegistryOptions:           registryOptions,
+		RepositoryOptions:         repositoryOptions,
+		PostRenderers:             map[string]string{},
+		ChartLock:                 chartLock,
+		ChartVerification:         chartVerification,
+		SecretPolicy:              parseSecretPolicy(),
+		SecretOutput:              secretOutput,
+	}
+}
+
+// the satelite options from the flags shared by install-satelite and export-satelite
+func parseSateliteOptions(controlPlaneCtxName string, sateliteCtxName string) openunison.SateliteOptions {
+	return openunison.SateliteOptions{
+		ControlPlaneContextName:     controlPlaneCtxName,
+		SateliteContextName:         sateliteCtxName,
+		AddClusterChart:             addClusterChart,
+		PathToSateliteYaml:          pathToSateliteYaml,
+		ControlPlaneNamespace:       controlPlaneNamespace,
+		ControlPlaneOrchestraName:   controlPlaneOrchestraChartName,
+		ControlPlaneSecretName:      controlPlaneSecretName,
+		ControlPlaneHelmDriver:      controlPlaneHelmDriver,
+		ControlPlaneKubeconfig:      controlPlaneKubeconfig,
+		ControlPlaneHost:            controlPlaneHost,
+		FetchControlPlaneChain:      fetchControlPlaneChain,
+		ControlPlaneCAFingerprint:   controlPlaneCAFingerprint,
+		SkipControlPlaneIntegration: skipCPIntegration,
+		ForceTakeover:               forceTakeover,
+	}
+}
+
 func parseNamespaceLabels(namespaceLabels *[]string) map[string]string {
 	nsLabelsMap := make(map[string]string)
 
@@ -87,10 +172,135 @@ func parseNamespaceLabels(namespaceLabels *[]string) map[string]string {
 	return nsLabelsMap
 }
 
+func parseSecretPolicy() openunison.SecretPolicy {
+	policy, err := openunison.NewSecretPolicy(secretLength, secretCharset)
+	if err != nil {
+		panic(err)
+	}
+
+	return policy
+}
+
+// adds the flags for writing Secrets as SealedSecrets or ExternalSecrets
+func addSecretOutputFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&secretOutput.Mode, "secret-output", openunison.SecretOutputApi, "How Secrets are written, one of api (create Secrets in the cluster), sealedsecret or externalsecret (write manifests to --secret-output-dir)")
+	cmd.PersistentFlags().StringVar(&secretOutput.OutputDir, "secret-output-dir", ".", "Directory to write SealedSecret and ExternalSecret manifests to")
+	cmd.PersistentFlags().StringVar(&secretOutput.SealedSecretsCertPath, "sealed-secrets-cert", "", "Path to the sealed secrets controller's certificate, required for sealedsecret")
+	cmd.PersistentFlags().StringVar(&secretOutput.ExternalSecretStore, "external-secret-store", "", "Name of the secret store ExternalSecrets reference, required for externalsecret")
+	cmd.PersistentFlags().StringVar(&secretOutput.ExternalSecretStoreKind, "external-secret-store-kind", "SecretStore", "Kind of the secret store, SecretStore or ClusterSecretStore")
+	cmd.PersistentFlags().StringVar(&secretOutput.ExternalSecretKeyPath, "external-secret-key-path", "{cluster}/{namespace}/{name}", "Remote key in the secret store, {cluster} is replaced with the context name, {namespace} and {name} with the Secret's")
+	cmd.PersistentFlags().StringVar(&secretOutput.ExternalSecretValuesDir, "external-secret-values-dir", "", "Directory to write values that must be added to the secret store to, a file per property in a directory per remote key.  The values are written in plaintext with mode 0600, delete them once they're stored.  Required for externalsecret when ouctl generates a value")
+}
+
+// adds the flags for pulling images from a private registry
+func addImageRelocationFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&imageRegistry, "image-registry", "", "Registry to pull every image from, replacing the image's registry and keeping its path")
+	cmd.PersistentFlags().StringVar(&pathToImageRelocationMap, "image-relocation-map", "", "Path to a YAML file with a registry and mappings of image prefixes to their replacement, the longest matching prefix wins")
+	cmd.PersistentFlags().StringVar(&imagePullSecretDockerConfig, "image-pull-secret-docker-config", "", "Path to a docker config.json to create an image pull secret from in each namespace ouctl deploys pods to")
+	cmd.PersistentFlags().StringVar(&imagePullSecretName, "image-pull-secret-name", "", "Name of the image pull secret, defaults to ouctl-image-pull when --image-pull-secret-docker-config is set")
+}
+
+// adds the flag for patching charts with a post-renderer
+func addPostRendererFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringArrayVar(&postRenderers, "post-renderer", []string{}, "Post-renderer for a release in the form release=path, the path is a kustomize directory or an executable with optional arguments split like a shell command, so quote paths with spaces, use *=path for every release without its own, may be repeated")
+}
+
+// adds the flags for recording charts in a lock file and installing only the charts it has
+func addChartLockFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&chartLock.Path, "lock-file", openunison.DefaultLockFile, "Path to the lock file --locked checks charts against, when set the version, repository and digest of each chart are recorded in it after a successful run")
+	cmd.PersistentFlags().BoolVar(&chartLock.Locked, "locked", false, "Only install charts that match the lock file, charts without '@version' use the locked version")
+}
+
+// adds the flags for connecting to OCI registries
+func addRegistryFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&registryOptions.CaCertPath, "oci-cacert-path", "p", "", "Path to a PEM file containing the CA certificate")
+	cmd.PersistentFlags().StringVar(&registryOptions.CertFile, "oci-cert-file", "", "Path to a PEM client certificate for OCI registries that require one")
+	cmd.PersistentFlags().StringVar(&registryOptions.KeyFile, "oci-key-file", "", "Path to the PEM key of the OCI client certificate")
+	cmd.PersistentFlags().BoolVar(&registryOptions.InsecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Skip verifying the certificates of OCI registries")
+	cmd.PersistentFlags().BoolVar(&registryOptions.PlainHTTP, "plain-http", false, "Connect to OCI registries over http instead of https")
+	cmd.PersistentFlags().StringVar(&registryOptions.Username, "oci-username", "", "Username for OCI registries, requires --oci-password")
+	cmd.PersistentFlags().StringVar(&registryOptions.PasswordPath, "oci-password", "", "Path to a file containing the password for OCI registries, or a secret source")
+	cmd.PersistentFlags().StringVar(&registryOptions.TokenPath, "oci-token", "", "Path to a file containing a bearer token for OCI registries, or a secret source")
+	cmd.PersistentFlags().StringVar(&registryOptions.ConfigPath, "oci-registry-config", "", "Path to a docker config.json with credentials for OCI registries, by default helm's registry configuration and docker's are used")
+	cmd.PersistentFlags().StringVar(&registryOptions.CacheDir, "chart-cache-dir", "", "Directory OCI charts are saved to and reused from, by default they're loaded in memory and not saved")
+}
+
+// adds the flags for the Tremolo helm repository and connecting to helm repositories
+func addRepositoryFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&repositoryOptions.URL, "repo-url", "", "URL of the tremolo helm repository, such as a mirror.  If the repository isn't configured it's added with "+openunison.DefaultTremoloRepoURL)
+	cmd.PersistentFlags().StringVar(&repositoryOptions.Username, "repo-username", "", "Username for helm repositories, requires --repo-password")
+	cmd.PersistentFlags().StringVar(&repositoryOptions.PasswordPath, "repo-password", "", "Path to a file containing the password for helm repositories, or a secret source")
+	cmd.PersistentFlags().StringVar(&repositoryOptions.CaFile, "repo-ca-file", "", "Path to a PEM file containing the CA certificate of helm repositories")
+	cmd.PersistentFlags().StringVar(&repositoryOptions.CertFile, "repo-cert-file", "", "Path to a PEM client certificate for helm repositories that require one")
+	cmd.PersistentFlags().StringVar(&repositoryOptions.KeyFile, "repo-key-file", "", "Path to the PEM key of the helm repository client certificate")
+	cmd.PersistentFlags().BoolVar(&repositoryOptions.InsecureSkipTLSVerify, "repo-insecure-skip-tls-verify", false, "Skip verifying the certificates of helm repositories")
+}
+
+// adds the flags for verifying charts are signed by a trusted key
+func addChartVerificationFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&chartVerification.Verify, "verify", false, "Fail if any chart isn't signed by a trusted key, charts from repositories are verified with their provenance file and OCI charts with their cosign signature")
+	cmd.PersistentFlags().StringVar(&chartVerification.Keyring, "keyring", defaultKeyring(), "Keyring with the public keys trusted to sign provenance files")
+	cmd.PersistentFlags().StringSliceVar(&chartVerification.CosignKeys, "cosign-key", []string{}, "Comma separated list of paths to PEM public keys trusted to sign OCI charts with cosign")
+}
+
+// the keyring helm uses by default
+func defaultKeyring() string {
+	if gnupgHome, ok := os.LookupEnv("GNUPGHOME"); ok {
+		return filepath.Join(gnupgHome, "pubring.gpg")
+	}
+
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+func parseImageRelocation() openunison.ImageRelocation {
+	relocation, err := openunison.NewImageRelocation(pathToImageRelocationMap, imageRegistry, imagePullSecretDockerConfig, imagePullSecretName)
+	if err != nil {
+		panic(err)
+	}
+
+	return relocation
+}
+
+func parsePostRenderers() map[string]string {
+	renderers := make(map[string]string)
+
+	for _, renderer := range postRenderers {
+		split := strings.SplitN(renderer, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			panic("post-renderers must be in the form release=path")
+		}
+
+		renderers[split[0]] = split[1]
+	}
+
+	return renderers
+}
+
+func parseSecretSources(secretSources *[]string) map[string]string {
+	sources := make(map[string]string)
+
+	for _, sourcePair := range *secretSources {
+		split := strings.SplitN(sourcePair, "=", 2)
+		if len(split) != 2 {
+			panic("secret sources must be in the form KEY=source")
+		}
+
+		sources[split[0]] = split[1]
+	}
+
+	return sources
+}
+
 func parseChartSlices(additionalCharts *[]string) []openunison.HelmChartInfo {
 	var additionalChartsList []openunison.HelmChartInfo
 	for _, chartPair := range *additionalCharts {
-		split := strings.Split(chartPair, "=")
+		// chart references may have an '=' too, such as ?ref= or #sha256=
+		split := strings.SplitN(chartPair, "=", 2)
+		if len(split) != 2 {
+			panic("charts must be in the form name=chart")
+		}
+
 		chart := openunison.HelmChartInfo{
 			Name:      split[0],
 			ChartPath: split[1],
@@ -0,0 +1,66 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+var secretsSourceName string
+var regenerateSecrets bool
+var includeSateliteSecrets bool
+var keepSecretBackups int
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manages the secrets generated by ouctl",
+	Long:  ``,
+}
+
+// secretsAuditCmd represents the secrets audit command
+var secretsAuditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Reports which generated secrets don't meet the secret policy",
+	Long: `Checks the secrets ouctl generates (unisonKeystorePassword, K8S_DB_SECRET and satelite client secrets) against the policy set by --secret-length and --secret-charset.  With --regenerate, secrets that fail the policy are:
+	1.  Backed up to a new Secret named <secret>-backup-<timestamp>, labeled with ouctl.openunison.tremolo.io/backup-of=<secret>.  Only the newest --keep-backups backups are kept
+	2.  Regenerated, failing if the Secret was changed while the audit was running
+	3.  If unisonKeystorePassword or K8S_DB_SECRET was regenerated, each OpenUnison using the Secret is annotated so the operator regenerates its configuration and its deployment is restarted
+Satelite client secrets are stored in satelite-client-secrets on the control plane, audit them with --secret-name satelite-client-secrets.  They're only regenerated with --include-satelites, re-run install-satelite for each regenerated satelite afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		audit, err := openunison.NewSecretAudit(namespace, secretsSourceName, parseSecretPolicy(), keepSecretBackups)
+		if err != nil {
+			panic(err)
+		}
+
+		results, err := audit.Run(regenerateSecrets, includeSateliteSecrets)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, result := range results {
+			if len(result.Problems) == 0 {
+				fmt.Printf("%s: ok\n", result.Key)
+			} else if result.Regenerated {
+				fmt.Printf("%s: %s - regenerated\n", result.Key, strings.Join(result.Problems, ", "))
+			} else {
+				fmt.Printf("%s: %s\n", result.Key, strings.Join(result.Problems, ", "))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsAuditCmd)
+
+	secretsAuditCmd.PersistentFlags().StringVarP(&secretsSourceName, "secret-name", "w", "orchestra-secrets-source", "The name of the Secret containing the generated secrets")
+	secretsAuditCmd.PersistentFlags().BoolVarP(&regenerateSecrets, "regenerate", "g", false, "Regenerate secrets that don't meet the policy")
+	secretsAuditCmd.PersistentFlags().BoolVar(&includeSateliteSecrets, "include-satelites", false, "Also regenerate satelite client secrets, each satelite must be re-deployed with install-satelite")
+	secretsAuditCmd.PersistentFlags().IntVar(&keepSecretBackups, "keep-backups", 3, "Number of backups of the Secret to keep when regenerating, older backups are deleted.  0 keeps every backup")
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tremolosecurity/openunison-control/openunison"
+)
+
+var trustedCertsWarnDays int
+
+// trustedCertsCmd represents the trusted-certs command
+var trustedCertsCmd = &cobra.Command{
+	Use:   "trusted-certs",
+	Short: "Manages the trusted_certs in a values.yaml",
+	Long:  `Edits only the trusted_certs in a values.yaml, the rest of the file keeps its order and comments.  Entries are de-duplicated by certificate fingerprint whenever the file is changed.  SOPS encrypted values files can't be edited.`,
+}
+
+// trustedCertsAddCmd represents the trusted-certs add command
+var trustedCertsAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Adds a certificate to trusted_certs, requires three arguments: The path to the values.yaml, the certificate's name and the path to its PEM file",
+	Long:  `Adds the certificate, or replaces the certificate with the same name.  If the certificate is already trusted with another name the existing entry is kept.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 3 {
+			return errors.New("requires three arguments: The path to the values.yaml, the certificate's name and the path to its PEM file")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		certsFile, err := openunison.LoadTrustedCertsFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+
+		name, err := certsFile.Add(args[1], args[2])
+		if err != nil {
+			panic(err)
+		}
+
+		err = certsFile.Save()
+		if err != nil {
+			panic(err)
+		}
+
+		if name != args[1] {
+			fmt.Printf("The certificate is already trusted as %s\n", name)
+		} else {
+			fmt.Printf("Trusted %s\n", name)
+		}
+	},
+}
+
+// trustedCertsRemoveCmd represents the trusted-certs remove command
+var trustedCertsRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Removes a certificate from trusted_certs, requires two arguments: The path to the values.yaml and the certificate's name",
+	Long:  ``,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return errors.New("requires two arguments: The path to the values.yaml and the certificate's name")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		certsFile, err := openunison.LoadTrustedCertsFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+
+		err = certsFile.Remove(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		err = certsFile.Save()
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Removed %s\n", args[1])
+	},
+}
+
+// trustedCertsListCmd represents the trusted-certs list command
+var trustedCertsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the certificates in trusted_certs, requires one argument: The path to the values.yaml",
+	Long:  `Lists each certificate's subject, fingerprint and expiration, flagging certificates that are invalid, expired or expire within --warn-days.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("requires one argument: The path to the values.yaml")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		certsFile, err := openunison.LoadTrustedCertsFile(args[0])
+		if err != nil {
+			panic(err)
+		}
+
+		for _, status := range certsFile.Certs.Status(time.Duration(trustedCertsWarnDays) * 24 * time.Hour) {
+			fmt.Printf("%s:\n", status.Name)
+
+			if status.Error != "" {
+				fmt.Printf("  Fingerprint : %s\n", status.Fingerprint)
+				fmt.Printf("  ERROR: %s\n", status.Error)
+				continue
+			}
+
+			fmt.Printf("  Subject     : %s\n", status.Subject)
+			fmt.Printf("  SHA-256     : %s\n", status.Fingerprint)
+			fmt.Printf("  Expires     : %s\n", status.NotAfter.UTC().Format(time.RFC3339))
+
+			if status.Expired {
+				fmt.Printf("  WARNING: this certificate has expired\n")
+			} else if status.ExpiresSoon {
+				fmt.Printf("  WARNING: this certificate expires in less than %d days\n", trustedCertsWarnDays)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trustedCertsCmd)
+	trustedCertsCmd.AddCommand(trustedCertsAddCmd)
+	trustedCertsCmd.AddCommand(trustedCertsRemoveCmd)
+	trustedCertsCmd.AddCommand(trustedCertsListCmd)
+
+	trustedCertsListCmd.PersistentFlags().IntVar(&trustedCertsWarnDays, "warn-days", 30, "Flag certificates that expire within this many days")
+}
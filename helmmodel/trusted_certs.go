@@ -0,0 +1,209 @@
+package helmmodel
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the trusted_certs in OpenUnison's values.yaml.  Names and certificates are kept unique, entries are updated in
+// place so their order in the values.yaml doesn't change
+type TrustedCerts []TrustedCertsInner
+
+// the state of a trusted certificate
+type TrustedCertStatus struct {
+	Name        string
+	Subject     string
+	Fingerprint string
+	NotAfter    time.Time
+	Expired     bool
+	ExpiresSoon bool
+	// set if the entry isn't a valid PEM certificate
+	Error string
+}
+
+// reads trusted_certs from helm values
+func ParseTrustedCerts(values interface{}) (TrustedCerts, error) {
+	certs := make(TrustedCerts, 0)
+	if values == nil {
+		return certs, nil
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &certs)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_certs must be a list of name and pem_b64: %v", err)
+	}
+
+	return certs, nil
+}
+
+// trusted_certs for helm values
+func (certs TrustedCerts) Values() []map[string]string {
+	values := make([]map[string]string, 0, len(certs))
+	for _, cert := range certs {
+		values = append(values, map[string]string{"name": cert.Name, "pem_b64": cert.PemB64})
+	}
+
+	return values
+}
+
+// adds or replaces the certificate with the name, then reconciles.  If the certificate is already trusted with
+// another name the existing entry is kept, the returned name is the one the certificate is trusted with
+func (certs *TrustedCerts) Set(name string, pemData []byte) (string, error) {
+	if _, err := certificateFromPEM(pemData); err != nil {
+		return "", fmt.Errorf("%s isn't a PEM certificate: %v", name, err)
+	}
+
+	pemB64 := base64.StdEncoding.EncodeToString(pemData)
+	fingerprint := entryFingerprint(pemB64)
+
+	// the existing entry is kept even when it comes after the one being set, other values and cert_alias may refer
+	// to its name
+	for _, cert := range *certs {
+		if cert.Name != name && entryFingerprint(cert.PemB64) == fingerprint {
+			certs.Remove(name)
+			certs.Reconcile()
+
+			return cert.Name, nil
+		}
+	}
+
+	updated := false
+	for i := range *certs {
+		if (*certs)[i].Name == name {
+			(*certs)[i].PemB64 = pemB64
+			updated = true
+			break
+		}
+	}
+
+	if !updated {
+		*certs = append(*certs, TrustedCertsInner{Name: name, PemB64: pemB64})
+	}
+
+	certs.Reconcile()
+
+	return name, nil
+}
+
+// removes the certificate with the name, false if there isn't one
+func (certs *TrustedCerts) Remove(name string) bool {
+	for i := range *certs {
+		if (*certs)[i].Name == name {
+			*certs = append((*certs)[0:i], (*certs)[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// removes entries with a name or certificate that's already in the list, the first entry is kept.  Returns a
+// description of each removed entry
+func (certs *TrustedCerts) Reconcile() []string {
+	removed := make([]string, 0)
+
+	names := make(map[string]bool)
+	fingerprints := make(map[string]string)
+
+	reconciled := make(TrustedCerts, 0, len(*certs))
+	for _, cert := range *certs {
+		if names[cert.Name] {
+			removed = append(removed, fmt.Sprintf("%s, a duplicate name", cert.Name))
+			continue
+		}
+
+		fingerprint := entryFingerprint(cert.PemB64)
+		if existing, ok := fingerprints[fingerprint]; ok {
+			removed = append(removed, fmt.Sprintf("%s, the same certificate as %s", cert.Name, existing))
+			continue
+		}
+
+		names[cert.Name] = true
+		fingerprints[fingerprint] = cert.Name
+		reconciled = append(reconciled, cert)
+	}
+
+	*certs = reconciled
+
+	return removed
+}
+
+// the state of each certificate, certificates that expire within warnBefore are flagged
+func (certs TrustedCerts) Status(warnBefore time.Duration) []TrustedCertStatus {
+	statuses := make([]TrustedCertStatus, 0, len(certs))
+	now := time.Now()
+
+	for _, cert := range certs {
+		status := TrustedCertStatus{Name: cert.Name, Fingerprint: entryFingerprint(cert.PemB64)}
+
+		pemData, err := base64.StdEncoding.DecodeString(cert.PemB64)
+		if err != nil {
+			status.Error = fmt.Sprintf("pem_b64 isn't base64: %v", err)
+			statuses = append(statuses, status)
+			continue
+		}
+
+		x509Cert, err := certificateFromPEM(pemData)
+		if err != nil {
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+
+		status.Subject = x509Cert.Subject.String()
+		status.NotAfter = x509Cert.NotAfter
+		status.Expired = now.After(x509Cert.NotAfter)
+		status.ExpiresSoon = !status.Expired && x509Cert.NotAfter.Sub(now) < warnBefore
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// the first certificate in PEM data
+func certificateFromPEM(pemData []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found")
+		}
+
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// the SHA-256 fingerprint of an entry's first certificate, or of its pem_b64 if it isn't a certificate so invalid
+// entries are still de-duplicated
+func entryFingerprint(pemB64 string) string {
+	data := []byte(pemB64)
+
+	if pemData, err := base64.StdEncoding.DecodeString(pemB64); err == nil {
+		if cert, err := certificateFromPEM(pemData); err == nil {
+			data = cert.Raw
+		}
+	}
+
+	sum := sha256.Sum256(data)
+
+	hexSum := make([]string, len(sum))
+	for i, b := range sum {
+		hexSum[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(hexSum, ":")
+}
@@ -0,0 +1,185 @@
+package helmmodel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a self-signed certificate with the common name
+func testCertificatePEM(t *testing.T, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func entry(name string, pemData []byte) TrustedCertsInner {
+	return TrustedCertsInner{Name: name, PemB64: base64.StdEncoding.EncodeToString(pemData)}
+}
+
+func names(certs TrustedCerts) []string {
+	result := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		result = append(result, cert.Name)
+	}
+
+	return result
+}
+
+func TestTrustedCertsSet(t *testing.T) {
+	certA := testCertificatePEM(t, "a")
+	certB := testCertificatePEM(t, "b")
+	certC := testCertificatePEM(t, "c")
+
+	tests := []struct {
+		name  string
+		certs TrustedCerts
+		set   string
+		pem   []byte
+		// the name Set returns and the entries afterwards
+		trustedAs string
+		expected  TrustedCerts
+	}{
+		{
+			name:      "adds a new certificate",
+			certs:     TrustedCerts{entry("unison-ca", certA)},
+			set:       "trusted-idp",
+			pem:       certB,
+			trustedAs: "trusted-idp",
+			expected:  TrustedCerts{entry("unison-ca", certA), entry("trusted-idp", certB)},
+		},
+		{
+			name:      "replaces a certificate in place",
+			certs:     TrustedCerts{entry("trusted-idp", certB), entry("unison-ca", certA)},
+			set:       "trusted-idp",
+			pem:       certC,
+			trustedAs: "trusted-idp",
+			expected:  TrustedCerts{entry("trusted-idp", certC), entry("unison-ca", certA)},
+		},
+		{
+			name:      "keeps an existing entry before the one being set",
+			certs:     TrustedCerts{entry("unison-ca", certA), entry("trusted-idp", certB)},
+			set:       "trusted-idp",
+			pem:       certA,
+			trustedAs: "unison-ca",
+			expected:  TrustedCerts{entry("unison-ca", certA)},
+		},
+		{
+			name:      "keeps an existing entry after the one being set",
+			certs:     TrustedCerts{entry("trusted-idp", certB), entry("unison-ca", certA)},
+			set:       "trusted-idp",
+			pem:       certA,
+			trustedAs: "unison-ca",
+			expected:  TrustedCerts{entry("unison-ca", certA)},
+		},
+		{
+			name:      "doesn't add a certificate that's already trusted",
+			certs:     TrustedCerts{entry("unison-ca", certA)},
+			set:       "trusted-idp",
+			pem:       certA,
+			trustedAs: "unison-ca",
+			expected:  TrustedCerts{entry("unison-ca", certA)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certs := test.certs
+
+			trustedAs, err := certs.Set(test.set, test.pem)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if trustedAs != test.trustedAs {
+				t.Errorf("trusted as %s, expected %s", trustedAs, test.trustedAs)
+			}
+
+			if !reflect.DeepEqual(certs, test.expected) {
+				t.Errorf("entries are %v, expected %v", names(certs), names(test.expected))
+			}
+		})
+	}
+
+	certs := TrustedCerts{}
+	if _, err := certs.Set("invalid", []byte("not a certificate")); err == nil {
+		t.Error("expected an invalid certificate to fail")
+	}
+}
+
+func TestTrustedCertsReconcile(t *testing.T) {
+	certA := testCertificatePEM(t, "a")
+	certB := testCertificatePEM(t, "b")
+
+	certs := TrustedCerts{
+		entry("unison-ca", certA),
+		entry("trusted-idp", certB),
+		entry("unison-ca", certB),
+		entry("copy-of-a", certA),
+		{Name: "invalid", PemB64: "bm90IGEgY2VydA=="},
+		{Name: "invalid-copy", PemB64: "bm90IGEgY2VydA=="},
+	}
+
+	removed := certs.Reconcile()
+
+	expectedRemoved := []string{
+		"unison-ca, a duplicate name",
+		"copy-of-a, the same certificate as unison-ca",
+		"invalid-copy, the same certificate as invalid",
+	}
+	if !reflect.DeepEqual(removed, expectedRemoved) {
+		t.Errorf("removed %v, expected %v", removed, expectedRemoved)
+	}
+
+	if expected := []string{"unison-ca", "trusted-idp", "invalid"}; !reflect.DeepEqual(names(certs), expected) {
+		t.Errorf("entries are %v, expected %v", names(certs), expected)
+	}
+
+	if removed := certs.Reconcile(); len(removed) != 0 {
+		t.Errorf("expected reconciling again to remove nothing, removed %v", removed)
+	}
+}
+
+func TestTrustedCertsRemove(t *testing.T) {
+	certA := testCertificatePEM(t, "a")
+	certB := testCertificatePEM(t, "b")
+
+	certs := TrustedCerts{entry("unison-ca", certA), entry("trusted-idp", certB)}
+
+	if !certs.Remove("unison-ca") {
+		t.Fatal("expected unison-ca to be removed")
+	}
+
+	if expected := []string{"trusted-idp"}; !reflect.DeepEqual(names(certs), expected) {
+		t.Errorf("entries are %v, expected %v", names(certs), expected)
+	}
+
+	if certs.Remove("unison-ca") {
+		t.Error("expected removing a name that isn't trusted to return false")
+	}
+}
@@ -0,0 +1,506 @@
+package openunison
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	orascontent "oras.land/oras-go/pkg/content"
+	"oras.land/oras-go/pkg/oras"
+)
+
+const (
+	// the manifest at the root of a bundle
+	bundleManifestFile = "bundle.yaml"
+	// the OCI layout with image layers, if they were included
+	bundleImagesDir = "images"
+)
+
+// describes the contents of a bundle
+type BundleManifest struct {
+	Charts []BundledChart `yaml:"charts"`
+	// every image referenced by the rendered charts
+	Images []string `yaml:"images"`
+	// true if the images are included in the bundle as an OCI layout
+	ImagesIncluded bool `yaml:"imagesIncluded"`
+}
+
+// a chart in a bundle
+type BundledChart struct {
+	// the release the chart is deployed as
+	Name string `yaml:"name"`
+	// the chart reference it was located with, without a version
+	Chart      string `yaml:"chart"`
+	Version    string `yaml:"version"`
+	Repository string `yaml:"repository,omitempty"`
+	// digests of the chart as it was located, so the bundle can be checked against a lock file
+	Digest         string `yaml:"digest,omitempty"`
+	ManifestDigest string `yaml:"manifestDigest,omitempty"`
+	Commit         string `yaml:"commit,omitempty"`
+	// path of the chart's archive in the bundle
+	File string `yaml:"file"`
+}
+
+// creates bundles for installing without access to chart repositories or image registries
+type BundleBuilder struct {
+	ou *OpenUnisonDeployment
+
+	addClusterChart string
+	includeImages   bool
+}
+
+// creates a bundle builder, the values.yaml is used to render the charts to find the images they use
+func NewBundleBuilder(namespace string, operatorChart string, orchestraChart string, orchestraLoginPortalChart string, clusterManagementChart string, addClusterChart string, pathToValuesYaml string, additionalCharts []HelmChartInfo, preCharts []HelmChartInfo, skipCharts []string, registryOptions RegistryOptions, repositoryOptions RepositoryOptions, chartVerification ChartVerification, chartLock ChartLock, includeImages bool) (*BundleBuilder, error) {
+	ou := &OpenUnisonDeployment{
+		namespace:                 namespace,
+		orchestraChart:            orchestraChart,
+		orchestraLoginPortalChart: orchestraLoginPortalChart,
+		clusterManagementChart:    clusterManagementChart,
+		pathToValuesYaml:          pathToValuesYaml,
+		additionalCharts:          additionalCharts,
+		preCharts:                 preCharts,
+		skipCharts:                map[string]bool{},
+		registryOptions:           registryOptions,
+		repositoryOptions:         repositoryOptions,
+		updatedRepositories:       map[string]bool{},
+		resolvedCharts:            map[string]LockedChart{},
+		chartVerification:         chartVerification,
+		chartLock:                 chartLock,
+	}
+
+	ou.operator.chart = operatorChart
+
+	if chartLock.Path != "" && chartLock.Record {
+		var err error
+		ou.lockFile, err = loadLockFile(chartLock.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, chartToSkip := range skipCharts {
+		ou.skipCharts[chartToSkip] = true
+	}
+
+	err := ou.loadHelmValues()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BundleBuilder{
+		ou:              ou,
+		addClusterChart: addClusterChart,
+		includeImages:   includeImages,
+	}, nil
+}
+
+// locates every chart at its pinned version, finds the images they use and writes them to a tgz
+func (builder *BundleBuilder) Create(pathToBundle string) error {
+	ou := builder.ou
+	settings := cli.New()
+
+	dir, err := os.MkdirTemp("", "ouctl-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := BundleManifest{Charts: make([]BundledChart, 0), Images: make([]string, 0)}
+	images := make(map[string]bool)
+
+	charts := make([]HelmChartInfo, 0)
+	charts = append(charts, ou.preCharts...)
+	charts = append(charts,
+		HelmChartInfo{Name: "openunison", ChartPath: ou.operator.chart},
+		HelmChartInfo{Name: "orchestra", ChartPath: ou.orchestraChart},
+		HelmChartInfo{Name: "orchestra-login-portal", ChartPath: ou.orchestraLoginPortalChart},
+		HelmChartInfo{Name: "cluster-management", ChartPath: ou.clusterManagementChart},
+		HelmChartInfo{Name: "add-cluster", ChartPath: builder.addClusterChart},
+	)
+	charts = append(charts, ou.additionalCharts...)
+
+	for _, helmChart := range charts {
+		if ou.skipCharts[helmChart.Name] {
+			fmt.Printf("Chart %s skipped\n", helmChart.Name)
+			continue
+		}
+
+		fmt.Printf("Adding chart %s, %s\n", helmChart.Name, helmChart.ChartPath)
+
+		chartReq, err := ou.locateChart(helmChart.ChartPath, &action.ChartPathOptions{}, settings)
+		if err != nil {
+			return err
+		}
+
+		chartDir := filepath.Join(dir, "charts", helmChart.Name)
+		err = os.MkdirAll(chartDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		chartFile, err := chartutil.Save(chartReq, chartDir)
+		if err != nil {
+			return err
+		}
+
+		chartName, _ := splitChartVersion(helmChart.ChartPath)
+		relativePath, _ := filepath.Rel(dir, chartFile)
+		resolved := ou.resolvedCharts[chartName]
+
+		manifest.Charts = append(manifest.Charts, BundledChart{
+			Name:           helmChart.Name,
+			Chart:          chartName,
+			Version:        chartReq.Metadata.Version,
+			Repository:     resolved.Repository,
+			Digest:         resolved.Digest,
+			ManifestDigest: resolved.ManifestDigest,
+			Commit:         resolved.Commit,
+			File:           filepath.ToSlash(relativePath),
+		})
+
+		chartImages, err := ou.renderImages(helmChart.Name, chartReq)
+		if err != nil {
+			// charts like add-cluster need values that only exist at install time
+			fmt.Printf("Could not render %s to find its images, add them to the registry manually: %v\n", helmChart.Name, err)
+		}
+
+		for _, image := range chartImages {
+			images[image] = true
+		}
+	}
+
+	for image := range images {
+		manifest.Images = append(manifest.Images, image)
+	}
+
+	sort.Strings(manifest.Images)
+
+	fmt.Printf("Images used by the charts:\n")
+	for _, image := range manifest.Images {
+		fmt.Printf("  %s\n", image)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "images.txt"), []byte(strings.Join(manifest.Images, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	if builder.includeImages {
+		err = pullImages(manifest.Images, filepath.Join(dir, bundleImagesDir))
+		if err != nil {
+			return err
+		}
+
+		manifest.ImagesIncluded = true
+	}
+
+	manifestData, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, bundleManifestFile), manifestData, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing %s\n", pathToBundle)
+
+	err = writeTarGz(dir, pathToBundle)
+	if err != nil {
+		return err
+	}
+
+	return ou.SaveLockFile()
+}
+
+// renders a chart the same way it would be installed and returns the images in its manifests and hooks
+func (ou *OpenUnisonDeployment) renderImages(name string, chartReq *chart.Chart) ([]string, error) {
+	client := action.NewInstall(new(action.Configuration))
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+	client.ReleaseName = name
+	client.Namespace = ou.namespace
+
+	release, err := client.Run(chartReq, mergeMaps(map[string]interface{}{}, ou.helmValues))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []string{release.Manifest}
+	for _, hook := range release.Hooks {
+		manifests = append(manifests, hook.Manifest)
+	}
+
+	images := make([]string, 0)
+
+	for _, manifest := range manifests {
+		for _, doc := range releaseutil.SplitManifests(manifest) {
+			var obj interface{}
+			if yaml.Unmarshal([]byte(doc), &obj) != nil {
+				continue
+			}
+
+			images = append(images, findImages(obj)...)
+		}
+	}
+
+	return images, nil
+}
+
+// finds every string in an image field, such as in pod specs or OpenUnison's spec.image and spec.activemq_image
+func findImages(node interface{}) []string {
+	images := make([]string, 0)
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			if image, ok := value.(string); ok && isImageKey(key) && image != "" {
+				images = append(images, image)
+			} else {
+				images = append(images, findImages(value)...)
+			}
+		}
+	case []interface{}:
+		for _, value := range n {
+			images = append(images, findImages(value)...)
+		}
+	}
+
+	return images
+}
+
+// copies each image, with every platform, into an OCI layout.  Registry credentials are read from the docker
+// configuration
+func pullImages(images []string, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	store, err := orascontent.NewOCI(dir)
+	if err != nil {
+		return err
+	}
+
+	registry, err := orascontent.NewRegistry(orascontent.RegistryOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		named, err := reference.ParseDockerRef(image)
+		if err != nil {
+			return fmt.Errorf("could not parse image %s: %v", image, err)
+		}
+
+		ref := named.String()
+		fmt.Printf("Pulling %s\n", ref)
+
+		desc, err := oras.Copy(context.TODO(), registry, ref, store, ref,
+			oras.WithPullEmptyNameAllowed(),
+			oras.WithAdditionalCachedMediaTypes("application/vnd.docker.distribution.manifest.v2+json", "application/vnd.docker.distribution.manifest.list.v2+json"))
+		if err != nil {
+			return fmt.Errorf("could not pull %s: %v", ref, err)
+		}
+
+		// docker manifests aren't tagged by the store
+		store.AddReference(ref, ocispec.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size})
+	}
+
+	return store.SaveIndex()
+}
+
+// an extracted bundle
+type chartBundle struct {
+	dir      string
+	manifest BundleManifest
+}
+
+// extracts the charts from a bundle, the images are left in the bundle for loading into a registry
+func openBundle(pathToBundle string) (*chartBundle, error) {
+	fmt.Printf("Loading charts from bundle %s\n", pathToBundle)
+
+	dir, err := os.MkdirTemp("", "ouctl-bundle-*")
+	if err != nil {
+		return nil, err
+	}
+
+	err = extractTarGz(pathToBundle, dir, func(name string) bool {
+		return !strings.HasPrefix(name, bundleImagesDir+"/")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifestData, err := os.ReadFile(filepath.Join(dir, bundleManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a bundle: %v", pathToBundle, err)
+	}
+
+	bundle := &chartBundle{dir: dir}
+	err = yaml.Unmarshal(manifestData, &bundle.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// loads a chart from the bundle by the reference it was bundled with, if the reference has a version it must match
+func (bundle *chartBundle) loadChart(chartRef string) (*chart.Chart, LockedChart, error) {
+	chartName, chartVersion := splitChartVersion(chartRef)
+
+	for _, bundled := range bundle.manifest.Charts {
+		if bundled.Chart != chartName {
+			continue
+		}
+
+		if chartVersion != "" && chartVersion != bundled.Version {
+			return nil, LockedChart{}, fmt.Errorf("chart %s is version %s in the bundle, not %s", chartName, bundled.Version, chartVersion)
+		}
+
+		fmt.Printf("Loading %s version %s from the bundle\n", chartName, bundled.Version)
+
+		chartReq, err := loader.Load(filepath.Join(bundle.dir, filepath.FromSlash(bundled.File)))
+		if err != nil {
+			return nil, LockedChart{}, err
+		}
+
+		return chartReq, LockedChart{
+			Name:           bundled.Chart,
+			Chart:          chartReq.Metadata.Name,
+			Version:        bundled.Version,
+			Repository:     bundled.Repository,
+			Digest:         bundled.Digest,
+			ManifestDigest: bundled.ManifestDigest,
+			Commit:         bundled.Commit,
+		}, nil
+	}
+
+	return nil, LockedChart{}, fmt.Errorf("chart %s is not in the bundle", chartName)
+}
+
+// writes every file in dir to a gzipped tar
+func writeTarGz(dir string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+
+		_, err = io.Copy(tw, data)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// extracts the regular files from a gzipped tar that include returns true for
+func extractTarGz(path string, dir string, include func(name string) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg || !include(header.Name) {
+			continue
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s in %s is outside of the bundle", header.Name, path)
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package openunison
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestFindImages(t *testing.T) {
+	manifests := []string{
+		`apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: operator
+        image: ghcr.io/tremolosecurity/openunison-k8s-operator:latest
+      - name: templated
+        image: ""
+`,
+		`apiVersion: openunison.tremolo.io/v6
+kind: OpenUnison
+spec:
+  image: ghcr.io/tremolosecurity/openunison-k8s:latest
+  activemq_image: ghcr.io/tremolosecurity/activemq-docker:latest
+  images:
+  - not-an-image-field
+  non_secret_data:
+  - name: image
+    value: not-an-image-field
+`,
+		`apiVersion: v1
+kind: ConfigMap
+data:
+  image_pull_policy: Always
+  image: 3
+`,
+	}
+
+	images := make([]string, 0)
+	for _, manifest := range manifests {
+		var obj interface{}
+		err := yaml.Unmarshal([]byte(manifest), &obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		images = append(images, findImages(obj)...)
+	}
+
+	sort.Strings(images)
+
+	expected := []string{
+		"busybox",
+		"ghcr.io/tremolosecurity/activemq-docker:latest",
+		"ghcr.io/tremolosecurity/openunison-k8s-operator:latest",
+		"ghcr.io/tremolosecurity/openunison-k8s:latest",
+	}
+
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("found %v, expected %v", images, expected)
+	}
+}
@@ -0,0 +1,271 @@
+package openunison
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+// charts that aren't from a repository have whatever version is in their Chart.yaml, so a version in the reference
+// has to be checked
+func checkChartVersion(chartName string, chartVersion string, chartReq *chart.Chart) error {
+	if chartVersion != "" && chartReq.Metadata.Version != chartVersion {
+		return fmt.Errorf("chart %s is version %s, not %s", chartName, chartReq.Metadata.Version, chartVersion)
+	}
+
+	return nil
+}
+
+// loads a chart from a directory or archive referenced as file://path, relative paths are relative to the current
+// directory
+func (ou *OpenUnisonDeployment) resolveLocalChart(chartName string, chartVersion string, chartPathOptions *action.ChartPathOptions, settings *cli.EnvSettings) (*chart.Chart, LockedChart, error) {
+	path := strings.TrimPrefix(chartName, "file://")
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, LockedChart{}, fmt.Errorf("chart %s not found: %v", chartName, err)
+	}
+
+	// archives are verified with the provenance file next to them
+	if ou.chartVerification.Verify {
+		chartPathOptions.Verify = true
+		chartPathOptions.Keyring = ou.chartVerification.Keyring
+	}
+
+	cp, err := chartPathOptions.LocateChart(path, settings)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	chartReq, err := loader.Load(cp)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	err = checkChartVersion(chartName, chartVersion, chartReq)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	resolved := LockedChart{
+		Name:    chartName,
+		Chart:   chartReq.Metadata.Name,
+		Version: chartReq.Metadata.Version,
+	}
+
+	// directories don't have a digest
+	if info, err := os.Stat(cp); err == nil && !info.IsDir() {
+		resolved.Digest, err = fileDigest(cp)
+		if err != nil {
+			return nil, LockedChart{}, err
+		}
+	}
+
+	return chartReq, resolved, nil
+}
+
+// downloads a chart archive from a url.  If the url ends with #sha256=<digest>, the archive must match it
+func (ou *OpenUnisonDeployment) resolveURLChart(chartName string, chartVersion string, settings *cli.EnvSettings) (*chart.Chart, LockedChart, error) {
+	chartURL, fragment, _ := strings.Cut(chartName, "#")
+
+	expectedDigest := ""
+	if fragment != "" {
+		algorithm, value, _ := strings.Cut(fragment, "=")
+		if algorithm != "sha256" || value == "" {
+			return nil, LockedChart{}, fmt.Errorf("chart %s must end with #sha256=<digest>", chartName)
+		}
+
+		expectedDigest = "sha256:" + strings.ToLower(value)
+	} else {
+		fmt.Printf("No checksum for %s, add #sha256=<digest> to check the archive\n", chartURL)
+	}
+
+	u, err := url.Parse(chartURL)
+	if err != nil {
+		return nil, LockedChart{}, fmt.Errorf("could not parse chart url %s: %v", chartURL, err)
+	}
+
+	chartGetter, err := getter.All(settings).ByScheme(u.Scheme)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	getterOptions := []getter.Option{
+		getter.WithURL(chartURL),
+		getter.WithTLSClientConfig(ou.repositoryOptions.CertFile, ou.repositoryOptions.KeyFile, ou.repositoryOptions.CaFile),
+		getter.WithInsecureSkipVerifyTLS(ou.repositoryOptions.InsecureSkipTLSVerify),
+	}
+
+	fmt.Printf("Downloading chart %s\n", chartURL)
+
+	data, err := chartGetter.Get(chartURL, getterOptions...)
+	if err != nil {
+		return nil, LockedChart{}, fmt.Errorf("could not download chart %s: %v", chartURL, err)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data.Bytes()))
+	if expectedDigest != "" && digest != expectedDigest {
+		return nil, LockedChart{}, fmt.Errorf("chart %s has digest %s, not %s", chartURL, digest, expectedDigest)
+	}
+
+	tempDir, err := os.MkdirTemp("", "ouctl-chart-*")
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	chartFilePath := filepath.Join(tempDir, "chart.tgz")
+	err = os.WriteFile(chartFilePath, data.Bytes(), 0600)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	if ou.chartVerification.Verify {
+		prov, err := chartGetter.Get(chartURL+".prov", getterOptions...)
+		if err != nil {
+			return nil, LockedChart{}, fmt.Errorf("could not download the provenance file of chart %s: %v", chartURL, err)
+		}
+
+		err = os.WriteFile(chartFilePath+".prov", prov.Bytes(), 0600)
+		if err != nil {
+			return nil, LockedChart{}, err
+		}
+
+		_, err = downloader.VerifyChart(chartFilePath, ou.chartVerification.Keyring)
+		if err != nil {
+			return nil, LockedChart{}, fmt.Errorf("could not verify chart %s: %v", chartURL, err)
+		}
+	}
+
+	chartReq, err := loader.Load(chartFilePath)
+	if err != nil {
+		return nil, LockedChart{}, fmt.Errorf("could not load chart %s: %v", chartURL, err)
+	}
+
+	err = checkChartVersion(chartName, chartVersion, chartReq)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	return chartReq, LockedChart{
+		Name:       chartName,
+		Chart:      chartReq.Metadata.Name,
+		Version:    chartReq.Metadata.Version,
+		Repository: chartURL,
+		Digest:     digest,
+	}, nil
+}
+
+// splits git+<repository url>//<path in the repository>?ref=<branch, tag or commit> into its parts
+func parseGitChartRef(chartName string) (string, string, string, error) {
+	ref := strings.TrimPrefix(chartName, "git+")
+
+	ref, query, _ := strings.Cut(ref, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", "", fmt.Errorf("could not parse %s: %v", chartName, err)
+	}
+
+	schemeEnd := strings.Index(ref, "://")
+	if schemeEnd < 0 {
+		return "", "", "", fmt.Errorf("chart %s must be in the form git+<url>//<path>?ref=<ref>", chartName)
+	}
+
+	repoURL := ref
+	path := ""
+
+	if i := strings.Index(ref[schemeEnd+3:], "//"); i >= 0 {
+		repoURL = ref[0 : schemeEnd+3+i]
+		path = ref[schemeEnd+3+i+2:]
+	}
+
+	if strings.Contains("/"+path+"/", "/../") {
+		return "", "", "", fmt.Errorf("chart %s's path can't leave the repository", chartName)
+	}
+
+	return repoURL, path, params.Get("ref"), nil
+}
+
+// clones a git repository into a temporary directory and loads the chart from it
+func (ou *OpenUnisonDeployment) resolveGitChart(chartName string, chartVersion string) (*chart.Chart, LockedChart, error) {
+	if ou.chartVerification.Verify {
+		return nil, LockedChart{}, fmt.Errorf("chart %s is from git and can't be verified", chartName)
+	}
+
+	repoURL, path, ref, err := parseGitChartRef(chartName)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, LockedChart{}, fmt.Errorf("charts from git require the git command: %v", err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "ouctl-git-*")
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	fmt.Printf("Cloning %s\n", repoURL)
+
+	_, err = runGit("", "clone", "--quiet", repoURL, tempDir)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	if ref != "" {
+		fmt.Printf("Checking out %s\n", ref)
+
+		_, err = runGit(tempDir, "checkout", "--quiet", ref)
+		if err != nil {
+			return nil, LockedChart{}, err
+		}
+	}
+
+	commit, err := runGit(tempDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	chartReq, err := loader.Load(filepath.Join(tempDir, filepath.FromSlash(path)))
+	if err != nil {
+		return nil, LockedChart{}, fmt.Errorf("could not load chart %s from %s: %v", path, repoURL, err)
+	}
+
+	err = checkChartVersion(chartName, chartVersion, chartReq)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	return chartReq, LockedChart{
+		Name:       chartName,
+		Chart:      chartReq.Metadata.Name,
+		Version:    chartReq.Metadata.Version,
+		Repository: repoURL,
+		Commit:     commit,
+	}, nil
+}
+
+// runs git, returning its trimmed output
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v\n%s", strings.Join(args, " "), err, string(out))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,108 @@
+package openunison
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// commits a chart at version into the work tree and returns the commit
+func commitChart(t *testing.T, work string, version string) string {
+	t.Helper()
+
+	chartDir := filepath.Join(work, "charts", "orchestra")
+	err := os.MkdirAll(chartDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v2\nname: orchestra\nversion: "+version+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", "-A"},
+		{"-c", "user.name=ouctl", "-c", "user.email=ouctl@example.com", "commit", "--quiet", "-m", version},
+	} {
+		if _, err := runGit(work, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit, err := runGit(work, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return commit
+}
+
+func TestResolveGitChart(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	bare := filepath.Join(t.TempDir(), "charts.git")
+	work := t.TempDir()
+
+	if _, err := runGit("", "init", "--quiet", "--bare", bare); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runGit(work, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := commitChart(t, work, "1.0.0")
+	if _, err := runGit(work, "tag", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	head := commitChart(t, work, "1.1.0")
+
+	if _, err := runGit(work, "push", "--quiet", "--tags", bare, "HEAD:refs/heads/release"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     string
+		version string
+		commit  string
+	}{
+		{"tag", "v1.0.0", "1.0.0", tagged},
+		{"branch", "release", "1.1.0", head},
+		{"commit", tagged, "1.0.0", tagged},
+	}
+
+	ou := &OpenUnisonDeployment{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chartName := "git+file://" + filepath.ToSlash(bare) + "//charts/orchestra?ref=" + test.ref
+
+			chartReq, locked, err := ou.resolveGitChart(chartName, test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if chartReq.Metadata.Version != test.version {
+				t.Errorf("loaded version %s, expected %s", chartReq.Metadata.Version, test.version)
+			}
+
+			if locked.Commit != test.commit {
+				t.Errorf("locked commit %s, expected %s", locked.Commit, test.commit)
+			}
+
+			if locked.Repository != "file://"+filepath.ToSlash(bare) {
+				t.Errorf("locked repository %s, expected file://%s", locked.Repository, bare)
+			}
+		})
+	}
+
+	if _, _, err := ou.resolveGitChart("git+file://"+filepath.ToSlash(bare)+"//charts/orchestra?ref=v1.0.0", "1.1.0"); err == nil {
+		t.Error("expected a version that doesn't match the tag's chart to fail")
+	}
+}
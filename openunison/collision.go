@@ -0,0 +1,152 @@
+package openunison
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the annotation on the control plane's secret that records which cluster registered a satelite name, its value is
+// the uid of the satelite's kube-system namespace
+const sateliteClusterAnnotationPrefix = "satellite.openunison.tremolo.io/"
+
+func sateliteClusterAnnotation(clusterName string) string {
+	return sateliteClusterAnnotationPrefix + clusterName
+}
+
+// the default Secret on the control plane satelite client secrets are stored in, kept apart from
+// orchestra-secrets-source so integration accounts don't need access to OpenUnison's own secrets
+const SateliteClientSecretName = "satelite-client-secrets"
+
+// where satelite client secrets were stored before they had their own Secret
+const legacySateliteSecretName = "orchestra-secrets-source"
+
+// copies a satelite's client secret and registration from orchestra-secrets-source into the control plane's client
+// secret Secret, so moving to a dedicated Secret doesn't change the satelite's client secret.  Returns the keys that
+// were copied.  If the control plane context can't read orchestra-secrets-source, nothing is copied
+func (ou *OpenUnisonDeployment) migrateSateliteClientSecret(cpSecret *v1.Secret, clusterName string) ([]string, error) {
+	key := "cluster-idp-" + clusterName
+
+	if ou.cpSecretName == legacySateliteSecretName {
+		return nil, nil
+	}
+
+	if _, ok := cpSecret.Data[key]; ok {
+		return nil, nil
+	}
+
+	legacySecret, err := ou.clientset.CoreV1().Secrets(ou.cpNamespace).Get(context.TODO(), legacySateliteSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	clientSecret, ok := legacySecret.Data[key]
+	if !ok {
+		return nil, nil
+	}
+
+	fmt.Printf("Moving the client secret for %s from %s to %s\n", clusterName, legacySateliteSecretName, ou.cpSecretName)
+
+	cpSecret.Data[key] = clientSecret
+
+	if uid := legacySecret.Annotations[sateliteClusterAnnotation(clusterName)]; uid != "" {
+		if cpSecret.Annotations == nil {
+			cpSecret.Annotations = map[string]string{}
+		}
+
+		cpSecret.Annotations[sateliteClusterAnnotation(clusterName)] = uid
+	}
+
+	return []string{key}, nil
+}
+
+// the uid of the satelite's kube-system namespace, which identifies the cluster
+func (ou *OpenUnisonDeployment) sateliteClusterUID() (string, error) {
+	config, err := loadRestConfigForContext(ou.satelateContextName)
+	if err != nil {
+		return "", err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	kubeSystem, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "kube-system", metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not read the kube-system namespace of %s to identify the satelite: %v", ou.satelateContextName, err)
+	}
+
+	return string(kubeSystem.UID), nil
+}
+
+// makes sure the satelite's cluster name isn't registered by another cluster.  A registration recorded with a
+// kube-system uid belongs to the cluster with that uid, registrations from before the uid was recorded are compared
+// by the satelite's hosts.  Returns true if another cluster's registration is being taken over with --force-takeover
+func (ou *OpenUnisonDeployment) checkSateliteCollision(clusterName string, releaseName string, integrated bool, secretExists bool, cpSecret *v1.Secret, sateliteUID string, actionConfig *action.Configuration) (bool, error) {
+	if !integrated && !secretExists {
+		fmt.Printf("Cluster name %s isn't in use\n", clusterName)
+		return false, nil
+	}
+
+	conflicts := make([]string, 0)
+
+	recordedUID := cpSecret.Annotations[sateliteClusterAnnotation(clusterName)]
+	if recordedUID != "" {
+		if recordedUID != sateliteUID {
+			conflicts = append(conflicts, fmt.Sprintf("it was registered by the cluster with kube-system uid %s, %s's is %s", recordedUID, ou.satelateContextName, sateliteUID))
+		}
+	} else if integrated {
+		release, err := actionConfig.Releases.Last(releaseName)
+		if err != nil {
+			return false, fmt.Errorf("could not load release %s: %v", releaseName, err)
+		}
+
+		network, _ := ou.helmValues["network"].(map[string]interface{})
+
+		registeredHosts := map[string]interface{}{}
+		if cluster, ok := release.Config["cluster"].(map[string]interface{}); ok {
+			if hosts, ok := cluster["hosts"].(map[string]interface{}); ok {
+				registeredHosts = hosts
+			}
+		}
+
+		for _, host := range []struct {
+			name      string
+			valuesKey string
+		}{
+			{"portal", "openunison_host"},
+			{"dashboard", "dashboard_host"},
+		} {
+			registered, _ := registeredHosts[host.name].(string)
+			current, _ := network[host.valuesKey].(string)
+
+			if registered != current {
+				conflicts = append(conflicts, fmt.Sprintf("its %s host is %s, not %s", host.name, registered, current))
+			}
+		}
+	} else {
+		fmt.Printf("The client secret for %s exists, but the cluster that registered it wasn't recorded, assuming it's %s\n", clusterName, ou.satelateContextName)
+	}
+
+	if len(conflicts) == 0 {
+		fmt.Printf("Cluster name %s is registered by %s\n", clusterName, ou.satelateContextName)
+		return false, nil
+	}
+
+	if !ou.forceTakeover {
+		return false, fmt.Errorf("cluster name %s is in use by another cluster, %s.  Use a different k8s_cluster_name, or --force-takeover to replace its registration", clusterName, strings.Join(conflicts, ", "))
+	}
+
+	fmt.Printf("Cluster name %s is in use by another cluster, %s.  Taking it over\n", clusterName, strings.Join(conflicts, ", "))
+
+	return true, nil
+}
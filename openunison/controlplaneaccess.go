@@ -0,0 +1,103 @@
+package openunison
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// loads the kubeconfig used to reach the control plane instead of the control plane context in the user's kubeconfig.
+// ref is a path or a secret source, such as a Secret on the satelite, and contextName has to be one of its contexts
+func loadControlPlaneKubeconfig(ref string, contextName string) (clientcmd.ClientConfig, error) {
+	source, err := ParseSecretSource(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Loading the control plane's kubeconfig from %s\n", source)
+
+	data, err := source.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	kubeconfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the control plane's kubeconfig from %s: %v", source, err)
+	}
+
+	if _, ok := kubeconfig.Contexts[contextName]; !ok {
+		contexts := make([]string, 0, len(kubeconfig.Contexts))
+		for name := range kubeconfig.Contexts {
+			contexts = append(contexts, name)
+		}
+		sort.Strings(contexts)
+
+		return nil, fmt.Errorf("context %s isn't in the control plane's kubeconfig from %s, it has %s", contextName, source, strings.Join(contexts, ", "))
+	}
+
+	return clientcmd.NewNonInteractiveClientConfig(*kubeconfig, contextName, &clientcmd.ConfigOverrides{}, nil), nil
+}
+
+// the RESTClientGetter for helm to reach the control plane, the current context unless the control plane has its own
+// kubeconfig
+func (ou *OpenUnisonDeployment) controlPlaneRESTClientGetter(settings *cli.EnvSettings) genericclioptions.RESTClientGetter {
+	if ou.controlPlaneConfig == nil {
+		return settings.RESTClientGetter()
+	}
+
+	return &clientConfigGetter{clientConfig: ou.controlPlaneConfig}
+}
+
+// a RESTClientGetter for a kubeconfig that's loaded in memory, so its credentials are never written to disk
+type clientConfigGetter struct {
+	clientConfig clientcmd.ClientConfig
+	discovery    discovery.CachedDiscoveryInterface
+}
+
+func (getter *clientConfigGetter) ToRESTConfig() (*rest.Config, error) {
+	return getter.clientConfig.ClientConfig()
+}
+
+func (getter *clientConfigGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	if getter.discovery != nil {
+		return getter.discovery, nil
+	}
+
+	config, err := getter.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	getter.discovery = memory.NewMemCacheClient(discoveryClient)
+
+	return getter.discovery, nil
+}
+
+func (getter *clientConfigGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	discoveryClient, err := getter.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(discoveryClient)
+	return restmapper.NewShortcutExpander(mapper, discoveryClient, nil), nil
+}
+
+func (getter *clientConfigGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return getter.clientConfig
+}
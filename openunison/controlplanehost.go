@@ -0,0 +1,140 @@
+package openunison
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tremolosecurity/openunison-control/openunisonmodel"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the host name OpenUnison is issued from
+const issuerHostEnvVar = "OU_HOST"
+
+// finds the host name satelites use as the control plane's issuer and the TLS secret it's served with.  Every host is
+// searched, if --control-plane-host is set it has to be one of the names, otherwise there has to be only one OU_HOST
+// name
+func (ou *OpenUnisonDeployment) controlPlaneIssuerHost(spec *openunisonmodel.OpenUnisonSpec) (string, string, error) {
+	var selectedHost *openunisonmodel.OpenUnisonSpecHosts
+	selectedName := ""
+
+	issuerNames := make([]string, 0)
+	allNames := make([]string, 0)
+
+	for i := range spec.Hosts {
+		for _, name := range spec.Hosts[i].Names {
+			allNames = append(allNames, name.Name)
+
+			if ou.controlPlaneHost != "" {
+				if name.Name == ou.controlPlaneHost && selectedHost == nil {
+					selectedHost = &spec.Hosts[i]
+					selectedName = name.Name
+				}
+			} else if name.EnvVar == issuerHostEnvVar {
+				if selectedHost == nil {
+					selectedHost = &spec.Hosts[i]
+					selectedName = name.Name
+				}
+
+				if !containsString(issuerNames, name.Name) {
+					issuerNames = append(issuerNames, name.Name)
+				}
+			}
+		}
+	}
+
+	if ou.controlPlaneHost != "" && selectedHost == nil {
+		sort.Strings(allNames)
+		return "", "", fmt.Errorf("control plane host %s isn't one of OpenUnison %s's hosts, %s", ou.controlPlaneHost, ou.cpOrchestraName, strings.Join(allNames, ", "))
+	}
+
+	if selectedHost == nil {
+		return "", "", fmt.Errorf("could not find %s name in orchestra CRD, use --control-plane-host to choose the issuer host", issuerHostEnvVar)
+	}
+
+	if len(issuerNames) > 1 {
+		sort.Strings(issuerNames)
+		return "", "", fmt.Errorf("OpenUnison %s has more than one %s name, %s.  Use --control-plane-host to choose the issuer host", ou.cpOrchestraName, issuerHostEnvVar, strings.Join(issuerNames, ", "))
+	}
+
+	tlsSecretName, err := ou.checkHostIngress(selectedHost, selectedName)
+	if err != nil {
+		return "", "", err
+	}
+
+	return selectedName, tlsSecretName, nil
+}
+
+// makes sure the host name is served by an ingress with a TLS secret, so satelites can reach the issuer.  Returns the
+// name of the TLS secret, empty if the host's ingress isn't checked
+func (ou *OpenUnisonDeployment) checkHostIngress(host *openunisonmodel.OpenUnisonSpecHosts, hostName string) (string, error) {
+	ingresses, err := ou.clientset.NetworkingV1().Ingresses(ou.cpNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not list the control plane's ingresses: %v", err)
+	}
+
+	for _, ingress := range ingresses.Items {
+		served := false
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Host == hostName {
+				served = true
+			}
+		}
+
+		if !served {
+			continue
+		}
+
+		for _, tls := range ingress.Spec.TLS {
+			if tls.SecretName == "" || !containsString(tls.Hosts, hostName) {
+				continue
+			}
+
+			_, err = ou.clientset.CoreV1().Secrets(ou.cpNamespace).Get(context.TODO(), tls.SecretName, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return "", fmt.Errorf("ingress %s serves %s with TLS secret %s, which doesn't exist", ingress.Name, hostName, tls.SecretName)
+			} else if apierrors.IsForbidden(err) && ou.fetchControlPlaneChain {
+				// integration accounts can't read TLS secrets, the host's certificate is checked when it's fetched
+				fmt.Printf("Control plane host %s is served by ingress %s with TLS secret %s, which can't be read\n", hostName, ingress.Name, tls.SecretName)
+				return tls.SecretName, nil
+			} else if err != nil {
+				return "", controlPlaneSecretError(tls.SecretName, err)
+			}
+
+			fmt.Printf("Control plane host %s is served by ingress %s with TLS secret %s\n", hostName, ingress.Name, tls.SecretName)
+			return tls.SecretName, nil
+		}
+
+		return "", fmt.Errorf("ingress %s serves %s without TLS", ingress.Name, hostName)
+	}
+
+	// istio and user managed hosts don't have an Ingress to check
+	if host.IngressType == "istio" || host.IngressType == "none" {
+		fmt.Printf("Control plane host %s has ingress type %s, not checking its TLS configuration\n", hostName, host.IngressType)
+		return "", nil
+	}
+
+	return "", fmt.Errorf("no ingress in %s serves control plane host %s", ou.cpNamespace, hostName)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// explains that a control plane secret can't be read by an integration account
+func controlPlaneSecretError(secretName string, err error) error {
+	if apierrors.IsForbidden(err) {
+		return fmt.Errorf("the control plane context can't read Secret %s, use --fetch-control-plane-chain to read the control plane's certificate from its host: %v", secretName, err)
+	}
+
+	return err
+}
@@ -0,0 +1,222 @@
+package openunison
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// the field manager CRDs are applied with
+const crdFieldManager = "ouctl"
+
+const crdURI = "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/"
+
+// helm only creates the CRDs in a chart's crds directory and never upgrades them, so any CRD that's missing or
+// different from the chart's is applied server-side before the chart is deployed.  Every CRD is checked before any
+// are applied, so a CRD that can't be upgraded stops the upgrade before anything is changed
+func (ou *OpenUnisonDeployment) upgradeCRDs(chartReq *chart.Chart) error {
+	changed := make([]map[string]interface{}, 0)
+
+	for _, crdFile := range chartReq.CRDObjects() {
+		crds, err := parseCRDs(crdFile.File.Data)
+		if err != nil {
+			return fmt.Errorf("could not parse %s in chart %s: %v", crdFile.Filename, chartReq.Metadata.Name, err)
+		}
+
+		for _, crd := range crds {
+			upgrade, err := ou.checkCRD(crd)
+			if err != nil {
+				return err
+			}
+
+			if upgrade {
+				changed = append(changed, crd)
+			}
+		}
+	}
+
+	for _, crd := range changed {
+		err := ou.applyCRD(crd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the apiextensions.k8s.io/v1 CRDs in a file, converted to json types so they compare with the cluster's
+func parseCRDs(data []byte) ([]map[string]interface{}, error) {
+	crds := make([]map[string]interface{}, 0)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		obj := make(map[string]interface{})
+		err := decoder.Decode(&obj)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if obj["kind"] != "CustomResourceDefinition" {
+			continue
+		}
+
+		if obj["apiVersion"] != "apiextensions.k8s.io/v1" {
+			fmt.Printf("Skipping CRD with apiVersion %v, only apiextensions.k8s.io/v1 CRDs are upgraded\n", obj["apiVersion"])
+			continue
+		}
+
+		jsonData, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		crd := make(map[string]interface{})
+		err = json.Unmarshal(jsonData, &crd)
+		if err != nil {
+			return nil, err
+		}
+
+		crds = append(crds, crd)
+	}
+
+	return crds, nil
+}
+
+// the name of a CRD from the chart
+func crdName(crd map[string]interface{}) string {
+	metadata, _ := crd["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	return name
+}
+
+// true if the CRD is missing or different from the chart's, errors if the chart's CRD can't replace the cluster's
+func (ou *OpenUnisonDeployment) checkCRD(crd map[string]interface{}) (bool, error) {
+	name := crdName(crd)
+	if name == "" {
+		return false, fmt.Errorf("CRD has no name")
+	}
+
+	respBytes, err := ou.clientset.RESTClient().Get().RequestURI(crdURI + name).DoRaw(context.TODO())
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("could not load CRD %s: %v", name, err)
+		}
+
+		fmt.Printf("CRD %s doesn't exist\n", name)
+		return true, nil
+	}
+
+	current := make(map[string]interface{})
+	err = json.Unmarshal(respBytes, &current)
+	if err != nil {
+		return false, err
+	}
+
+	if containsFields(crd["spec"], current["spec"]) {
+		fmt.Printf("CRD %s is up to date\n", name)
+		return false, nil
+	}
+
+	err = checkStoredVersions(name, crd, current)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("CRD %s is different from the chart's\n", name)
+
+	return true, nil
+}
+
+func (ou *OpenUnisonDeployment) applyCRD(crd map[string]interface{}) error {
+	name := crdName(crd)
+
+	fmt.Printf("Applying CRD %s\n", name)
+
+	data, err := json.Marshal(crd)
+	if err != nil {
+		return err
+	}
+
+	// the CRD was created by helm, so its fields are taken over from helm's field manager
+	_, err = ou.clientset.RESTClient().Patch(types.ApplyPatchType).
+		AbsPath(crdURI+name).
+		Param("fieldManager", crdFieldManager).
+		Param("force", "true").
+		Body(data).
+		DoRaw(context.TODO())
+	if err != nil {
+		return fmt.Errorf("could not apply CRD %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// every version objects were ever stored as has to stay in the CRD, otherwise those objects can't be read
+func checkStoredVersions(name string, crd map[string]interface{}, current map[string]interface{}) error {
+	chartVersions := make(map[string]bool)
+
+	spec, _ := crd["spec"].(map[string]interface{})
+	versions, _ := spec["versions"].([]interface{})
+	for _, v := range versions {
+		version, _ := v.(map[string]interface{})
+		if versionName, ok := version["name"].(string); ok {
+			chartVersions[versionName] = true
+		}
+	}
+
+	status, _ := current["status"].(map[string]interface{})
+	storedVersions, _ := status["storedVersions"].([]interface{})
+	for _, v := range storedVersions {
+		storedVersion, _ := v.(string)
+		if !chartVersions[storedVersion] {
+			return fmt.Errorf("the chart's CRD %s drops version %s, which objects are stored as.  Migrate the objects to a version in the chart and remove %s from the CRD's status.storedVersions before upgrading", name, storedVersion, storedVersion)
+		}
+	}
+
+	return nil
+}
+
+// true if every field in want has the same value in have, fields the API server defaults are ignored
+func containsFields(want interface{}, have interface{}) bool {
+	switch wantValue := want.(type) {
+	case map[string]interface{}:
+		haveValue, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		for key, value := range wantValue {
+			if !containsFields(value, haveValue[key]) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		haveValue, ok := have.([]interface{})
+		if !ok || len(wantValue) != len(haveValue) {
+			return false
+		}
+
+		for i := range wantValue {
+			if !containsFields(wantValue[i], haveValue[i]) {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return reflect.DeepEqual(want, have)
+	}
+}
@@ -3,8 +3,6 @@ package openunison
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
@@ -12,44 +10,36 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/tremolosecurity/openunison-control/helmmodel"
-	"github.com/tremolosecurity/openunison-control/openunisonmodel"
 	"gopkg.in/yaml.v3"
 
 	v1 "k8s.io/api/core/v1"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/postrender"
 
 	"helm.sh/helm/v3/pkg/registry"
 
+	"github.com/Masterminds/semver/v3"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
-
-func randSeq(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
-}
-
 type OperatorDeployment struct {
 	chart string
 }
@@ -80,8 +70,10 @@ type OpenUnisonDeployment struct {
 	orchestraLoginPortalChart string
 	pathToValuesYaml          string
 	secretFile                string
+	secretValues              map[string][]byte
 	secret                    string
 	clientset                 *kubernetes.Clientset
+	restConfig                *rest.Config
 
 	controlPlaneContextName string
 	satelateContextName     string
@@ -97,15 +89,34 @@ type OpenUnisonDeployment struct {
 
 	helmValues map[string]interface{}
 
+	// true if the values.yaml is encrypted with SOPS, so decrypted values are never written back
+	helmValuesEncrypted bool
+
 	additionalCharts []HelmChartInfo
 	preCharts        []HelmChartInfo
 
 	namespaceLabels map[string]string
 
+	// the namespace of OpenUnison on the control plane, the same as namespace unless --control-plane-namespace is set
+	cpNamespace     string
 	cpOrchestraName string
 	cpSecretName    string
+	// the helm storage driver for satelite releases on the control plane, HELM_DRIVER if empty
+	cpHelmDriver string
+	// if set, the control plane is reached with this kubeconfig instead of the control plane context in the user's
+	// kubeconfig, controlPlaneActive is true while it's in use
+	controlPlaneConfig clientcmd.ClientConfig
+	controlPlaneActive bool
+	// the control plane host satelites use as their issuer, found from OU_HOST if empty
+	controlPlaneHost string
+	// if true, the control plane's CA is found from the chain its host serves instead of its TLS secret
+	fetchControlPlaneChain bool
+	// the SHA-256 fingerprint the fetched control plane CA has to have
+	controlPlaneCAFingerprint string
 
 	skipCpIntegration bool
+	// if true, a satelite takes over a cluster name registered by another cluster
+	forceTakeover bool
 
 	extraAzGroups []interface{}
 
@@ -114,46 +125,133 @@ type OpenUnisonDeployment struct {
 
 	skipCharts map[string]bool
 
-	ociCaCertPath string
+	registryOptions RegistryOptions
+
+	repositoryOptions   RepositoryOptions
+	updatedRepositories map[string]bool
+
+	// if set, charts are only loaded from the bundle
+	bundle *chartBundle
+
+	imageRelocation ImageRelocation
+
+	// post-renderers keyed by release name, and the flag each was created from
+	postRenderers     map[string]postrender.PostRenderer
+	postRendererSpecs map[string]string
+
+	chartLock      ChartLock
+	lockFile       *LockFile
+	resolvedCharts map[string]LockedChart
+
+	chartVerification ChartVerification
+
+	secretPolicy SecretPolicy
+	secretOutput SecretOutput
+}
+
+// configures a deployment, named fields so arguments can't be swapped
+type DeploymentOptions struct {
+	Namespace string
+
+	OperatorChart             string
+	OrchestraChart            string
+	OrchestraLoginPortalChart string
+	// only used by NewOpenUnisonDeployment, as are the database and smtp passwords and SkipClusterManagement
+	ClusterManagementChart string
+
+	PathToValuesYaml string
+
+	// the primary authentication secret, -s
+	SecretFile string
+	// a YAML or dotenv file with keys for orchestra-secrets-source
+	PathToSecrets string
+	// keys for orchestra-secrets-source and their secret sources
+	SecretSources      map[string]string
+	PathToDbPassword   string
+	PathToSmtpPassword string
+
+	SkipClusterManagement bool
+
+	AdditionalCharts []HelmChartInfo
+	PreCharts        []HelmChartInfo
+	NamespaceLabels  map[string]string
+	SkipCharts       []string
+
+	RegistryOptions   RegistryOptions
+	RepositoryOptions RepositoryOptions
+	PathToBundle      string
+	ImageRelocation   ImageRelocation
+	// post renderers by chart name
+	PostRenderers     map[string]string
+	ChartLock         ChartLock
+	ChartVerification ChartVerification
+
+	SecretPolicy SecretPolicy
+	SecretOutput SecretOutput
+}
+
+// configures how a satelite is integrated with its control plane
+type SateliteOptions struct {
+	ControlPlaneContextName string
+	SateliteContextName     string
+	AddClusterChart         string
+	PathToSateliteYaml      string
+
+	// defaults to the satelite's namespace
+	ControlPlaneNamespace     string
+	ControlPlaneOrchestraName string
+	ControlPlaneSecretName    string
+	ControlPlaneHelmDriver    string
+	ControlPlaneKubeconfig    string
+	ControlPlaneHost          string
+	FetchControlPlaneChain    bool
+	ControlPlaneCAFingerprint string
+
+	SkipControlPlaneIntegration bool
+	ForceTakeover               bool
 }
 
 // creates a new deployment structure
-func NewOpenUnisonDeployment(namespace string, operatorChart string, orchestraChart string, orchestraLoginPortalChart string, pathToValuesYaml string, secretFile string, clusterManagementChart string, pathToDbPassword string, pathToSmtpPassword string, skipClusterManagement bool, additionalCharts []HelmChartInfo, preCharts []HelmChartInfo, namespaceLabels map[string]string, skipCharts []string, ociCaCertPath string) (*OpenUnisonDeployment, error) {
-	ou, err := NewSateliteDeployment(namespace, operatorChart, orchestraChart, orchestraLoginPortalChart, pathToValuesYaml, secretFile, "", "", "", "", additionalCharts, preCharts, namespaceLabels, "orchestra", "orchestra-secrets-source", false, skipCharts, ociCaCertPath)
+func NewOpenUnisonDeployment(options DeploymentOptions) (*OpenUnisonDeployment, error) {
+	ou, err := NewSateliteDeployment(options, SateliteOptions{
+		ControlPlaneNamespace:     options.Namespace,
+		ControlPlaneOrchestraName: "orchestra",
+		ControlPlaneSecretName:    "orchestra-secrets-source",
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	ou.clusterManagementChart = clusterManagementChart
-	ou.pathToDbPassword = pathToDbPassword
-	ou.pathToSmtpPassword = pathToSmtpPassword
-	ou.skipClusterManagement = skipClusterManagement
+	ou.clusterManagementChart = options.ClusterManagementChart
+	ou.pathToDbPassword = options.PathToDbPassword
+	ou.pathToSmtpPassword = options.PathToSmtpPassword
+	ou.skipClusterManagement = options.SkipClusterManagement
 
 	return ou, nil
 }
 
 // creates a new deployment structure
-func NewSateliteDeployment(namespace string, operatorChart string, orchestraChart string, orchestraLoginPortalChart string, pathToValuesYaml string, secretFile string, controlPlanContextName string, sateliteContextName string, addClusterChart string, pathToSateliteYaml string, additionalCharts []HelmChartInfo, preCharts []HelmChartInfo, namespaceLabels map[string]string, cpOrchestraName string, cpSecretName string, skipCpIntegration bool, skipCharts []string, ociCaCertPath string) (*OpenUnisonDeployment, error) {
+func NewSateliteDeployment(options DeploymentOptions, satelite SateliteOptions) (*OpenUnisonDeployment, error) {
 	ou := &OpenUnisonDeployment{IsolatateRequestAccess: IsolateRequestAccess{Enabled: false, AzRules: make([]AzRule, 0)}}
 
-	ou.namespace = namespace
+	ou.namespace = options.Namespace
 
-	ou.operator.chart = operatorChart
+	ou.operator.chart = options.OperatorChart
 
-	ou.orchestraChart = orchestraChart
-	ou.orchestraLoginPortalChart = orchestraLoginPortalChart
-	ou.pathToValuesYaml = pathToValuesYaml
-	ou.secretFile = secretFile
+	ou.orchestraChart = options.OrchestraChart
+	ou.orchestraLoginPortalChart = options.OrchestraLoginPortalChart
+	ou.pathToValuesYaml = options.PathToValuesYaml
+	ou.secretFile = options.SecretFile
 
-	ou.controlPlaneContextName = controlPlanContextName
-	ou.satelateContextName = sateliteContextName
-	ou.addClusterChart = addClusterChart
+	ou.controlPlaneContextName = satelite.ControlPlaneContextName
+	ou.satelateContextName = satelite.SateliteContextName
+	ou.addClusterChart = satelite.AddClusterChart
 
-	ou.pathToSaveSateliteValues = pathToSateliteYaml
+	ou.pathToSaveSateliteValues = satelite.PathToSateliteYaml
 
-	ou.additionalCharts = additionalCharts
-	ou.preCharts = preCharts
+	ou.additionalCharts = options.AdditionalCharts
+	ou.preCharts = options.PreCharts
 
 	err := ou.loadKubernetesConfiguration()
 	if err != nil {
@@ -166,19 +264,108 @@ func NewSateliteDeployment(namespace string, operatorChart string, orchestraChar
 		return nil, err
 	}
 
-	ou.namespaceLabels = namespaceLabels
+	ou.secretValues = make(map[string][]byte)
+
+	if options.PathToSecrets != "" {
+		ou.secretValues, err = loadSecretsFile(options.PathToSecrets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, ref := range options.SecretSources {
+		source, err := ParseSecretSource(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		// exec: sources print only the command, not its arguments
+		fmt.Printf("Loading %s from %s\n", key, source)
+		ou.secretValues[key], err = readSecretSource(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ou.namespaceLabels = options.NamespaceLabels
+
+	ou.cpNamespace = satelite.ControlPlaneNamespace
+	if ou.cpNamespace == "" {
+		ou.cpNamespace = options.Namespace
+	}
+
+	ou.cpOrchestraName = satelite.ControlPlaneOrchestraName
+	ou.cpSecretName = satelite.ControlPlaneSecretName
+	ou.cpHelmDriver = satelite.ControlPlaneHelmDriver
+
+	if satelite.ControlPlaneKubeconfig != "" {
+		ou.controlPlaneConfig, err = loadControlPlaneKubeconfig(satelite.ControlPlaneKubeconfig, satelite.ControlPlaneContextName)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	ou.cpOrchestraName = cpOrchestraName
-	ou.cpSecretName = cpSecretName
-	ou.skipCpIntegration = skipCpIntegration
+	ou.controlPlaneHost = satelite.ControlPlaneHost
+	ou.fetchControlPlaneChain = satelite.FetchControlPlaneChain
+	ou.controlPlaneCAFingerprint = satelite.ControlPlaneCAFingerprint
+	ou.skipCpIntegration = satelite.SkipControlPlaneIntegration
+	ou.forceTakeover = satelite.ForceTakeover
 
 	ou.skipCharts = map[string]bool{}
 
-	for chartToSkip := range skipCharts {
-		ou.skipCharts[skipCharts[chartToSkip]] = true
+	for chartToSkip := range options.SkipCharts {
+		ou.skipCharts[options.SkipCharts[chartToSkip]] = true
+	}
+
+	ou.registryOptions = options.RegistryOptions
+	ou.repositoryOptions = options.RepositoryOptions
+	ou.updatedRepositories = make(map[string]bool)
+
+	if options.PathToBundle != "" {
+		ou.bundle, err = openBundle(options.PathToBundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ou.imageRelocation = options.ImageRelocation
+
+	ou.postRendererSpecs = options.PostRenderers
+	ou.postRenderers, err = newPostRenderers(options.PostRenderers)
+	if err != nil {
+		return nil, err
+	}
+
+	ou.chartLock = options.ChartLock
+	ou.resolvedCharts = make(map[string]LockedChart)
+
+	if options.ChartLock.Path != "" && (options.ChartLock.Locked || options.ChartLock.Record) {
+		ou.lockFile, err = loadLockFile(options.ChartLock.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if options.ChartLock.Locked && len(ou.lockFile.Charts) == 0 {
+			return nil, fmt.Errorf("--locked requires a lock file, but %s has no charts", options.ChartLock.Path)
+		}
+	} else if options.ChartLock.Locked {
+		return nil, fmt.Errorf("--locked requires a lock file")
+	}
+
+	if options.ChartVerification.Verify && ou.bundle != nil {
+		return nil, fmt.Errorf("charts in a bundle can't be verified, add --verify to 'bundle create' instead")
+	}
+
+	ou.chartVerification = options.ChartVerification
+
+	ou.secretPolicy = options.SecretPolicy
+
+	err = options.SecretOutput.Validate()
+	if err != nil {
+		return nil, err
 	}
 
-	ou.ociCaCertPath = ociCaCertPath
+	ou.secretOutput = options.SecretOutput
 
 	return ou, nil
 }
@@ -192,6 +379,16 @@ func (ou *OpenUnisonDeployment) loadHelmValues() error {
 		return err
 	}
 
+	yamlValues, ou.helmValuesEncrypted, err = decryptSops(yamlValues)
+
+	if err != nil {
+		return fmt.Errorf("could not decrypt %s: %v", ou.pathToValuesYaml, err)
+	}
+
+	if ou.helmValuesEncrypted {
+		fmt.Printf("Decrypted SOPS values\n")
+	}
+
 	ou.helmValues = make(map[string]interface{})
 
 	err = yaml.Unmarshal(yamlValues, &ou.helmValues)
@@ -205,6 +402,22 @@ func (ou *OpenUnisonDeployment) loadHelmValues() error {
 	return nil
 }
 
+// writes the generated values back to the values.yaml, unless it's encrypted
+func (ou *OpenUnisonDeployment) saveHelmValues() error {
+	if ou.helmValuesEncrypted {
+		fmt.Printf("%s is encrypted with SOPS, not saving generated values\n", ou.pathToValuesYaml)
+		return nil
+	}
+
+	dataToWrite, err := yaml.Marshal(&ou.helmValues)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ou.pathToValuesYaml, dataToWrite, 0644)
+}
+
 func (ou *OpenUnisonDeployment) IsNaas() bool {
 	return isNaasFromHelm(ou.helmValues)
 }
@@ -216,7 +429,7 @@ func isNaasFromHelm(helm map[string]interface{}) bool {
 		return false
 	}
 
-	enableProvisioning := openunison["enable_provisioning"].(bool)
+	enableProvisioning, _ := openunison["enable_provisioning"].(bool)
 
 	return enableProvisioning
 }
@@ -227,6 +440,9 @@ func (ou *OpenUnisonDeployment) setCurrentContext(ctxName string) (string, error
 
 	currentContextName := ctxName
 
+	// k8s: secret sources without a context stay on the context ouctl started with
+	recordStartupContext()
+
 	pathOptions := clientcmd.NewDefaultPathOptions()
 	curCfg, err := pathOptions.GetStartingConfig()
 
@@ -234,6 +450,8 @@ func (ou *OpenUnisonDeployment) setCurrentContext(ctxName string) (string, error
 		return "", err
 	}
 
+	ou.controlPlaneActive = false
+
 	if curCfg.CurrentContext != ctxName {
 
 		_, ok := curCfg.Contexts[ctxName]
@@ -252,30 +470,186 @@ func (ou *OpenUnisonDeployment) setCurrentContext(ctxName string) (string, error
 	return currentContextName, nil
 }
 
+// switch to the control plane, if it has its own kubeconfig the current context isn't changed.  Returns the context
+// that was current
+func (ou *OpenUnisonDeployment) setControlPlaneContext() (string, error) {
+	if ou.controlPlaneConfig == nil {
+		return ou.setCurrentContext(ou.controlPlaneContextName)
+	}
+
+	curCfg, err := clientcmd.NewDefaultPathOptions().GetStartingConfig()
+	if err != nil {
+		return "", err
+	}
+
+	ou.controlPlaneActive = true
+
+	return curCfg.CurrentContext, nil
+}
+
 // get the current k8s configuration
 
 func (ou *OpenUnisonDeployment) loadKubernetesConfiguration() error {
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	configOverrides := &clientcmd.ConfigOverrides{}
-	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+	var config *rest.Config
+	var err error
+
+	if ou.controlPlaneActive {
+		config, err = ou.controlPlaneConfig.ClientConfig()
+	} else {
+		config, err = loadRestConfig()
+	}
 
-	config, err := kubeConfig.ClientConfig()
 	if err != nil {
 		return err
 	}
 
-	ou.clientset, err = kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return err
 	}
 
+	ou.clientset = clientset
+	ou.restConfig = config
+
 	return nil
 }
 
+// the configuration of the current context
+func loadRestConfig() (*rest.Config, error) {
+	return loadRestConfigForContext("")
+}
+
+// the configuration of a context without making it the current context, the current context if contextName is empty
+func loadRestConfigForContext(contextName string) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	configOverrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+
+	return kubeConfig.ClientConfig()
+}
+
+// creates a clientset for the current context
+func loadClientset() (*kubernetes.Clientset, error) {
+	config, err := loadRestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
 // deploy a NaaS Portal
 
 func (ou *OpenUnisonDeployment) DeployNaaSPortal() error {
 
+	err := ou.validateNaaSValues()
+
+	if err != nil {
+		return err
+	}
+
+	// deploy the operator
+	settings := cli.New()
+	actionConfig := new(action.Configuration)
+
+	if err := actionConfig.Init(settings.RESTClientGetter(), ou.namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return err
+	}
+
+	listClient := action.NewList(actionConfig)
+
+	clusterManagementChartDeployed := false
+
+	listClient.All = true
+	releases, err := listClient.Run()
+
+	for _, release := range releases {
+		if release.Name == "cluster-management" && release.Namespace == ou.namespace {
+			clusterManagementChartDeployed = true
+		}
+	}
+
+	// add standard groups to NaaS based on roles defined
+	client := action.NewInstall(actionConfig)
+
+	client.Namespace = ou.namespace
+	client.ReleaseName = "cluster-management"
+
+	chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
+
+	if err != nil {
+		return err
+	}
+
+	err = ou.setNaaSAzGroups(chartReq)
+
+	if err != nil {
+		return err
+	}
+
+	// with merged values, create azRules
+
+	err = ou.DeployAuthPortal()
+
+	if err != nil {
+		return err
+	}
+
+	//if !openunisonDeployed {
+	fmt.Print("Deploying the Cluster Management chart\n")
+
+	if ou.skipClusterManagement {
+		fmt.Println("Skipping cluster management chart")
+	} else {
+
+		if !clusterManagementChartDeployed {
+			fmt.Println("Chart not deployed, installing")
+			client := action.NewInstall(actionConfig)
+
+			client.Namespace = ou.namespace
+			client.ReleaseName = "cluster-management"
+
+			chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
+			if err != nil {
+				return err
+			}
+
+			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
+
+			//_, err = client.Run(chartReq, mergedValues)
+			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig, true)
+
+			if err != nil {
+				return err
+			}
+		} else {
+			fmt.Println("Chart deployed, upgrading")
+			client := action.NewUpgrade(actionConfig)
+
+			client.Namespace = ou.namespace
+
+			chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
+
+			if err != nil {
+				return err
+			}
+
+			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
+			//_, err = client.Run("cluster-management", chartReq, mergedValues)
+			_, err = ou.runChartUpgrade(client, "cluster-management", chartReq, mergedValues)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checks that the values are valid for a NaaS portal
+func (ou *OpenUnisonDeployment) validateNaaSValues() error {
+
 	openunison := ou.helmValues["openunison"].(map[string]interface{})
 	enableProvisioning := openunison["enable_provisioning"].(bool)
 
@@ -284,10 +658,6 @@ func (ou *OpenUnisonDeployment) DeployNaaSPortal() error {
 	}
 
 	externalEnabled := false
-	internalEnabled := false
-
-	externalSuffix := ""
-	internalSuffix := ""
 
 	naas, found := openunison["naas"].(map[string]interface{})
 	if found {
@@ -322,39 +692,11 @@ func (ou *OpenUnisonDeployment) DeployNaaSPortal() error {
 		return fmt.Errorf("no smtp section to your values.yaml")
 	}
 
-	// deploy the operator
-	settings := cli.New()
-	actionConfig := new(action.Configuration)
-
-	if err := actionConfig.Init(settings.RESTClientGetter(), ou.namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
-		return err
-	}
-
-	listClient := action.NewList(actionConfig)
-
-	clusterManagementChartDeployed := false
-
-	listClient.All = true
-	releases, err := listClient.Run()
-
-	for _, release := range releases {
-		if release.Name == "cluster-management" && release.Namespace == ou.namespace {
-			clusterManagementChartDeployed = true
-		}
-	}
-
-	// add standard groups to NaaS based on roles defined
-	client := action.NewInstall(actionConfig)
-
-	client.Namespace = ou.namespace
-	client.ReleaseName = "cluster-management"
-
-	chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
-
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
+// adds the az_groups for the NaaS roles, based on the values merged with the cluster management chart
+func (ou *OpenUnisonDeployment) setNaaSAzGroups(chartReq *chart.Chart) error {
 	mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
 
 	openunisonCfg, ok := mergedValues["openunison"]
@@ -374,6 +716,12 @@ func (ou *OpenUnisonDeployment) DeployNaaSPortal() error {
 		return fmt.Errorf("When configuring NaaS groups, no openunison.naas.groups section")
 	}
 
+	externalEnabled := false
+	internalEnabled := false
+
+	externalSuffix := ""
+	internalSuffix := ""
+
 	external, found := groupsCfg.(map[string]interface{})["external"].(map[string]interface{})
 	if found {
 		externalEnabled, found = external["enabled"].(bool)
@@ -418,83 +766,119 @@ func (ou *OpenUnisonDeployment) DeployNaaSPortal() error {
 
 	ou.helmValues["openunison"].(map[string]interface{})["az_groups"] = azRules
 
-	// with merged values, create azRules
+	return nil
+}
 
-	err = ou.DeployAuthPortal()
+// what prepareSatelite found on the control plane, used to integrate the satelite once it's deployed
+type sateliteIntegration struct {
+	clusterName  string
+	releaseName  string
+	integrated   bool
+	actionConfig *action.Configuration
+	settings     *cli.EnvSettings
+
+	naasEnabled           bool
+	managementEnabled     bool
+	naasGroupsInternal    bool
+	naasExternalSuffix    string
+	externalNaasGroupName string
+	managementProxyUrl    string
+	naasRoles             []map[string]interface{}
+
+	// the control plane's certificate added to the satelite's trusted_certs, empty if it's trusted by default
+	idpCert string
+}
+
+// deploys an OpenUnison satelite
+func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
+
+	originalContextName, err := ou.setControlPlaneContext()
 
 	if err != nil {
 		return err
 	}
 
-	//if !openunisonDeployed {
-	fmt.Print("Deploying the Cluster Management chart\n")
+	ou.loadKubernetesConfiguration()
 
-	if ou.skipClusterManagement {
-		fmt.Println("Skipping cluster management chart")
-	} else {
+	integration, err := ou.prepareSatelite()
 
-		if !clusterManagementChartDeployed {
-			fmt.Println("Chart not deployed, installing")
-			client := action.NewInstall(actionConfig)
+	if err != nil {
+		return err
+	}
 
-			client.Namespace = ou.namespace
-			client.ReleaseName = "cluster-management"
+	clusterName := integration.clusterName
+	satelateReleaseName := integration.releaseName
+	sateliteIntegrated := integration.integrated
+	actionConfig := integration.actionConfig
+	settings := integration.settings
+	naasRoles := integration.naasRoles
 
-			chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
-			if err != nil {
-				return err
-			}
+	if !ou.skipCpIntegration {
+		shouldReturn, returnValue := ou.integrateSatelite(ou.helmValues, clusterName, err, sateliteIntegrated, actionConfig, satelateReleaseName, settings, nil, "", "", naasRoles)
+		if shouldReturn {
+			return returnValue
+		}
+	}
 
-			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
+	// deploy the satelte
+	fmt.Printf("Switching to %v\n", ou.satelateContextName)
+	_, err = ou.setCurrentContext(ou.satelateContextName)
 
-			//_, err = client.Run(chartReq, mergedValues)
-			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deploying the satelite")
+	ou.loadKubernetesConfiguration()
+	err = ou.DeployAuthPortal()
 
-			if err != nil {
-				return err
-			}
-		} else {
-			fmt.Println("Chart deployed, upgrading")
-			client := action.NewUpgrade(actionConfig)
+	if err != nil {
+		return err
+	}
 
-			client.Namespace = ou.namespace
+	err = ou.DeployAdditionalCharts()
+	if err != nil {
+		return err
+	}
 
-			chartReq, err := ou.locateChart(ou.clusterManagementChart, &client.ChartPathOptions, settings)
+	if !ou.skipCpIntegration {
+		if integration.naasEnabled && integration.managementEnabled {
+			// if the naas is enabled, need to deploy management
+			management := ou.sateliteManagement(integration)
 
-			if err != nil {
-				return err
+			// redeployment satelite integration
+			ou.setControlPlaneContext()
+			ou.loadKubernetesConfiguration()
+			shouldReturn, returnValue := ou.integrateSatelite(ou.helmValues, clusterName, err, sateliteIntegrated, actionConfig, satelateReleaseName, settings, management, integration.naasExternalSuffix, integration.externalNaasGroupName, naasRoles)
+			if shouldReturn {
+				return returnValue
 			}
 
-			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
-			//_, err = client.Run("cluster-management", chartReq, mergedValues)
-			_, err = ou.runChartUpgrade(client, "cluster-management", chartReq, mergedValues)
-
-			if err != nil {
-				return err
-			}
 		}
-	}
 
-	return nil
-}
+	}
 
-// deploys an OpenUnison satelite
-func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
+	// leave the kubeconfig the way we found it
+	ou.setCurrentContext(originalContextName)
 
-	originalContextName, err := ou.setCurrentContext(ou.controlPlaneContextName)
+	fmt.Println(sateliteIntegrated)
+	fmt.Println(originalContextName)
 
-	if err != nil {
-		return err
+	if !ou.skipCpIntegration {
+		return ou.verifyIdPTrust(integration)
 	}
 
-	ou.loadKubernetesConfiguration()
+	return nil
+}
 
+// reads the control plane's configuration, creates the satelite's client secret on the control plane and generates
+// the satelite's oidc configuration in its values.yaml.  The control plane must be the current context
+func (ou *OpenUnisonDeployment) prepareSatelite() (*sateliteIntegration, error) {
 	// get the satelite cluster name
 
 	clusterName, ok := ou.helmValues["k8s_cluster_name"].(string)
 
 	if !ok {
-		return fmt.Errorf("k8s_cluster_name must be defined in the satalite values.yaml")
+		return nil, fmt.Errorf("k8s_cluster_name must be defined in the satalite values.yaml")
 	}
 
 	satelateReleaseName := "satellite-" + clusterName
@@ -502,8 +886,13 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 	settings := cli.New()
 	actionConfig := new(action.Configuration)
 
-	if err := actionConfig.Init(settings.RESTClientGetter(), ou.namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
-		return err
+	cpHelmDriver := ou.cpHelmDriver
+	if cpHelmDriver == "" {
+		cpHelmDriver = os.Getenv("HELM_DRIVER")
+	}
+
+	if err := actionConfig.Init(ou.controlPlaneRESTClientGetter(settings), ou.cpNamespace, cpHelmDriver, log.Printf); err != nil {
+		return nil, err
 	}
 
 	listClient := action.NewList(actionConfig)
@@ -514,96 +903,114 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 	sateliteIntegrated := false
 
 	for _, release := range releases {
-		if release.Namespace == ou.namespace && release.Name == satelateReleaseName {
+		if release.Namespace == ou.cpNamespace && release.Name == satelateReleaseName {
 			sateliteIntegrated = true
 		}
 	}
 
-	ouSecret, err := ou.clientset.CoreV1().Secrets(ou.namespace).Get(context.TODO(), ou.cpSecretName, metav1.GetOptions{})
-	foundSecret := false
-	if err != nil {
+	var currentCpSecret *v1.Secret
+	ouSecret, err := ou.clientset.CoreV1().Secrets(ou.cpNamespace).Get(context.TODO(), ou.cpSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
 		ouSecret = &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      ou.cpSecretName,
-				Namespace: ou.namespace,
+				Namespace: ou.cpNamespace,
 			},
 			Data: map[string][]byte{},
 		}
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load the control plane's client secrets from %s/%s: %v", ou.cpNamespace, ou.cpSecretName, err)
 	} else {
-		foundSecret = true
+		currentCpSecret = ouSecret.DeepCopy()
+		if ouSecret.Data == nil {
+			ouSecret.Data = map[string][]byte{}
+		}
 	}
 
-	sateliteClientSecret, ok := ouSecret.Data["cluster-idp-"+clusterName]
-
-	if !ok {
-		fmt.Println("SSO Client Secret doesn't exist, creating")
-		ou.secret = string(randSeq((64)))
-		ouSecret.Data["cluster-idp-"+clusterName] = []byte(ou.secret)
-
-		if foundSecret {
-			ou.clientset.CoreV1().Secrets(ou.namespace).Update(context.TODO(), ouSecret, metav1.UpdateOptions{})
-		} else {
-			_, err = ou.clientset.CoreV1().Secrets(ou.namespace).Create(context.TODO(), ouSecret, metav1.CreateOptions{})
-			if err != nil {
-				return err
-			}
-		}
+	migratedKeys, err := ou.migrateSateliteClientSecret(ouSecret, clusterName)
+	if err != nil {
+		return nil, err
+	}
 
-		fmt.Println("Created")
-	} else {
-		fmt.Println("SSO client secret already created, retrieving")
-		ou.secret = string(sateliteClientSecret)
+	cpSecretKeys, err := ou.secretOutput.existingKeys(ou.controlPlaneContextName, ou.cpNamespace, ou.cpSecretName)
+	if err != nil {
+		return nil, err
 	}
 
-	respBytes, err := ou.clientset.RESTClient().Get().RequestURI("/apis/apiextensions.k8s.io/v1/customresourcedefinitions/openunisons.openunison.tremolo.io").DoRaw(context.TODO())
+	sateliteUID, err := ou.sateliteClusterUID()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ouCrd := make(map[string]interface{})
-	json.Unmarshal(respBytes, &ouCrd)
+	_, secretExists := ouSecret.Data["cluster-idp-"+clusterName]
+	takeover, err := ou.checkSateliteCollision(clusterName, satelateReleaseName, sateliteIntegrated, secretExists || cpSecretKeys["cluster-idp-"+clusterName], ouSecret, sateliteUID, actionConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	spec := ouCrd["spec"].(map[string]interface{})
-	versions, ok := spec["versions"].([]interface{})
+	if takeover {
+		// the other cluster's client secret is replaced so it can't keep using the registration
+		delete(ouSecret.Data, "cluster-idp-"+clusterName)
+		delete(cpSecretKeys, "cluster-idp-"+clusterName)
+	}
 
-	if !ok {
-		return fmt.Errorf("no spec in openunison crd")
+	// record which cluster the name belongs to
+	recordSateliteUID := ouSecret.Annotations[sateliteClusterAnnotation(clusterName)] != sateliteUID
+	if ouSecret.Annotations == nil {
+		ouSecret.Annotations = map[string]string{}
 	}
+	ouSecret.Annotations[sateliteClusterAnnotation(clusterName)] = sateliteUID
 
-	ouVersion := ""
+	sateliteClientSecret, ok := ouSecret.Data["cluster-idp-"+clusterName]
 
-	for _, v := range versions {
-		version := v.(map[string]interface{})
-		served := version["served"].(bool)
-		stored := version["storage"].(bool)
+	if !ok && cpSecretKeys["cluster-idp-"+clusterName] {
+		// the secret was generated by a previous run, but can't be read back from the manifest
+		fmt.Println("SSO client secret already written to the control plane's secret manifest, keeping the satelite's existing client secret")
+		ou.secret = ""
 
-		if served && stored {
-			ouVersion = version["name"].(string)
+		if recordSateliteUID {
+			err = ou.saveSecret(ou.controlPlaneContextName, ouSecret, currentCpSecret, nil)
+			if err != nil {
+				return nil, err
+			}
 		}
-	}
+	} else if !ok {
+		fmt.Println("SSO Client Secret doesn't exist, creating")
+		ou.secret, err = ou.secretPolicy.Generate()
+		if err != nil {
+			return nil, err
+		}
+		ouSecret.Data["cluster-idp-"+clusterName] = []byte(ou.secret)
 
-	if ouVersion == "" {
-		return fmt.Errorf("could not find version of openunisons")
-	}
+		err = ou.saveSecret(ou.controlPlaneContextName, ouSecret, currentCpSecret, []string{"cluster-idp-" + clusterName})
+		if err != nil {
+			return nil, err
+		}
 
-	fmt.Printf("OpenUnison CRD Version : %v\n", ouVersion)
+		fmt.Println("Created")
+	} else {
+		fmt.Println("SSO client secret already created, retrieving")
+		ou.secret = string(sateliteClientSecret)
 
-	respBytes, err = ou.clientset.RESTClient().Get().RequestURI("/apis/openunison.tremolo.io/" + ouVersion + "/namespaces/" + ou.namespace + "/openunisons/" + ou.cpOrchestraName).DoRaw(context.TODO())
-	if err != nil {
-		return err
+		if recordSateliteUID || len(migratedKeys) > 0 {
+			err = ou.saveSecret(ou.controlPlaneContextName, ouSecret, currentCpSecret, migratedKeys)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	orchestra := make(map[string]interface{})
-	json.Unmarshal(respBytes, &orchestra)
+	ouClient, err := newOpenUnisonClient(ou.restConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	var orchestraObj openunisonmodel.OpenUnison
-	json.Unmarshal(respBytes, &orchestraObj)
+	orchestraObj, err := ouClient.get(ou.cpNamespace, ou.cpOrchestraName)
+	if err != nil {
+		return nil, err
+	}
 
 	specObj := orchestraObj.Spec
-	hosts := specObj.Hosts
-	host := hosts[0]
-	names := host.Names
-
 	nonSecretData := specObj.NonSecretData
 
 	naasEnabled := false
@@ -632,7 +1039,7 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 		} else if nsdName == "openunison.naas.default-groups" {
 			enc, err := base64.StdEncoding.DecodeString(nsd.Value)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			var localRoles []map[string]interface{}
@@ -640,7 +1047,7 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 			err = json.Unmarshal(enc, &localRoles)
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			naasRoles = append(naasRoles, localRoles...)
@@ -648,7 +1055,7 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 		} else if nsdName == "openunison.naas.roles" {
 			enc, err := base64.StdEncoding.DecodeString(nsd.Value)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			var localRoles []map[string]interface{}
@@ -656,7 +1063,7 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 			err = json.Unmarshal(enc, &localRoles)
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			naasRoles = append(naasRoles, localRoles...)
@@ -664,13 +1071,13 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 		} else if nsdName == "openunison.naas.internal-isolateRequestAccess" {
 			enc, err := base64.StdEncoding.DecodeString(nsd.Value)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			err = json.Unmarshal(enc, &ou.IsolatateRequestAccess)
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			// need the important info from the isolate structure
@@ -682,22 +1089,18 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 
 	}
 
-	idpHostName := ""
-
-	for _, name := range names {
-
-		if name.EnvVar == "OU_HOST" {
-			idpHostName = name.Name
-		}
-	}
-
-	if idpHostName == "" {
-		return fmt.Errorf("could not find OU_HOST name in orchestra CRD")
+	idpHostName, idpTLSSecretName, err := ou.controlPlaneIssuerHost(specObj)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Printf("Control Plane IdP host name: %v\n", idpHostName)
 
 	keyStore := specObj.KeyStore
+	if keyStore == nil || keyStore.KeyPairs == nil {
+		return nil, fmt.Errorf("OpenUnison %s has no key_store.key_pairs", ou.cpOrchestraName)
+	}
+
 	keyPairs := keyStore.KeyPairs
 	keys := keyPairs.Keys
 
@@ -714,11 +1117,14 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 
 	idpCert := ""
 
-	if isLocalGeneratedCert {
-		ouTlsKey, err := ou.clientset.CoreV1().Secrets(ou.namespace).Get(context.TODO(), "ou-tls-certificate", metav1.GetOptions{})
+	if isLocalGeneratedCert && ou.fetchControlPlaneChain {
+		// an integration account can't read ou-tls-certificate, the certificate is read from the host instead
+		fmt.Println("Reading the operator generated certificate from the control plane's host")
+	} else if isLocalGeneratedCert {
+		ouTlsKey, err := ou.clientset.CoreV1().Secrets(ou.cpNamespace).Get(context.TODO(), "ou-tls-certificate", metav1.GetOptions{})
 
 		if err != nil {
-			return err
+			return nil, controlPlaneSecretError("ou-tls-certificate", err)
 		}
 
 		idpCert = string(ouTlsKey.Data["tls.crt"])
@@ -730,7 +1136,7 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 			if cert.Name == "unison-ca" {
 				bytes, err := base64.StdEncoding.DecodeString(cert.PemData)
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				idpCert = string(bytes)
@@ -739,6 +1145,14 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 
 	}
 
+	if idpCert == "" {
+		// the certificate is from cert-manager or another CA
+		idpCert, err = ou.detectIdPCertificate(idpHostName, idpTLSSecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	fmt.Printf("IdP Certificate : %v\n", idpCert)
 
 	// create updates to yaml
@@ -766,60 +1180,29 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 
 	trustedCertAlias := "trusted-idp"
 
-	//add the idp's certificate
+	//add the idp's certificate, updating the existing entry if the certificate changed
 	if idpCert != "" {
-
-		trustCertsJson, err := json.Marshal(ou.helmValues["trusted_certs"])
-
+		trustedCerts, err := helmmodel.ParseTrustedCerts(ou.helmValues["trusted_certs"])
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		var trustedCerts []helmmodel.TrustedCertsInner
-
-		json.Unmarshal(trustCertsJson, &trustedCerts)
-
-		// trustedCerts, ok := ou.helmValues["trusted_certs"].([]interface{})
-		// if !ok {
-		// 	trustedCerts = make([]interface{}, 0)
-		// }
-
-		foundCert := false
-
-		b64Cert := base64.StdEncoding.EncodeToString([]byte(idpCert))
-
-		for _, cert := range trustedCerts {
-
-			if cert.Name == "trusted-idp" {
-				cert.PemB64 = b64Cert
-				foundCert = true
-				break
-			} else if cert.PemB64 == b64Cert {
-				foundCert = true
-				trustedCertAlias = cert.Name
-				break
-			}
-		}
-
-		if !foundCert {
-			trustedCert := &helmmodel.TrustedCertsInner{}
-			trustedCert.Name = "trusted-idp"
-			trustedCert.PemB64 = b64Cert
-
-			trustedCerts = append(trustedCerts, *trustedCert)
-
-			tcjson, err := json.Marshal(trustedCerts)
-
-			if err != nil {
-				panic(err)
-			}
+		for _, removed := range trustedCerts.Reconcile() {
+			fmt.Printf("Removing trusted_certs entry %s\n", removed)
+		}
 
-			var tcarray []map[string]string
-			json.Unmarshal(tcjson, &tcarray)
+		trustedCertAlias, err = trustedCerts.Set("trusted-idp", []byte(idpCert))
+		if err != nil {
+			return nil, err
+		}
 
-			ou.helmValues["trusted_certs"] = tcarray
+		if trustedCertAlias != "trusted-idp" {
+			fmt.Printf("The control plane's certificate is already trusted as %s\n", trustedCertAlias)
 		}
 
+		printTrustedCertWarnings(trustedCerts)
+
+		ou.helmValues["trusted_certs"] = trustedCerts.Values()
 	}
 
 	managementProxyUrl := ""
@@ -883,121 +1266,93 @@ func (ou *OpenUnisonDeployment) DeployOpenUnisonSatelite() error {
 		ou.extraAzGroups = openunison["extra_az_groups"].([]interface{})
 
 	}
-	dataToWrite, err := yaml.Marshal(&ou.helmValues)
+	err = ou.saveHelmValues()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ioutil.WriteFile(ou.pathToValuesYaml, dataToWrite, 0644)
-
-	if !ou.skipCpIntegration {
-		shouldReturn, returnValue := ou.integrateSatelite(ou.helmValues, clusterName, err, sateliteIntegrated, actionConfig, satelateReleaseName, settings, nil, "", "", naasRoles)
-		if shouldReturn {
-			return returnValue
-		}
-	}
+	return &sateliteIntegration{
+		clusterName:           clusterName,
+		releaseName:           satelateReleaseName,
+		integrated:            sateliteIntegrated,
+		actionConfig:          actionConfig,
+		settings:              settings,
+		naasEnabled:           naasEnabled,
+		managementEnabled:     sateliteManagementEnabled,
+		naasGroupsInternal:    naasGroupsInternal,
+		naasExternalSuffix:    naasExternalSuffix,
+		externalNaasGroupName: externalNaasGroupName,
+		managementProxyUrl:    managementProxyUrl,
+		naasRoles:             naasRoles,
+		idpCert:               idpCert,
+	}, nil
+}
 
-	// deploy the satelte
-	fmt.Printf("Switching to %v\n", ou.satelateContextName)
-	_, err = ou.setCurrentContext(ou.satelateContextName)
+// the management configuration for the add-cluster chart when the satelite is managed by a NaaS control plane,
+// the satelite must be the current context
+func (ou *OpenUnisonDeployment) sateliteManagement(integration *sateliteIntegration) map[string]interface{} {
+	targetCert := ""
+	var trustedCerts []helmmodel.TrustedCertsInner
+	trustCertsJson, err := json.Marshal(ou.helmValues["trusted_certs"])
 
 	if err != nil {
-		return err
+		panic(err)
 	}
-	fmt.Printf("Deploying the satelite")
-	ou.loadKubernetesConfiguration()
-	err = ou.DeployAuthPortal()
 
-	if err != nil {
-		return err
-	}
+	json.Unmarshal(trustCertsJson, &trustedCerts)
 
-	err = ou.DeployAdditionalCharts()
-	if err != nil {
-		return err
+	for _, trustedCert := range trustedCerts {
+		certName := trustedCert.Name
+		if certName == "unison-ca" {
+			targetCert = trustedCert.PemB64
+		}
 	}
 
-	if !ou.skipCpIntegration {
-		if naasEnabled && sateliteManagementEnabled {
-			// if the naas is enabled, need to deploy management
-			targetCert := ""
-			var trustedCerts []helmmodel.TrustedCertsInner
-			trustCertsJson, err := json.Marshal(ou.helmValues["trusted_certs"])
-
-			if err != nil {
-				panic(err)
-			}
-
-			json.Unmarshal(trustCertsJson, &trustedCerts)
-
-			for _, trustedCert := range trustedCerts {
-				certName := trustedCert.Name
-				if certName == "unison-ca" {
-					targetCert = trustedCert.PemB64
-				}
-			}
-
-			// trustedCerts, ok := ou.helmValues["trusted_certs"].([]interface{})
-			// if ok {
-			// 	for _, t := range trustedCerts {
-			// 		trustedCert := t.(map[string]interface{})
-			// 		certName := trustedCert["name"].(string)
-			// 		if certName == "unison-ca" {
-			// 			targetCert = trustedCert["pem_b64"].(string)
-			// 		}
-			// 	}
-			// }
-
-			if targetCert == "" {
-				// not found, load the ou-tls-certificate secret
-				tlsSecret, err := ou.clientset.CoreV1().Secrets(ou.namespace).Get(context.TODO(), "ou-tls-certificate", metav1.GetOptions{})
-				if err == nil {
-					targetCert = base64.StdEncoding.EncodeToString(tlsSecret.Data["tls.crt"])
-				}
-			}
-
-			management := make(map[string]interface{})
-			management["enabled"] = true
-
-			if ! naasGroupsInternal {
-				managementInternal := make(map[string]interface{})
-				managementInternal["enabled"] = false;
-				management["internal"] = managementInternal;
-			}
+	// trustedCerts, ok := ou.helmValues["trusted_certs"].([]interface{})
+	// if ok {
+	// 	for _, t := range trustedCerts {
+	// 		trustedCert := t.(map[string]interface{})
+	// 		certName := trustedCert["name"].(string)
+	// 		if certName == "unison-ca" {
+	// 			targetCert = trustedCert["pem_b64"].(string)
+	// 		}
+	// 	}
+	// }
 
-			target := make(map[string]interface{})
-			management["target"] = target
+	if targetCert == "" {
+		// not found, load the ou-tls-certificate secret
+		tlsSecret, err := ou.clientset.CoreV1().Secrets(ou.namespace).Get(context.TODO(), "ou-tls-certificate", metav1.GetOptions{})
+		if err == nil {
+			targetCert = base64.StdEncoding.EncodeToString(tlsSecret.Data["tls.crt"])
+		}
+	}
 
-			target["url"] = managementProxyUrl
-			target["tokenType"] = "oidc"
-			target["useToken"] = true
+	management := make(map[string]interface{})
+	management["enabled"] = true
 
-			if targetCert != "" {
-				target["base64_certificate"] = targetCert
-			}
+	if ! integration.naasGroupsInternal {
+		managementInternal := make(map[string]interface{})
+		managementInternal["enabled"] = false;
+		management["internal"] = managementInternal;
+	}
 
-			// redeployment satelite integration
-			ou.setCurrentContext(ou.controlPlaneContextName)
-			ou.loadKubernetesConfiguration()
-			shouldReturn, returnValue := ou.integrateSatelite(ou.helmValues, clusterName, err, sateliteIntegrated, actionConfig, satelateReleaseName, settings, management, naasExternalSuffix, externalNaasGroupName, naasRoles)
-			if shouldReturn {
-				return returnValue
-			}
+	target := make(map[string]interface{})
+	management["target"] = target
 
-		}
+	target["url"] = integration.managementProxyUrl
+	target["tokenType"] = "oidc"
+	target["useToken"] = true
 
+	if targetCert != "" {
+		target["base64_certificate"] = targetCert
 	}
 
-	// leave the kubeconfig the way we found it
-	ou.setCurrentContext(originalContextName)
-
-	fmt.Println(sateliteIntegrated)
-	fmt.Println(originalContextName)
-	return nil
+	return management
 }
 
-func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interface{}, clusterName string, err error, sateliteIntegrated bool, actionConfig *action.Configuration, satelateReleaseName string, settings *cli.EnvSettings, management map[string]interface{}, externalGroupNameSuffix string, externalGroupName string, naasRoles []map[string]interface{}) (bool, error) {
+// builds the values for the add-cluster chart on the control plane
+func (ou *OpenUnisonDeployment) sateliteIntegrationValues(helmValues map[string]interface{}, clusterName string, management map[string]interface{}, externalGroupNameSuffix string, externalGroupName string, naasRoles []map[string]interface{}) (map[string]interface{}, error) {
 	cpYaml := `{
 		"cluster": {
 		  "name": "%v",
@@ -1050,10 +1405,10 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 	fmt.Printf("Integrating satelite into the control plane with yaml: \n%v\n", cpYaml)
 
 	cpValues := make(map[string]interface{})
-	err = json.Unmarshal([]byte(cpYaml), &cpValues)
+	err := json.Unmarshal([]byte(cpYaml), &cpValues)
 
 	if err != nil {
-		return true, err
+		return nil, err
 	}
 
 	if management != nil {
@@ -1122,13 +1477,23 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 		dataToWrite, err := yaml.Marshal(&cpValues)
 
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 
 		ioutil.WriteFile(ou.pathToSaveSateliteValues, dataToWrite, 0644)
 	}
 
-	_, err = ou.setCurrentContext(ou.controlPlaneContextName)
+	return cpValues, nil
+}
+
+func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interface{}, clusterName string, err error, sateliteIntegrated bool, actionConfig *action.Configuration, satelateReleaseName string, settings *cli.EnvSettings, management map[string]interface{}, externalGroupNameSuffix string, externalGroupName string, naasRoles []map[string]interface{}) (bool, error) {
+	cpValues, err := ou.sateliteIntegrationValues(helmValues, clusterName, management, externalGroupNameSuffix, externalGroupName, naasRoles)
+
+	if err != nil {
+		return true, err
+	}
+
+	_, err = ou.setControlPlaneContext()
 
 	if err != nil {
 		return true, err
@@ -1143,7 +1508,7 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 		fmt.Print("Satelite not integrated yet, deploying")
 		client := action.NewInstall(actionConfig)
 
-		client.Namespace = ou.namespace
+		client.Namespace = ou.cpNamespace
 		client.ReleaseName = satelateReleaseName
 
 		chartReq, err := ou.locateChart(ou.addClusterChart, &client.ChartPathOptions, settings)
@@ -1153,7 +1518,7 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 		}
 
 		//_, err = client.Run(chartReq, cpValues)
-		_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, cpValues, actionConfig)
+		_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, cpValues, actionConfig, false)
 		if err != nil {
 			return true, err
 		}
@@ -1161,7 +1526,7 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 		fmt.Println("Satelite already integrated, upgrading")
 		client := action.NewUpgrade(actionConfig)
 
-		client.Namespace = ou.namespace
+		client.Namespace = ou.cpNamespace
 
 		chartReq, err := ou.locateChart(ou.addClusterChart, &client.ChartPathOptions, settings)
 
@@ -1179,21 +1544,45 @@ func (ou *OpenUnisonDeployment) integrateSatelite(helmValues map[string]interfac
 	return false, nil
 }
 
-func (ou *OpenUnisonDeployment) runChartInstall(client *action.Install, name string, chartReq *chart.Chart, cpValues map[string]interface{}, actionConfig *action.Configuration) (bool, error) {
+// installs the chart, retrying up to five times.  If uninstallFailed is false a failed release is upgraded instead of
+// being deleted, so the context doesn't need to be able to delete anything
+func (ou *OpenUnisonDeployment) runChartInstall(client *action.Install, name string, chartReq *chart.Chart, cpValues map[string]interface{}, actionConfig *action.Configuration, uninstallFailed bool) (bool, error) {
+	postRenderer, renderer := ou.postRenderer(name, client.Namespace)
+	if postRenderer != nil {
+		client.PostRenderer = postRenderer
+	}
+
 	for i := 0; i <= 5; i++ {
 		_, err := client.Run(chartReq, cpValues)
 		if err != nil {
-			fmt.Printf("Error installing chart %s - %s, deleting and retrying\n", name, err.Error())
+			if !uninstallFailed {
+				if _, lastErr := actionConfig.Releases.Last(name); lastErr == nil {
+					fmt.Printf("Error installing chart %s - %s, upgrading the failed release\n", name, err.Error())
 
-			del := action.NewUninstall(actionConfig)
-			_, err := del.Run(name)
-			if err != nil {
-				return true, err
+					upgrade := action.NewUpgrade(actionConfig)
+					upgrade.Namespace = client.Namespace
+
+					return ou.runChartUpgrade(upgrade, name, chartReq, cpValues)
+				}
+
+				fmt.Printf("Error installing chart %s - %s, retrying\n", name, err.Error())
+			} else {
+				fmt.Printf("Error installing chart %s - %s, deleting and retrying\n", name, err.Error())
+
+				del := action.NewUninstall(actionConfig)
+				_, err := del.Run(name)
+				if err != nil {
+					return true, err
+				}
 			}
 			fmt.Println("Waiting a few seconds...")
 			time.Sleep(5 * time.Second)
-			fmt.Printf("Try #%i\n", i)
+			fmt.Printf("Try #%d\n", i)
 		} else {
+			if renderer != nil {
+				return false, ou.recordImageRelocation(name, renderer)
+			}
+
 			return false, nil
 		}
 	}
@@ -1202,6 +1591,11 @@ func (ou *OpenUnisonDeployment) runChartInstall(client *action.Install, name str
 }
 
 func (ou *OpenUnisonDeployment) runChartUpgrade(client *action.Upgrade, name string, chartReq *chart.Chart, cpValues map[string]interface{}) (bool, error) {
+	postRenderer, renderer := ou.postRenderer(name, client.Namespace)
+	if postRenderer != nil {
+		client.PostRenderer = postRenderer
+	}
+
 	for i := 0; i <= 5; i++ {
 		_, err := client.Run(name, chartReq, cpValues)
 		if err != nil {
@@ -1209,8 +1603,12 @@ func (ou *OpenUnisonDeployment) runChartUpgrade(client *action.Upgrade, name str
 
 			fmt.Println("Waiting a few seconds...")
 			time.Sleep(5 * time.Second)
-			fmt.Printf("Try #%i\n", i)
+			fmt.Printf("Try #%d\n", i)
 		} else {
+			if renderer != nil {
+				return false, ou.recordImageRelocation(name, renderer)
+			}
+
 			return false, nil
 		}
 	}
@@ -1224,8 +1622,8 @@ func (ou *OpenUnisonDeployment) setupSecret(helmValues map[string]interface{}) e
 		return nil
 	}
 
+	var current *v1.Secret
 	secret, err := ou.clientset.CoreV1().Secrets(ou.namespace).Get(context.TODO(), "orchestra-secrets-source", metav1.GetOptions{})
-	foundSecret := false
 	if err != nil {
 		secret = &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
@@ -1234,136 +1632,111 @@ func (ou *OpenUnisonDeployment) setupSecret(helmValues map[string]interface{}) e
 			},
 			Data: map[string][]byte{},
 		}
-
-		// generate the standard keys
-		secret.Data["unisonKeystorePassword"] = []byte(randSeq((64)))
-		secret.Data["K8S_DB_SECRET"] = []byte(randSeq((64)))
 	} else {
-		foundSecret = true
+		current = secret.DeepCopy()
 	}
 
-	hasSecret := ou.secretFile != "" || ou.secret != ""
+	// keys written to a SealedSecret or ExternalSecret by a previous run count as existing
+	existingKeys, err := ou.secretOutput.existingKeys(ou.satelateContextName, ou.namespace, "orchestra-secrets-source")
+	if err != nil {
+		return err
+	}
 
-	var authSecret []byte
+	for key := range secret.Data {
+		existingKeys[key] = true
+	}
 
-	if hasSecret {
-		if ou.secret != "" {
-			authSecret = []byte(ou.secret)
-		} else {
-			authSecret, err = ioutil.ReadFile(ou.secretFile)
+	generated := make([]string, 0)
+
+	if current == nil {
+		// generate the standard keys
+		for _, key := range []string{"unisonKeystorePassword", "K8S_DB_SECRET"} {
+			if existingKeys[key] {
+				continue
+			}
+
+			value, err := ou.secretPolicy.Generate()
 			if err != nil {
 				return err
 			}
 
-			authSecret = []byte(strings.TrimSpace(string(authSecret)))
+			secret.Data[key] = []byte(value)
+			existingKeys[key] = true
+			generated = append(generated, key)
 		}
-
 	}
 
-	authNeedsSecret := false
-	authSecretLabel := ""
-	foundAuth := false
-
-	_, ok := helmValues["oidc"]
-
-	if ok {
-		authNeedsSecret = true
-		foundAuth = true
-		authSecretLabel = "OIDC_CLIENT_SECRET"
-	} else {
-		_, ok = helmValues["github"]
+	// anything from the secrets file is added as is
+	for key, value := range ou.secretValues {
+		secret.Data[key] = value
+		existingKeys[key] = true
+	}
 
-		if ok {
-			foundAuth = true
-			authNeedsSecret = true
-			authSecretLabel = "GITHUB_SECRET_ID"
-		} else {
-			_, ok = helmValues["active_directory"]
+	required, err := requiredSecrets(helmValues)
+	if err != nil {
+		return err
+	}
 
-			if ok {
-				authNeedsSecret = true
-				foundAuth = true
-				authSecretLabel = "AD_BIND_PASSWORD"
-			} else {
-				_, ok = helmValues["saml"]
-				authNeedsSecret = false
-				foundAuth = true
+	// secrets from flags override the secrets file
+	flagSecrets := make(map[string]string)
 
-			}
+	if ou.secretFile != "" {
+		primaryKey := primaryAuthSecretKey(required)
+		if primaryKey == "" {
+			return fmt.Errorf("-s or --secrets-file-path was set, but no configured authentication needs a secret")
 		}
-	}
 
-	if !foundAuth {
-		return fmt.Errorf("No authentication found, one of active_directory, github, oidc, saml required")
+		flagSecrets[primaryKey] = ou.secretFile
 	}
 
-	_, ok = secret.Data[authSecretLabel]
-
-	if !ok {
-		// there's not already a secret
-		if authNeedsSecret && !hasSecret {
-			return fmt.Errorf("Authentication type requires a secret in a file specified in -s or --secrets-file-path")
-		}
+	if ou.pathToDbPassword != "" {
+		flagSecrets["OU_JDBC_PASSWORD"] = ou.pathToDbPassword
 	}
 
-	if authNeedsSecret && hasSecret {
-		secret.Data[authSecretLabel] = authSecret
+	if ou.pathToSmtpPassword != "" {
+		flagSecrets["SMTP_PASSWORD"] = ou.pathToSmtpPassword
 	}
 
-	openunison := helmValues["openunison"].(map[string]interface{})
-	enableNaaS := openunison["enable_provisioning"].(bool)
+	for key, ref := range flagSecrets {
+		value, err := readSecret(ref)
+		if err != nil {
+			return err
+		}
 
-	if enableNaaS {
-		//check for the database password
-		_, hasJdbcPassword := secret.Data["OU_JDBC_PASSWORD"]
-		if ou.pathToDbPassword != "" {
-			dbSecret, err := ioutil.ReadFile(ou.pathToDbPassword)
-			if err != nil {
-				return err
-			}
+		fmt.Printf("Setting %s\n", key)
+		secret.Data[key] = value
+		existingKeys[key] = true
+	}
 
-			dbSecret = []byte(strings.TrimSpace(string(dbSecret)))
+	// the satelite's client secret from the control plane
+	if ou.secret != "" {
+		secret.Data["OIDC_CLIENT_SECRET"] = []byte(ou.secret)
+		existingKeys["OIDC_CLIENT_SECRET"] = true
+		generated = append(generated, "OIDC_CLIENT_SECRET")
+	}
 
-			fmt.Println("Setting database password\n")
+	missing := make([]string, 0)
 
-			secret.Data["OU_JDBC_PASSWORD"] = dbSecret
-		} else if !hasJdbcPassword {
-			return fmt.Errorf("if openunison.enable_provisioning is true, -b or --database-secret-path must be set")
+	for _, requirement := range required {
+		if requirement.Key == "" || existingKeys[requirement.Key] {
+			continue
 		}
 
-		// check for SMTP
-		_, hasSmtpPassword := secret.Data["SMTP_PASSWORD"]
-		if ou.pathToSmtpPassword != "" {
-			smtpSecret, err := ioutil.ReadFile(ou.pathToSmtpPassword)
-			if err != nil {
-				return err
-			}
-
-			smtpSecret = []byte(strings.TrimSpace(string(smtpSecret)))
-
-			fmt.Println("Setting SMTP password")
-			secret.Data["SMTP_PASSWORD"] = smtpSecret
-		} else if !hasSmtpPassword {
-			return fmt.Errorf("if openunison.enable_provisioning is true, -t or --smtp-secret-path must be set")
+		message := fmt.Sprintf("%s for %s", requirement.Key, requirement.Section)
+		if requirement.Flag != "" {
+			message = message + " (" + requirement.Flag + ")"
+		} else if requirement.Key == primaryAuthSecretKey(required) {
+			message = message + " (-s or --secrets-file-path)"
 		}
-	}
 
-	if !foundSecret {
-		fmt.Printf("Creating secret\n")
-		secret, err = ou.clientset.CoreV1().Secrets(ou.namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
-		if err != nil {
-			return err
-		}
-	} else {
-		fmt.Printf("Updating secret\n")
-		secret, err = ou.clientset.CoreV1().Secrets(ou.namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
-		if err != nil {
-			return err
-		}
+		missing = append(missing, message)
 	}
 
-	return nil
+	if len(missing) > 0 {
+		return fmt.Errorf("missing secrets, set them with --secrets, --secret KEY=source or the listed flag: %s", strings.Join(missing, ", "))
+	}
 
+	return ou.saveSecret(ou.satelateContextName, secret, current, generated)
 }
 
 // deploys all extra charts
@@ -1439,7 +1812,7 @@ func (ou *OpenUnisonDeployment) deployChart(chart HelmChartInfo) error {
 		}
 
 		//_, err = client.Run(chartReq, ou.helmValues)
-		_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, ou.helmValues, actionConfig)
+		_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, ou.helmValues, actionConfig, true)
 
 		if err != nil {
 			return err
@@ -1475,12 +1848,42 @@ func (ou *OpenUnisonDeployment) deployChart(chart HelmChartInfo) error {
 // specifies chart version
 
 func (ou *OpenUnisonDeployment) locateChart(configChartName string, chartPathOptions *action.ChartPathOptions, settings *cli.EnvSettings) (*chart.Chart, error) {
-	chartName := configChartName
-	chartVersion := ""
-	if strings.Contains(configChartName, "@") {
-		chartName = configChartName[0:strings.Index(configChartName, "@")]
-		chartVersion = configChartName[strings.Index(configChartName, "@")+1:]
+	chartReq, _, err := ou.locateLockedChart(configChartName, chartPathOptions, settings)
+	return chartReq, err
+}
+
+// locates a chart, returning where it was resolved from
+func (ou *OpenUnisonDeployment) locateLockedChart(configChartName string, chartPathOptions *action.ChartPathOptions, settings *cli.EnvSettings) (*chart.Chart, LockedChart, error) {
+	configChartName, err := ou.lockedChartRef(configChartName)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
 
+	var chartReq *chart.Chart
+	var resolved LockedChart
+
+	if ou.bundle != nil {
+		chartReq, resolved, err = ou.bundle.loadChart(configChartName)
+	} else {
+		chartReq, resolved, err = ou.resolveChart(configChartName, chartPathOptions, settings)
+	}
+
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	err = ou.checkLock(resolved)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	return chartReq, resolved, nil
+}
+
+// locates a chart in its repository, returning it with its resolved version and digest
+func (ou *OpenUnisonDeployment) resolveChart(configChartName string, chartPathOptions *action.ChartPathOptions, settings *cli.EnvSettings) (*chart.Chart, LockedChart, error) {
+	chartName, chartVersion := splitChartVersion(configChartName)
+	if chartVersion != "" {
 		fmt.Printf("Chart version specified for %s: %s\n", chartName, chartVersion)
 
 		chartPathOptions.Version = chartVersion
@@ -1489,111 +1892,247 @@ func (ou *OpenUnisonDeployment) locateChart(configChartName string, chartPathOpt
 		fmt.Printf("No chart version specified for %s\n", chartName)
 	}
 
+	switch {
+	case strings.HasPrefix(chartName, "file://"):
+		return ou.resolveLocalChart(chartName, chartVersion, chartPathOptions, settings)
+	case strings.HasPrefix(chartName, "https://") || strings.HasPrefix(chartName, "http://"):
+		return ou.resolveURLChart(chartName, chartVersion, settings)
+	case strings.HasPrefix(chartName, "git+"):
+		return ou.resolveGitChart(chartName, chartVersion)
+	}
+
 	// Check if the chart is using OCI
 	if strings.HasPrefix(chartName, "oci://") {
 		fmt.Printf("OCI chart detected: %s\n", chartName)
 
-		var ociClient *registry.Client
+		return ou.resolveOCIChart(chartName, chartVersion, settings)
+	}
+
+	// the chart's provenance file is verified against the keyring when it's located
+	if ou.chartVerification.Verify {
+		chartPathOptions.Verify = true
+		chartPathOptions.Keyring = ou.chartVerification.Keyring
+	}
 
-		if ou.ociCaCertPath != "" {
+	err := ou.ensureRepository(chartName, settings)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
 
-			// there's a ca cert
-			var err error
-			caCert, err := os.ReadFile(ou.ociCaCertPath)
-			if err != nil {
-				panic(err)
-			}
+	err = ou.repositoryOptions.apply(chartPathOptions)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
 
-			caPool := x509.NewCertPool()
-			if ok := caPool.AppendCertsFromPEM(caCert); !ok {
-				panic("failed to append CA cert")
-			}
+	cp, err := chartPathOptions.LocateChart(chartName, settings)
 
-			tlsConfig := &tls.Config{
-				RootCAs: caPool,
-			}
+	if err != nil && chartVersion != "" && isRepositoryChart(chartName) {
+		// the version may have been released since the index was downloaded
+		repoName, _, _ := strings.Cut(chartName, "/")
+		fmt.Printf("Could not locate %s version %s, refreshing the index of helm repository %s\n", chartName, chartVersion, repoName)
 
-			httpClient := &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: tlsConfig,
-				},
-			}
+		err = ou.updateRepository(repoName, settings)
+		if err != nil {
+			return nil, LockedChart{}, err
+		}
 
-			ociClient, err = registry.NewClient(
-				registry.ClientOptEnableCache(true),
-				registry.ClientOptDebug(true),
-				registry.ClientOptHTTPClient(httpClient),
-			)
+		cp, err = chartPathOptions.LocateChart(chartName, settings)
+	}
 
-			if err != nil {
-				return nil, fmt.Errorf("failed to initialize OCI client: %v", err)
-			}
-		} else {
-			var err error
-			ociClient, err = registry.NewClient(
-				registry.ClientOptEnableCache(true),
-				registry.ClientOptDebug(true),
-			)
-			if err != nil {
-				return nil, fmt.Errorf("failed to initialize OCI client: %v", err)
-			}
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	chartReq, err := loader.Load(cp)
+
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
+
+	resolved := LockedChart{
+		Name:       chartName,
+		Chart:      chartReq.Metadata.Name,
+		Version:    chartReq.Metadata.Version,
+		Repository: chartRepositoryURL(chartName, settings),
+	}
+
+	// charts in local directories don't have a digest
+	if info, err := os.Stat(cp); err == nil && !info.IsDir() {
+		resolved.Digest, err = fileDigest(cp)
+		if err != nil {
+			return nil, LockedChart{}, err
 		}
+	}
+
+	return chartReq, resolved, nil
 
-		// Step 1: Initialize OCI client
+}
+
+// resolves an OCI chart's version to a manifest digest and loads the chart by that digest, verifying the manifest's
+// signature first when required.  The archive, whether it's pulled or from the chart cache, must match the manifest's
+// chart layer so the chart that's installed is the one that was verified
+func (ou *OpenUnisonDeployment) resolveOCIChart(chartName string, chartVersion string, settings *cli.EnvSettings) (*chart.Chart, LockedChart, error) {
+	ociClient, err := ou.registryOptions.newClient(settings)
+	if err != nil {
+		return nil, LockedChart{}, err
+	}
 
-		// Step 2: Create a temporary directory
-		tempDir, err := os.MkdirTemp("", "helm-oci-*")
+	repository := strings.TrimPrefix(chartName, "oci://")
+
+	// an exact version is used as the tag, otherwise the newest tag matching the constraint
+	tag := chartVersion
+	if _, err := semver.NewVersion(chartVersion); chartVersion == "" || err != nil {
+		tags, err := ociClient.Tags(repository)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+			return nil, LockedChart{}, fmt.Errorf("failed to list the versions of OCI chart %s: %v", chartName, err)
 		}
-		fmt.Printf("Temporary directory created: %s\n", tempDir)
 
-		debugLog := func(format string, v ...interface{}) {
-			fmt.Printf(format+"\n", v...)
+		tag, err = registry.GetTagMatchingVersionOrConstraint(tags, chartVersion)
+		if err != nil {
+			return nil, LockedChart{}, fmt.Errorf("OCI chart %s: %v", chartName, err)
 		}
+	}
+
+	// OCI tags can't contain '+'
+	manifest, err := ociClient.Resolve(repository + ":" + strings.ReplaceAll(tag, "+", "_"))
+	if err != nil {
+		return nil, LockedChart{}, fmt.Errorf("failed to resolve the manifest of OCI chart %s version %s: %v", chartName, tag, err)
+	}
+
+	if manifest == nil {
+		return nil, LockedChart{}, fmt.Errorf("OCI chart %s has no registry", chartName)
+	}
 
-		actionConfig := new(action.Configuration)
-		if err := actionConfig.Init(settings.RESTClientGetter(), "", os.Getenv("HELM_DRIVER"), debugLog); err != nil {
-			return nil, fmt.Errorf("failed to initialize Helm action configuration: %v", err)
+	manifestDigest := manifest.Digest.String()
+	fmt.Printf("OCI chart %s version %s is %s\n", chartName, tag, manifestDigest)
+
+	if ou.chartVerification.Verify {
+		err = ou.verifyCosignSignature(chartName, manifestDigest, settings)
+		if err != nil {
+			return nil, LockedChart{}, err
 		}
+	}
+
+	// everything else is read by digest, so a tag that's moved since it was resolved can't change what's loaded
+	pinnedRef := repository + "@" + manifestDigest
 
-		actionConfig.RegistryClient = ociClient
+	var data []byte
+	var layerDigest string
 
-		// Step 3: Pull the chart from the OCI registry
-		pull := action.NewPullWithOpts(action.WithConfig(actionConfig))
-		pull.DestDir = tempDir
-		pull.Version = chartVersion
-		pull.Settings = &cli.EnvSettings{}
+	cachedPath := ""
+	if ou.registryOptions.CacheDir != "" {
+		// the cache is laid out by registry and repository so charts with the same name from different places don't
+		// collide, a registry's port is kept without the ':'
+		cachedPath = filepath.Join(ou.registryOptions.CacheDir, filepath.FromSlash(strings.ReplaceAll(repository, ":", "_")), filepath.Base(chartName)+"-"+tag+".tgz")
 
-		_, err = pull.Run(chartName)
+		if cached, err := os.ReadFile(cachedPath); err == nil {
+			// helm won't pull without a layer, the provenance layer is small and allowed to be missing
+			pulled, err := ociClient.Pull(pinnedRef, registry.PullOptWithChart(false), registry.PullOptWithProv(true), registry.PullOptIgnoreMissingProv(true))
+			if err != nil {
+				return nil, LockedChart{}, fmt.Errorf("failed to pull the manifest of OCI chart %s: %v", chartName, err)
+			}
+
+			layerDigest, err = chartLayerDigest(pulled.Manifest.Data)
+			if err != nil {
+				return nil, LockedChart{}, fmt.Errorf("OCI chart %s: %v", chartName, err)
+			}
+
+			if dataDigest(cached) == layerDigest {
+				fmt.Printf("Using cached chart %s\n", cachedPath)
+				data = cached
+			} else {
+				fmt.Printf("Cached chart %s doesn't match %s, pulling it again\n", cachedPath, manifestDigest)
+			}
+		}
+	}
+
+	if data == nil {
+		pulled, err := ociClient.Pull(pinnedRef)
 		if err != nil {
-			return nil, fmt.Errorf("failed to pull OCI chart %s: %v", chartName, err)
+			return nil, LockedChart{}, fmt.Errorf("failed to pull OCI chart %s: %v", chartName, err)
 		}
 
-		// Step 4: Load the chart from the temporary directory
-		chartFilePath := filepath.Join(tempDir, filepath.Base(chartName)+"-"+chartVersion+".tgz")
-		chartReq, err := loader.Load(chartFilePath)
+		layerDigest, err = chartLayerDigest(pulled.Manifest.Data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load OCI chart from %s: %v", chartFilePath, err)
+			return nil, LockedChart{}, fmt.Errorf("OCI chart %s: %v", chartName, err)
 		}
 
-		return chartReq, nil
+		data = pulled.Chart.Data
+
+		if cachedPath != "" {
+			err = writeCachedChart(cachedPath, data)
+			if err != nil {
+				return nil, LockedChart{}, err
+			}
+		}
 	}
 
-	cp, err := chartPathOptions.LocateChart(chartName, settings)
+	digest := dataDigest(data)
+	if digest != layerDigest {
+		return nil, LockedChart{}, fmt.Errorf("OCI chart %s has digest %s, but its manifest %s has chart layer %s", chartName, digest, manifestDigest, layerDigest)
+	}
 
+	chartReq, err := loader.LoadArchive(bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, LockedChart{}, fmt.Errorf("failed to load OCI chart %s: %v", chartName, err)
 	}
 
-	chartReq, err := loader.Load(cp)
+	return chartReq, LockedChart{
+		Name:           chartName,
+		Chart:          chartReq.Metadata.Name,
+		Version:        chartReq.Metadata.Version,
+		Repository:     chartName[0:strings.LastIndex(chartName, "/")],
+		Digest:         digest,
+		ManifestDigest: manifestDigest,
+	}, nil
+}
 
+// writes a chart into the cache with a rename, so a pull that's interrupted or runs at the same time never leaves a
+// partial archive behind
+func writeCachedChart(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
 
-	return chartReq, nil
+// the digest of the chart archive in an OCI manifest
+func chartLayerDigest(manifestData []byte) (string, error) {
+	var manifest ocispec.Manifest
+	err := json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the manifest: %v", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == registry.ChartLayerMediaType || layer.MediaType == registry.LegacyChartLayerMediaType {
+			return layer.Digest.String(), nil
+		}
+	}
 
+	return "", fmt.Errorf("the manifest has no chart layer")
 }
 
 // deploys OpenUnison into the cluster
@@ -1694,7 +2233,7 @@ func (ou *OpenUnisonDeployment) DeployAuthPortal() error {
 			}
 
 			//_, err = client.Run(chartReq, vals)
-			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, ou.helmValues, actionConfig)
+			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, ou.helmValues, actionConfig, true)
 
 			if err != nil {
 				return err
@@ -1711,6 +2250,12 @@ func (ou *OpenUnisonDeployment) DeployAuthPortal() error {
 				return err
 			}
 
+			err = ou.upgradeCRDs(chartReq)
+
+			if err != nil {
+				return err
+			}
+
 			_, err = ou.runChartUpgrade(client, "openunison", chartReq, ou.helmValues)
 
 			if err != nil {
@@ -1768,7 +2313,7 @@ func (ou *OpenUnisonDeployment) DeployAuthPortal() error {
 			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
 
 			//_, deployErr = client.Run(chartReq, mergedValues)
-			_, deployErr = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig)
+			_, deployErr = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig, true)
 
 		} else {
 			// deploy orchestra, make sure that it deploys
@@ -1817,8 +2362,6 @@ func (ou *OpenUnisonDeployment) DeployAuthPortal() error {
 			} else {
 				return deployErr
 			}
-
-			return err
 		}
 
 		// wait until the orchestra container is running
@@ -1857,7 +2400,7 @@ func (ou *OpenUnisonDeployment) DeployAuthPortal() error {
 			mergedValues := mergeMaps(chartReq.Values, ou.helmValues)
 
 			//_, err = client.Run(chartReq, mergedValues)
-			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig)
+			_, err = ou.runChartInstall(client, client.ReleaseName, chartReq, mergedValues, actionConfig, true)
 
 			if err != nil {
 				return err
@@ -0,0 +1,703 @@
+package openunison
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// releases are written as Argo CD Applications
+	GitOpsFormatArgoCD = "argocd"
+	// releases are written as Flux HelmReleases
+	GitOpsFormatFlux = "flux"
+
+	// values are added to each release
+	GitOpsValuesInline = "inline"
+	// values are stored in a ConfigMap referenced by each release, only supported by Flux
+	GitOpsValuesConfigMap = "configmap"
+)
+
+// configures how releases are exported
+type GitOpsOptions struct {
+	Format     string
+	OutputDir  string
+	ValuesMode string
+
+	ArgoCDNamespace   string
+	ArgoCDProject     string
+	DestinationServer string
+
+	FluxNamespace string
+}
+
+// a helm release ouctl would install, with its chart pinned to the version that was located
+type plannedRelease struct {
+	Name      string
+	Namespace string
+
+	// the repository url, without oci:// for OCI repositories
+	RepoURL string
+	// the name of the repository in helm's repositories.yaml, empty for OCI and git
+	RepoName string
+	OCI      bool
+
+	// charts from git are pinned to the commit they were checked out from, with the chart's directory as Path
+	Git    bool
+	Path   string
+	Commit string
+
+	Chart   string
+	Version string
+
+	Values map[string]interface{}
+}
+
+// a file of manifests to write
+type gitOpsFile struct {
+	Name    string
+	Objects []interface{}
+}
+
+// characters that can't be in a Kubernetes object name
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// checks the options are valid
+func (options GitOpsOptions) Validate() error {
+	switch options.Format {
+	case GitOpsFormatArgoCD, GitOpsFormatFlux:
+	default:
+		return fmt.Errorf("unknown format %s, must be one of %s or %s", options.Format, GitOpsFormatArgoCD, GitOpsFormatFlux)
+	}
+
+	switch options.ValuesMode {
+	case GitOpsValuesInline:
+	case GitOpsValuesConfigMap:
+		if options.Format == GitOpsFormatArgoCD {
+			return fmt.Errorf("Argo CD can't load values from a ConfigMap, use --values-mode %s", GitOpsValuesInline)
+		}
+	default:
+		return fmt.Errorf("unknown values mode %s, must be one of %s or %s", options.ValuesMode, GitOpsValuesInline, GitOpsValuesConfigMap)
+	}
+
+	return nil
+}
+
+// writes the releases DeployAuthPortal or DeployNaaSPortal would install as Argo CD Applications or Flux HelmReleases
+func (ou *OpenUnisonDeployment) ExportGitOps(options GitOpsOptions) error {
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
+
+	if ou.secretOutput.IsApi() {
+		fmt.Println("orchestra-secrets-source isn't exported, use --secret-output sealedsecret or externalsecret to include it")
+	} else {
+		err = ou.setupSecret(ou.helmValues)
+		if err != nil {
+			return err
+		}
+	}
+
+	releases, err := ou.planReleases()
+	if err != nil {
+		return err
+	}
+
+	files, err := options.manifests(releases, ou.namespaceLabels)
+	if err != nil {
+		return err
+	}
+
+	return options.write(files)
+}
+
+// locates every chart ouctl would deploy, in the order it deploys them, with the values each is installed with
+func (ou *OpenUnisonDeployment) planReleases() ([]plannedRelease, error) {
+	settings := cli.New()
+	releases := make([]plannedRelease, 0)
+
+	var clusterManagementChart *chart.Chart
+	var err error
+
+	deployClusterManagement := ou.IsNaas() && !ou.skipClusterManagement && !ou.skipCharts["cluster-management"]
+
+	if ou.IsNaas() {
+		err = ou.validateNaaSValues()
+		if err != nil {
+			return nil, err
+		}
+
+		clusterManagementChart, err = ou.locateChart(ou.clusterManagementChart, &action.ChartPathOptions{}, settings)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ou.setNaaSAzGroups(clusterManagementChart)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// pre and additional charts are deployed with the values as is, the OpenUnison charts with values merged
+	// into the chart's defaults
+	plan := func(name string, chartRef string, merge bool) error {
+		if ou.skipCharts[name] {
+			fmt.Printf("Chart %s skipped\n", name)
+			return nil
+		}
+
+		release, err := ou.planRelease(name, chartRef, ou.helmValues, merge, settings)
+		if err != nil {
+			return err
+		}
+
+		releases = append(releases, release)
+		return nil
+	}
+
+	for _, preChart := range ou.preCharts {
+		err = plan(preChart.Name, preChart.ChartPath, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, release := range []struct {
+		name     string
+		chartRef string
+		merge    bool
+	}{
+		{"openunison", ou.operator.chart, false},
+		{"orchestra", ou.orchestraChart, true},
+		{"orchestra-login-portal", ou.orchestraLoginPortalChart, true},
+	} {
+		err = plan(release.name, release.chartRef, release.merge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if deployClusterManagement {
+		err = plan("cluster-management", ou.clusterManagementChart, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, additionalChart := range ou.additionalCharts {
+		err = plan(additionalChart.Name, additionalChart.ChartPath, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return releases, nil
+}
+
+// locates a chart and works out where it's from so the release can be pinned to the same version, if merge is true
+// the values are merged into the chart's defaults.  Argo CD and Flux can't read charts from ouctl's file system or
+// from an archive's url, so only charts from helm repositories, OCI registries and git can be exported
+func (ou *OpenUnisonDeployment) planRelease(name string, chartRef string, values map[string]interface{}, merge bool, settings *cli.EnvSettings) (plannedRelease, error) {
+	release := plannedRelease{Name: name, Namespace: ou.namespace}
+
+	chartName, _ := splitChartVersion(chartRef)
+
+	switch {
+	case strings.HasPrefix(chartName, "file://"):
+		return release, fmt.Errorf("chart %s for %s is a local chart and can't be exported, push it to a helm repository, an OCI registry or git and reference it from there", chartName, name)
+	case strings.HasPrefix(chartName, "https://") || strings.HasPrefix(chartName, "http://"):
+		return release, fmt.Errorf("chart %s for %s is an archive's url and can't be exported, reference it from its helm repository, an OCI registry or git", chartName, name)
+	}
+
+	chartReq, resolved, err := ou.locateLockedChart(chartRef, &action.ChartPathOptions{}, settings)
+	if err != nil {
+		return release, err
+	}
+
+	release.Version = chartReq.Metadata.Version
+
+	if strings.HasPrefix(chartName, "git+") {
+		repoURL, path, ref, err := parseGitChartRef(chartName)
+		if err != nil {
+			return release, err
+		}
+
+		release.Git = true
+		release.RepoURL = repoURL
+		release.Path = path
+		release.Chart = chartReq.Metadata.Name
+
+		// the commit the chart was checked out from, so a branch that moves doesn't change the release
+		release.Commit = resolved.Commit
+		if release.Commit == "" {
+			release.Commit = ref
+		}
+
+		if release.Commit == "" {
+			return release, fmt.Errorf("chart %s for %s wasn't checked out from a commit and can't be exported", chartName, name)
+		}
+	} else if strings.HasPrefix(chartName, "oci://") {
+		release.OCI = true
+		release.RepoURL = strings.TrimPrefix(chartName[0:strings.LastIndex(chartName, "/")], "oci://")
+		release.Chart = chartName[strings.LastIndex(chartName, "/")+1:]
+	} else {
+		repoName, repoChart, found := strings.Cut(chartName, "/")
+		if !found {
+			return release, fmt.Errorf("chart %s for %s isn't from a repository and can't be exported", chartName, name)
+		}
+
+		repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+		if err != nil {
+			return release, fmt.Errorf("could not load helm repositories from %s: %v", settings.RepositoryConfig, err)
+		}
+
+		entry := repoFile.Get(repoName)
+		if entry == nil {
+			return release, fmt.Errorf("chart %s for %s isn't from a repository and can't be exported", chartName, name)
+		}
+
+		release.RepoName = repoName
+		release.RepoURL = entry.URL
+		release.Chart = repoChart
+	}
+
+	if merge {
+		release.Values = mergeMaps(chartReq.Values, values)
+	} else {
+		release.Values = mergeMaps(map[string]interface{}{}, values)
+	}
+
+	if release.Git {
+		fmt.Printf("Exporting %s from %s, chart %s version %s at %s\n", name, release.RepoURL, release.Chart, release.Version, release.Commit)
+	} else {
+		fmt.Printf("Exporting %s from %s, chart %s version %s\n", name, release.RepoURL, release.Chart, release.Version)
+	}
+
+	return release, nil
+}
+
+// splits a chart reference into its name and the version after the last '@', if there is one.  An '@' followed by
+// a '/' is part of the name, such as the user in git+ssh://git@github.com/org/charts//orchestra
+func splitChartVersion(chartRef string) (string, string) {
+	i := strings.LastIndex(chartRef, "@")
+	if i < 0 || strings.Contains(chartRef[i+1:], "/") {
+		return chartRef, ""
+	}
+
+	return chartRef[0:i], chartRef[i+1:]
+}
+
+// builds the manifests for the releases in the configured format
+func (options GitOpsOptions) manifests(releases []plannedRelease, namespaceLabels map[string]string) ([]gitOpsFile, error) {
+	if options.Format == GitOpsFormatArgoCD {
+		return options.argoCDManifests(releases, namespaceLabels), nil
+	}
+
+	return options.fluxManifests(releases)
+}
+
+// one Application per release, sync waves keep ouctl's order when the Applications are synced by a parent Application.
+// Charts from git are read from their directory at the commit they were located at
+func (options GitOpsOptions) argoCDManifests(releases []plannedRelease, namespaceLabels map[string]string) []gitOpsFile {
+	files := make([]gitOpsFile, 0)
+
+	syncOptions := []interface{}{"CreateNamespace=true"}
+
+	for i, release := range releases {
+		syncPolicy := map[string]interface{}{
+			"syncOptions": syncOptions,
+		}
+
+		if len(namespaceLabels) > 0 {
+			labels := make(map[string]interface{})
+			for name, value := range namespaceLabels {
+				labels[name] = value
+			}
+
+			syncPolicy["managedNamespaceMetadata"] = map[string]interface{}{
+				"labels": labels,
+			}
+		}
+
+		source := map[string]interface{}{
+			"repoURL":        release.RepoURL,
+			"chart":          release.Chart,
+			"targetRevision": release.Version,
+			"helm": map[string]interface{}{
+				"releaseName":  release.Name,
+				"valuesObject": release.Values,
+			},
+		}
+
+		if release.Git {
+			delete(source, "chart")
+			source["path"] = release.Path
+			source["targetRevision"] = release.Commit
+		}
+
+		application := map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Application",
+			"metadata": map[string]interface{}{
+				"name":      release.Name,
+				"namespace": options.ArgoCDNamespace,
+				"annotations": map[string]interface{}{
+					"argocd.argoproj.io/sync-wave": strconv.Itoa(i),
+				},
+			},
+			"spec": map[string]interface{}{
+				"project": options.ArgoCDProject,
+				"source":  source,
+				"destination": map[string]interface{}{
+					"server":    options.DestinationServer,
+					"namespace": release.Namespace,
+				},
+				"syncPolicy": syncPolicy,
+			},
+		}
+
+		files = append(files, gitOpsFile{
+			Name:    fmt.Sprintf("%02d-%s.yaml", i, release.Name),
+			Objects: []interface{}{application},
+		})
+	}
+
+	return files
+}
+
+// the key of the source a Flux HelmRelease's chart comes from
+func fluxSourceKey(release plannedRelease) string {
+	if release.Git {
+		return release.RepoURL + "@" + release.Commit
+	}
+
+	if release.OCI {
+		return "oci://" + release.RepoURL
+	}
+
+	return release.RepoURL
+}
+
+// a HelmRepository for each repository, a GitRepository for each git repository and commit and a HelmRelease per
+// release, each release depends on the one before it
+func (options GitOpsOptions) fluxManifests(releases []plannedRelease) ([]gitOpsFile, error) {
+	files := make([]gitOpsFile, 0)
+
+	repositories := make([]interface{}, 0)
+	gitRepositories := make([]interface{}, 0)
+	repositoryNames := make(map[string]string)
+
+	for _, release := range releases {
+		url := fluxSourceKey(release)
+
+		if _, found := repositoryNames[url]; found {
+			continue
+		}
+
+		if release.Git {
+			name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(release.RepoURL), "-"), "-")
+			if len(name) > 40 {
+				name = strings.Trim(name[len(name)-40:], "-")
+			}
+
+			commit := release.Commit
+			if len(commit) > 12 {
+				commit = commit[0:12]
+			}
+
+			name = name + "-" + strings.ToLower(commit)
+			repositoryNames[url] = name
+
+			gitRepositories = append(gitRepositories, map[string]interface{}{
+				"apiVersion": "source.toolkit.fluxcd.io/v1",
+				"kind":       "GitRepository",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": options.FluxNamespace,
+				},
+				"spec": map[string]interface{}{
+					"interval": "1h",
+					"url":      release.RepoURL,
+					"ref": map[string]interface{}{
+						"commit": release.Commit,
+					},
+				},
+			})
+
+			continue
+		}
+
+		name := release.RepoName
+		if name == "" {
+			name = strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(release.RepoURL), "-"), "-")
+		}
+
+		repositoryNames[url] = name
+
+		spec := map[string]interface{}{
+			"interval": "1h",
+			"url":      url,
+		}
+
+		if release.OCI {
+			spec["type"] = "oci"
+		}
+
+		repositories = append(repositories, map[string]interface{}{
+			"apiVersion": "source.toolkit.fluxcd.io/v1",
+			"kind":       "HelmRepository",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": options.FluxNamespace,
+			},
+			"spec": spec,
+		})
+	}
+
+	if len(repositories) > 0 {
+		files = append(files, gitOpsFile{Name: "helm-repositories.yaml", Objects: repositories})
+	}
+
+	if len(gitRepositories) > 0 {
+		files = append(files, gitOpsFile{Name: "git-repositories.yaml", Objects: gitRepositories})
+	}
+
+	for i, release := range releases {
+		url := fluxSourceKey(release)
+
+		objects := make([]interface{}, 0)
+
+		chartSpec := map[string]interface{}{
+			"chart":   release.Chart,
+			"version": release.Version,
+			"sourceRef": map[string]interface{}{
+				"kind":      "HelmRepository",
+				"name":      repositoryNames[url],
+				"namespace": options.FluxNamespace,
+			},
+		}
+
+		// the version of a chart from git is whatever's in its Chart.yaml at the commit
+		if release.Git {
+			chartSpec = map[string]interface{}{
+				"chart":             "./" + release.Path,
+				"reconcileStrategy": "Revision",
+				"sourceRef": map[string]interface{}{
+					"kind":      "GitRepository",
+					"name":      repositoryNames[url],
+					"namespace": options.FluxNamespace,
+				},
+			}
+		}
+
+		spec := map[string]interface{}{
+			"interval":    "10m",
+			"releaseName": release.Name,
+			// releases installed by ouctl are stored in the openunison namespace, so they're adopted rather than reinstalled
+			"targetNamespace":  release.Namespace,
+			"storageNamespace": release.Namespace,
+			"install": map[string]interface{}{
+				"createNamespace": true,
+			},
+			"chart": map[string]interface{}{
+				"spec": chartSpec,
+			},
+		}
+
+		if i > 0 {
+			spec["dependsOn"] = []interface{}{
+				map[string]interface{}{
+					"name": releases[i-1].Name,
+				},
+			}
+		}
+
+		if options.ValuesMode == GitOpsValuesConfigMap {
+			configMapName := release.Name + "-values"
+
+			values, err := marshalManifest(release.Values)
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      configMapName,
+					"namespace": options.FluxNamespace,
+				},
+				"data": map[string]interface{}{
+					"values.yaml": string(values),
+				},
+			})
+
+			spec["valuesFrom"] = []interface{}{
+				map[string]interface{}{
+					"kind":      "ConfigMap",
+					"name":      configMapName,
+					"valuesKey": "values.yaml",
+				},
+			}
+		} else {
+			spec["values"] = release.Values
+		}
+
+		objects = append(objects, map[string]interface{}{
+			"apiVersion": "helm.toolkit.fluxcd.io/v2",
+			"kind":       "HelmRelease",
+			"metadata": map[string]interface{}{
+				"name":      release.Name,
+				"namespace": options.FluxNamespace,
+			},
+			"spec": spec,
+		})
+
+		files = append(files, gitOpsFile{
+			Name:    fmt.Sprintf("%02d-%s.yaml", i, release.Name),
+			Objects: objects,
+		})
+	}
+
+	return files, nil
+}
+
+// writes each file to the output directory
+func (options GitOpsOptions) write(files []gitOpsFile) error {
+	err := os.MkdirAll(options.OutputDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data := make([]byte, 0)
+
+		for i, object := range file.Objects {
+			objectData, err := marshalManifest(object)
+			if err != nil {
+				return err
+			}
+
+			if i > 0 {
+				data = append(data, []byte("---\n")...)
+			}
+
+			data = append(data, objectData...)
+		}
+
+		path := filepath.Join(options.OutputDir, file.Name)
+		fmt.Printf("Writing %s\n", path)
+
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writes a bundle for the control plane and one for the satelite, each in a directory named for its context.  The
+// control plane's bundle has the add-cluster release and the Secret with the satelite's client secret, the
+// satelite's bundle has its releases and orchestra-secrets-source.  Secrets are written with the secret output, so
+// the clusters are only read from.
+func (ou *OpenUnisonDeployment) ExportSateliteGitOps(options GitOpsOptions) error {
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
+
+	if ou.secretOutput.IsApi() {
+		return fmt.Errorf("--secret-output must be %s or %s when exporting a satelite", SecretOutputSealedSecret, SecretOutputExternalSecret)
+	}
+
+	controlPlaneDir := filepath.Join(options.OutputDir, ou.controlPlaneContextName)
+	sateliteDir := filepath.Join(options.OutputDir, ou.satelateContextName)
+
+	originalContextName, err := ou.setControlPlaneContext()
+	if err != nil {
+		return err
+	}
+
+	// leave the kubeconfig the way we found it
+	defer ou.setCurrentContext(originalContextName)
+
+	err = ou.loadKubernetesConfiguration()
+	if err != nil {
+		return err
+	}
+
+	secretOutputDir := ou.secretOutput.OutputDir
+	defer func() { ou.secretOutput.OutputDir = secretOutputDir }()
+
+	ou.secretOutput.OutputDir = controlPlaneDir
+
+	integration, err := ou.prepareSatelite()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exporting the satelite to %s\n", sateliteDir)
+
+	_, err = ou.setCurrentContext(ou.satelateContextName)
+	if err != nil {
+		return err
+	}
+
+	err = ou.loadKubernetesConfiguration()
+	if err != nil {
+		return err
+	}
+
+	ou.secretOutput.OutputDir = sateliteDir
+
+	sateliteOptions := options
+	sateliteOptions.OutputDir = sateliteDir
+
+	err = ou.ExportGitOps(sateliteOptions)
+	if err != nil {
+		return err
+	}
+
+	if ou.skipCpIntegration {
+		return nil
+	}
+
+	fmt.Printf("Exporting the control plane integration to %s\n", controlPlaneDir)
+
+	var management map[string]interface{}
+	if integration.naasEnabled && integration.managementEnabled {
+		management = ou.sateliteManagement(integration)
+	}
+
+	cpValues, err := ou.sateliteIntegrationValues(ou.helmValues, integration.clusterName, management, integration.naasExternalSuffix, integration.externalNaasGroupName, integration.naasRoles)
+	if err != nil {
+		return err
+	}
+
+	release, err := ou.planRelease(integration.releaseName, ou.addClusterChart, cpValues, false, integration.settings)
+	if err != nil {
+		return err
+	}
+
+	release.Namespace = ou.cpNamespace
+
+	controlPlaneOptions := options
+	controlPlaneOptions.OutputDir = controlPlaneDir
+
+	files, err := controlPlaneOptions.manifests([]plannedRelease{release}, nil)
+	if err != nil {
+		return err
+	}
+
+	return controlPlaneOptions.write(files)
+}
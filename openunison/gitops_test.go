@@ -0,0 +1,184 @@
+package openunison
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+func TestPlanReleaseFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	bare := filepath.Join(t.TempDir(), "charts.git")
+	work := t.TempDir()
+
+	if _, err := runGit("", "init", "--quiet", "--bare", bare); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runGit(work, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+
+	commit := commitChart(t, work, "1.0.0")
+
+	if _, err := runGit(work, "push", "--quiet", bare, "HEAD:refs/heads/release"); err != nil {
+		t.Fatal(err)
+	}
+
+	ou := &OpenUnisonDeployment{namespace: "openunison", resolvedCharts: map[string]LockedChart{}}
+
+	repoURL := "file://" + filepath.ToSlash(bare)
+	values := map[string]interface{}{"network": map[string]interface{}{"openunison_host": "k8sou.example.com"}}
+
+	release, err := ou.planRelease("orchestra", "git+"+repoURL+"//charts/orchestra?ref=release", values, false, cli.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := plannedRelease{
+		Name:      "orchestra",
+		Namespace: "openunison",
+		RepoURL:   repoURL,
+		Git:       true,
+		Path:      "charts/orchestra",
+		Commit:    commit,
+		Chart:     "orchestra",
+		Version:   "1.0.0",
+		Values:    values,
+	}
+
+	if !reflect.DeepEqual(release, expected) {
+		t.Errorf("planned %+v, expected %+v", release, expected)
+	}
+}
+
+func TestPlanReleaseCantBeExported(t *testing.T) {
+	ou := &OpenUnisonDeployment{namespace: "openunison", resolvedCharts: map[string]LockedChart{}}
+
+	tests := []struct {
+		chartRef string
+		err      string
+	}{
+		{chartRef: "file://./charts/orchestra", err: "is a local chart and can't be exported"},
+		{chartRef: "https://charts.example.com/orchestra-1.0.0.tgz#sha256=abcd", err: "is an archive's url and can't be exported"},
+		{chartRef: "http://charts.example.com/orchestra-1.0.0.tgz@1.0.0", err: "is an archive's url and can't be exported"},
+	}
+
+	for _, test := range tests {
+		_, err := ou.planRelease("orchestra", test.chartRef, map[string]interface{}{}, false, cli.New())
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.chartRef, test.err, err)
+		}
+	}
+}
+
+var testPlannedReleases = []plannedRelease{
+	{Name: "openunison", Namespace: "openunison", RepoURL: "https://nexus.tremolo.io/repository/helm/", RepoName: "tremolo", Chart: "openunison-operator", Version: "3.0.9", Values: map[string]interface{}{}},
+	{Name: "orchestra", Namespace: "openunison", RepoURL: "https://github.com/org/charts", Git: true, Path: "charts/orchestra", Commit: "0123456789abcdef0123456789abcdef01234567", Chart: "orchestra", Version: "1.0.0", Values: map[string]interface{}{}},
+	{Name: "orchestra-login-portal", Namespace: "openunison", RepoURL: "https://github.com/org/charts", Git: true, Path: "charts/orchestra-login-portal", Commit: "0123456789abcdef0123456789abcdef01234567", Chart: "orchestra-login-portal", Version: "1.0.0", Values: map[string]interface{}{}},
+	{Name: "cluster-management", Namespace: "openunison", RepoURL: "registry.example.com/charts", OCI: true, Chart: "openunison-k8s-cluster-management", Version: "3.0.1", Values: map[string]interface{}{}},
+}
+
+func TestArgoCDManifestsFromGit(t *testing.T) {
+	options := GitOpsOptions{Format: GitOpsFormatArgoCD, ValuesMode: GitOpsValuesInline, ArgoCDNamespace: "argocd", ArgoCDProject: "default", DestinationServer: "https://kubernetes.default.svc"}
+
+	files, err := options.manifests(testPlannedReleases, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := func(i int) map[string]interface{} {
+		return files[i].Objects[0].(map[string]interface{})["spec"].(map[string]interface{})["source"].(map[string]interface{})
+	}
+
+	orchestra := source(1)
+	if orchestra["repoURL"] != "https://github.com/org/charts" || orchestra["path"] != "charts/orchestra" || orchestra["targetRevision"] != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("orchestra's source is %v", orchestra)
+	}
+
+	if _, found := orchestra["chart"]; found {
+		t.Errorf("a git source has a chart: %v", orchestra)
+	}
+
+	operator := source(0)
+	if operator["chart"] != "openunison-operator" || operator["targetRevision"] != "3.0.9" {
+		t.Errorf("the operator's source is %v", operator)
+	}
+
+	if _, found := operator["path"]; found {
+		t.Errorf("a helm repository source has a path: %v", operator)
+	}
+}
+
+func TestFluxManifestsFromGit(t *testing.T) {
+	options := GitOpsOptions{Format: GitOpsFormatFlux, ValuesMode: GitOpsValuesInline, FluxNamespace: "flux-system"}
+
+	files, err := options.manifests(testPlannedReleases, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	objects := make(map[string]map[string]interface{})
+	for _, file := range files {
+		names = append(names, file.Name)
+
+		for _, object := range file.Objects {
+			obj := object.(map[string]interface{})
+			objects[obj["kind"].(string)+"/"+obj["metadata"].(map[string]interface{})["name"].(string)] = obj
+		}
+	}
+
+	expectedNames := []string{"helm-repositories.yaml", "git-repositories.yaml", "00-openunison.yaml", "01-orchestra.yaml", "02-orchestra-login-portal.yaml", "03-cluster-management.yaml"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("wrote %v, expected %v", names, expectedNames)
+	}
+
+	// both charts from the same commit share a GitRepository
+	gitRepository, found := objects["GitRepository/https-github-com-org-charts-0123456789ab"]
+	if !found {
+		t.Fatalf("no GitRepository in %v", reflect.ValueOf(objects).MapKeys())
+	}
+
+	gitSpec := gitRepository["spec"].(map[string]interface{})
+	if gitSpec["url"] != "https://github.com/org/charts" || gitSpec["ref"].(map[string]interface{})["commit"] != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("the GitRepository's spec is %v", gitSpec)
+	}
+
+	chartSpec := func(name string) map[string]interface{} {
+		return objects["HelmRelease/"+name]["spec"].(map[string]interface{})["chart"].(map[string]interface{})["spec"].(map[string]interface{})
+	}
+
+	for _, name := range []string{"orchestra", "orchestra-login-portal"} {
+		spec := chartSpec(name)
+
+		expected := map[string]interface{}{
+			"chart":             "./charts/" + name,
+			"reconcileStrategy": "Revision",
+			"sourceRef": map[string]interface{}{
+				"kind":      "GitRepository",
+				"name":      "https-github-com-org-charts-0123456789ab",
+				"namespace": "flux-system",
+			},
+		}
+
+		if !reflect.DeepEqual(spec, expected) {
+			t.Errorf("%s's chart is %v, expected %v", name, spec, expected)
+		}
+	}
+
+	if spec := chartSpec("openunison"); spec["version"] != "3.0.9" || spec["sourceRef"].(map[string]interface{})["name"] != "tremolo" {
+		t.Errorf("the operator's chart is %v", spec)
+	}
+
+	if spec := chartSpec("cluster-management"); spec["sourceRef"].(map[string]interface{})["name"] != "registry-example-com-charts" {
+		t.Errorf("cluster-management's chart is %v", spec)
+	}
+}
@@ -0,0 +1,314 @@
+package openunison
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// certificates that expire within this long are warned about
+const certificateExpiryWarning = 30 * 24 * time.Hour
+
+// finds the certificate satelites have to trust for the control plane's host when it isn't generated by the operator.
+// The CA is taken from the ingress's TLS secret, or with --fetch-control-plane-chain from the chain the host serves
+func (ou *OpenUnisonDeployment) detectIdPCertificate(hostName string, tlsSecretName string) (string, error) {
+	var chain []*x509.Certificate
+	var err error
+
+	if ou.fetchControlPlaneChain {
+		chain, err = fetchCertificateChain(hostName)
+		if err != nil {
+			return "", err
+		}
+
+		printCertificateChain(fmt.Sprintf("Certificate chain served by %s", hostName), chain)
+
+		anchor, verified, err := resolveChainAnchor(chain, hostName, ou.controlPlaneCAFingerprint, systemRoots())
+		if err != nil {
+			return "", err
+		}
+
+		// a chain that isn't verified by the system's CAs was read without verifying it, so whoever answered has to
+		// be the control plane
+		if !verified || ou.controlPlaneCAFingerprint != "" {
+			err = ou.confirmFetchedAnchor(anchor, hostName)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return trustAnchorPEM(anchor, chain, hostName)
+	} else if tlsSecretName != "" {
+		tlsSecret, err := ou.clientset.CoreV1().Secrets(ou.cpNamespace).Get(context.TODO(), tlsSecretName, metav1.GetOptions{})
+		if err != nil {
+			return "", controlPlaneSecretError(tlsSecretName, err)
+		}
+
+		chain, err = parseCertificates(tlsSecret.Data["tls.crt"])
+		if err != nil {
+			return "", fmt.Errorf("could not parse tls.crt in %s: %v", tlsSecretName, err)
+		}
+
+		printCertificateChain(fmt.Sprintf("Certificate chain in %s", tlsSecretName), chain)
+
+		// cert-manager and most CAs include the issuing CA as ca.crt
+		if caData := tlsSecret.Data["ca.crt"]; len(caData) > 0 {
+			caCerts, err := parseCertificates(caData)
+			if err != nil {
+				return "", fmt.Errorf("could not parse ca.crt in %s: %v", tlsSecretName, err)
+			}
+
+			printCertificateChain(fmt.Sprintf("CA certificates in %s", tlsSecretName), caCerts)
+
+			anchor, err := caTrustAnchor(chain, caCerts, hostName)
+			if err != nil {
+				return "", fmt.Errorf("ca.crt in %s: %v", tlsSecretName, err)
+			}
+
+			return anchor, nil
+		}
+	} else {
+		fmt.Printf("No TLS secret for %s, use --fetch-control-plane-chain to read the certificate from the host\n", hostName)
+		return "", nil
+	}
+
+	anchor, _, err := resolveChainAnchor(chain, hostName, ou.controlPlaneCAFingerprint, systemRoots())
+	if err != nil {
+		return "", fmt.Errorf("tls.crt in %s: %v", tlsSecretName, err)
+	}
+
+	return trustAnchorPEM(anchor, chain, hostName)
+}
+
+// the anchor from a chain without a separate CA, the chain's self-signed root or, if the root isn't included, the root
+// from the system's CAs that validates the chain.  The anchor is reported as verified when it's one of the system's CAs.  It's added even when the system's CAs
+// trust the chain, since the satelite's image may not have the same CAs.  An intermediate is only pinned when it matches
+// fingerprint, otherwise the root has to be provided
+func resolveChainAnchor(chain []*x509.Certificate, hostName string, fingerprint string, roots *x509.CertPool) (*x509.Certificate, bool, error) {
+	if len(chain) == 0 {
+		return nil, false, fmt.Errorf("no certificates for %s", hostName)
+	}
+
+	var systemAnchor *x509.Certificate
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		verifiedChains, err := chain[0].Verify(x509.VerifyOptions{DNSName: strings.Split(hostName, ":")[0], Roots: roots, Intermediates: intermediates})
+		if err == nil {
+			verifiedChain := verifiedChains[0]
+			systemAnchor = verifiedChain[len(verifiedChain)-1]
+		}
+	}
+
+	for _, cert := range chain {
+		if isSelfSigned(cert) {
+			return cert, systemAnchor != nil && systemAnchor.Equal(cert), nil
+		}
+	}
+
+	if fingerprint != "" {
+		for _, cert := range chain {
+			if normalizeFingerprint(certificateFingerprint(cert)) == normalizeFingerprint(fingerprint) {
+				fmt.Printf("The root CA for %s isn't in its chain, trusting %s from --control-plane-ca-fingerprint\n", hostName, cert.Subject.String())
+				return cert, false, nil
+			}
+		}
+	}
+
+	if systemAnchor != nil {
+		fmt.Printf("The root CA for %s isn't in its chain, trusting %s from the system's CAs\n", hostName, systemAnchor.Subject.String())
+		return systemAnchor, true, nil
+	}
+
+	last := chain[len(chain)-1]
+
+	return nil, false, fmt.Errorf("the root CA for %s isn't in its chain and isn't one of the system's CAs, add the root CA to the chain or the TLS secret's ca.crt, or pin %s with --control-plane-ca-fingerprint %s", hostName, last.Subject.String(), certificateFingerprint(last))
+}
+
+// the system's CAs, or none if they can't be loaded
+func systemRoots() *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil
+	}
+
+	return roots
+}
+
+// a fetched anchor has to match --control-plane-ca-fingerprint, or be confirmed when ouctl is run from a terminal
+func (ou *OpenUnisonDeployment) confirmFetchedAnchor(anchor *x509.Certificate, hostName string) error {
+	fingerprint := certificateFingerprint(anchor)
+
+	if ou.controlPlaneCAFingerprint != "" {
+		if normalizeFingerprint(ou.controlPlaneCAFingerprint) != normalizeFingerprint(fingerprint) {
+			return fmt.Errorf("%s served %s with SHA-256 fingerprint %s, which doesn't match --control-plane-ca-fingerprint %s", hostName, anchor.Subject.String(), fingerprint, ou.controlPlaneCAFingerprint)
+		}
+
+		fmt.Printf("%s matches --control-plane-ca-fingerprint\n", anchor.Subject.String())
+		return nil
+	}
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("the certificate chain from %s wasn't verified, check %s's SHA-256 fingerprint %s and pass it with --control-plane-ca-fingerprint", hostName, anchor.Subject.String(), fingerprint)
+	}
+
+	fmt.Printf("Trust %s, SHA-256 fingerprint %s, for %s? [y/N] ", anchor.Subject.String(), fingerprint, hostName)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("%s wasn't trusted for %s", anchor.Subject.String(), hostName)
+	}
+
+	return nil
+}
+
+// fingerprints are compared without case or separators, so openssl's "sha256 Fingerprint=AB:CD..." and ouctl's
+// formats both match
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.TrimSpace(fingerprint))
+	if _, value, found := strings.Cut(fingerprint, "="); found {
+		fingerprint = value
+	}
+	fingerprint = strings.TrimPrefix(fingerprint, "SHA256:")
+
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
+
+// the anchor from a CA bundle, the bundle's root or the first certificate if it doesn't have one
+func caTrustAnchor(chain []*x509.Certificate, caCerts []*x509.Certificate, hostName string) (string, error) {
+	if len(caCerts) == 0 {
+		return "", fmt.Errorf("no certificates")
+	}
+
+	anchor := caCerts[0]
+	for _, cert := range caCerts {
+		if isSelfSigned(cert) {
+			anchor = cert
+			break
+		}
+	}
+
+	return trustAnchorPEM(anchor, append(append([]*x509.Certificate{}, chain...), caCerts...), hostName)
+}
+
+// makes sure the chain is valid with only the anchor trusted, the same way satelites will see it
+func trustAnchorPEM(anchor *x509.Certificate, chain []*x509.Certificate, hostName string) (string, error) {
+	if len(chain) == 0 {
+		return "", fmt.Errorf("no certificates for %s", hostName)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{DNSName: hostName, Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return "", fmt.Errorf("the certificate for %s isn't valid when trusting %s: %v", hostName, anchor.Subject.String(), err)
+	}
+
+	fmt.Printf("Adding %s, SHA-256 fingerprint %s, to trusted_certs\n", anchor.Subject.String(), certificateFingerprint(anchor))
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: anchor.Raw})), nil
+}
+
+// the certificates the host presents, without verifying them
+func fetchCertificateChain(hostName string) ([]*x509.Certificate, error) {
+	address := hostName
+	if _, _, err := net.SplitHostPort(hostName); err != nil {
+		address = net.JoinHostPort(hostName, "443")
+	}
+
+	fmt.Printf("Reading the certificate chain from %s\n", address)
+
+	// the chain is verified once the anchor is chosen
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", address, &tls.Config{
+		ServerName:         strings.Split(hostName, ":")[0],
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0)
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return certs, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	hexSum := make([]string, len(sum))
+	for i, b := range sum {
+		hexSum[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(hexSum, ":")
+}
+
+func printCertificateChain(title string, chain []*x509.Certificate) {
+	fmt.Printf("%s:\n", title)
+
+	for i, cert := range chain {
+		fmt.Printf("  %d. Subject     : %s\n", i, cert.Subject.String())
+		fmt.Printf("     Issuer      : %s\n", cert.Issuer.String())
+		fmt.Printf("     SHA-256     : %s\n", certificateFingerprint(cert))
+		fmt.Printf("     Expires     : %s\n", cert.NotAfter.UTC().Format(time.RFC3339))
+
+		if time.Now().After(cert.NotAfter) {
+			fmt.Printf("     WARNING: this certificate has expired\n")
+		} else if time.Until(cert.NotAfter) < certificateExpiryWarning {
+			fmt.Printf("     WARNING: this certificate expires in less than %d days\n", int(certificateExpiryWarning.Hours()/24))
+		}
+	}
+}
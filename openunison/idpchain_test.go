@@ -0,0 +1,112 @@
+package openunison
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issues a certificate signed by parent, or a self-signed one when parent is nil
+func issueTestCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	if !isCA {
+		template.DNSNames = []string{name}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestResolveChainAnchor(t *testing.T) {
+	const hostName = "k8sou.example.com"
+
+	root, rootKey := issueTestCertificate(t, "root", true, nil, nil)
+	intermediate, intermediateKey := issueTestCertificate(t, "intermediate", true, root, rootKey)
+	leaf, _ := issueTestCertificate(t, hostName, false, intermediate, intermediateKey)
+
+	systemWithRoot := x509.NewCertPool()
+	systemWithRoot.AddCert(root)
+
+	tests := []struct {
+		name        string
+		chain       []*x509.Certificate
+		fingerprint string
+		roots       *x509.CertPool
+		anchor      *x509.Certificate
+		verified    bool
+		err         string
+	}{
+		{name: "root in the chain", chain: []*x509.Certificate{leaf, intermediate, root}, roots: x509.NewCertPool(), anchor: root},
+		{name: "root in the chain and the system", chain: []*x509.Certificate{leaf, intermediate, root}, roots: systemWithRoot, anchor: root, verified: true},
+		{name: "root from the system", chain: []*x509.Certificate{leaf, intermediate}, roots: systemWithRoot, anchor: root, verified: true},
+		{name: "pinned intermediate", chain: []*x509.Certificate{leaf, intermediate}, fingerprint: strings.ToLower(certificateFingerprint(intermediate)), roots: x509.NewCertPool(), anchor: intermediate},
+		{name: "pin takes precedence over the system", chain: []*x509.Certificate{leaf, intermediate}, fingerprint: certificateFingerprint(intermediate), roots: systemWithRoot, anchor: intermediate},
+		{name: "no root", chain: []*x509.Certificate{leaf, intermediate}, roots: x509.NewCertPool(), err: "pin CN=intermediate with --control-plane-ca-fingerprint " + certificateFingerprint(intermediate)},
+		{name: "no system CAs", chain: []*x509.Certificate{leaf, intermediate}, err: "isn't one of the system's CAs"},
+		{name: "pin that doesn't match", chain: []*x509.Certificate{leaf, intermediate}, fingerprint: certificateFingerprint(root), roots: x509.NewCertPool(), err: "isn't in its chain"},
+		{name: "empty chain", err: "no certificates"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			anchor, verified, err := resolveChainAnchor(test.chain, hostName, test.fingerprint, test.roots)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !anchor.Equal(test.anchor) || verified != test.verified {
+				t.Errorf("anchor is %s, verified %v, expected %s, verified %v", anchor.Subject.String(), verified, test.anchor.Subject.String(), test.verified)
+			}
+
+			// the anchor is only added to trusted_certs if it validates the chain on its own
+			if _, err := trustAnchorPEM(anchor, test.chain, hostName); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package openunison
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the parts of the issuer's discovery document that are checked
+type openIDConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+type jsonWebKeySet struct {
+	Keys []map[string]interface{} `json:"keys"`
+}
+
+// how long to wait before checking the identity provider again
+var idpTrustRetryInterval = 5 * time.Second
+
+// an error reaching the identity provider that may go away, such as a connection that's refused or a 5xx while
+// OpenUnison restarts
+type temporaryIdPError struct {
+	err error
+}
+
+func (e *temporaryIdPError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryIdPError) Unwrap() error {
+	return e.err
+}
+
+// makes sure the satelite can trust the control plane's identity provider the way it's configured, so a wrong
+// issuer or certificate is found now instead of at login.  The control plane can take a few seconds to load the
+// satelite's trust, so errors reaching it are retried, anything else fails right away
+func (ou *OpenUnisonDeployment) verifyIdPTrust(integration *sateliteIntegration) error {
+	oidc, _ := ou.helmValues["oidc"].(map[string]interface{})
+	issuer, _ := oidc["issuer"].(string)
+	if issuer == "" {
+		return fmt.Errorf("the satelite's values have no oidc.issuer")
+	}
+
+	fmt.Printf("Verifying the satelite trusts the control plane's identity provider %s\n", issuer)
+
+	var err error
+	for i := 0; i < 12; i++ {
+		err = checkIdPTrust(issuer, integration.idpCert)
+		if err == nil {
+			fmt.Printf("Identity provider %s is trusted\n", issuer)
+			return nil
+		}
+
+		var temporary *temporaryIdPError
+		if !errors.As(err, &temporary) {
+			break
+		}
+
+		fmt.Printf("Could not reach the identity provider - %v, retrying\n", err)
+		time.Sleep(idpTrustRetryInterval)
+	}
+
+	return fmt.Errorf("the satelite was deployed, but can't trust the control plane's identity provider %s: %v", issuer, err)
+}
+
+// fetches the issuer's discovery document and keys, trusting only idpCert or the system's CAs if it's empty, and
+// checks the discovery document is for the issuer
+func checkIdPTrust(issuer string, idpCert string) error {
+	client, err := idpTrustClient(idpCert)
+	if err != nil {
+		return err
+	}
+
+	discovery := &openIDConfiguration{}
+	err = getJSON(client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", discovery)
+	if err != nil {
+		return err
+	}
+
+	if discovery.Issuer != issuer {
+		return fmt.Errorf("the identity provider's issuer is %s, but the satelite is configured with %s", discovery.Issuer, issuer)
+	}
+
+	if discovery.JwksURI == "" {
+		return fmt.Errorf("the identity provider's discovery document has no jwks_uri")
+	}
+
+	keys := &jsonWebKeySet{}
+	err = getJSON(client, discovery.JwksURI, keys)
+	if err != nil {
+		return err
+	}
+
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("the identity provider's key set %s has no keys", discovery.JwksURI)
+	}
+
+	for _, key := range keys.Keys {
+		if _, ok := key["kty"].(string); !ok {
+			return fmt.Errorf("the identity provider's key set %s has a key without a kty", discovery.JwksURI)
+		}
+	}
+
+	return nil
+}
+
+// an http client that trusts the same certificate the satelite does
+func idpTrustClient(idpCert string) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if idpCert != "" {
+		certPool := x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM([]byte(idpCert)); !ok {
+			return nil, fmt.Errorf("the control plane's certificate isn't a valid PEM certificate")
+		}
+
+		tlsConfig.RootCAs = certPool
+	}
+
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+func getJSON(client *http.Client, url string, obj interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		if isCertificateError(err) {
+			return fmt.Errorf("could not get %s: %v", url, err)
+		}
+
+		return &temporaryIdPError{err: fmt.Errorf("could not get %s: %v", url, err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &temporaryIdPError{err: fmt.Errorf("could not read %s: %v", url, err)}
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &temporaryIdPError{err: fmt.Errorf("%s returned %d", url, resp.StatusCode)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+
+	err = json.Unmarshal(body, obj)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %v", url, err)
+	}
+
+	return nil
+}
+
+// true if the identity provider's certificate isn't trusted, which retrying won't fix
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,177 @@
+package openunison
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an identity provider that serves a discovery document with issuer and jwks as its key set
+func newTestIdP(t *testing.T, issuer func(url string) string, jwks string) *httptest.Server {
+	t.Helper()
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/idp/k8sIdp/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   issuer(server.URL + "/auth/idp/k8sIdp"),
+				"jwks_uri": server.URL + "/auth/idp/k8sIdp/certs",
+			})
+		case "/auth/idp/k8sIdp/certs":
+			w.Write([]byte(jwks))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func serverCertPEM(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+// a self-signed certificate for 127.0.0.1 that didn't sign httptest's certificate
+func untrustedCertPEM(t *testing.T) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "untrusted"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCheckIdPTrust(t *testing.T) {
+	const validKeys = `{"keys":[{"kty":"RSA","kid":"unison-tls","n":"AQAB","e":"AQAB"}]}`
+
+	sameIssuer := func(url string) string { return url }
+
+	tests := []struct {
+		name string
+		// the issuer the discovery document returns for the issuer's url
+		issuer func(url string) string
+		jwks   string
+		// the certificate the satelite trusts, the server's own if empty
+		idpCert string
+		err     string
+	}{
+		{name: "trusted", issuer: sameIssuer, jwks: validKeys},
+		{name: "issuer mismatch", issuer: func(url string) string { return "https://k8sou.example.com/auth/idp/k8sIdp" }, jwks: validKeys, err: "but the satelite is configured with"},
+		{name: "empty key set", issuer: sameIssuer, jwks: `{"keys":[]}`, err: "has no keys"},
+		{name: "key without kty", issuer: sameIssuer, jwks: `{"keys":[{"kid":"unison-tls"}]}`, err: "without a kty"},
+		{name: "untrusted certificate", issuer: sameIssuer, jwks: validKeys, idpCert: untrustedCertPEM(t), err: "certificate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestIdP(t, test.issuer, test.jwks)
+
+			idpCert := test.idpCert
+			if idpCert == "" {
+				idpCert = serverCertPEM(server)
+			}
+
+			err := checkIdPTrust(server.URL+"/auth/idp/k8sIdp", idpCert)
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("expected the identity provider to be trusted, got %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+
+			var temporary *temporaryIdPError
+			if errors.As(err, &temporary) {
+				t.Fatalf("expected %v to be permanent", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIdPTrustRetries(t *testing.T) {
+	defer func(interval time.Duration) { idpTrustRetryInterval = interval }(idpTrustRetryInterval)
+	idpTrustRetryInterval = time.Millisecond
+
+	const validKeys = `{"keys":[{"kty":"RSA","kid":"unison-tls","n":"AQAB","e":"AQAB"}]}`
+
+	// the key set fails with a 503 until the third request, like OpenUnison while it's restarting
+	discoveryRequests := 0
+	requests := 0
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			discoveryRequests++
+			json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/certs"})
+		case "/certs":
+			requests++
+			if requests < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(validKeys))
+		}
+	}))
+	defer server.Close()
+
+	ou := &OpenUnisonDeployment{helmValues: map[string]interface{}{"oidc": map[string]interface{}{"issuer": server.URL}}}
+
+	err := ou.verifyIdPTrust(&sateliteIntegration{idpCert: serverCertPEM(server)})
+	if err != nil {
+		t.Fatalf("expected a 5xx to be retried, got %v", err)
+	}
+
+	if requests != 3 {
+		t.Fatalf("expected 3 requests for the key set, got %d", requests)
+	}
+
+	// a permanent failure isn't retried
+	discoveryRequests = 0
+	ou.helmValues = map[string]interface{}{"oidc": map[string]interface{}{"issuer": server.URL + "/"}}
+
+	err = ou.verifyIdPTrust(&sateliteIntegration{idpCert: serverCertPEM(server)})
+	if err == nil || !strings.Contains(err.Error(), "but the satelite is configured with") {
+		t.Fatalf("expected an issuer mismatch, got %v", err)
+	}
+
+	if discoveryRequests != 1 {
+		t.Fatalf("expected the issuer mismatch to fail without retrying, got %d requests", discoveryRequests)
+	}
+}
@@ -0,0 +1,394 @@
+package openunison
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+var readVerbs = []string{"get", "list", "watch"}
+var readWriteVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+
+// what helm's release storage needs, failed releases are upgraded instead of deleted
+var helmStorageVerbs = []string{"get", "list", "create", "update"}
+
+// the helm storage driver satelite releases are stored with when installed with an integration account.  Listing
+// Secrets can't be limited to helm's, so releases are stored in ConfigMaps
+const IntegrationAccountHelmDriver = "configmap"
+
+// a ServiceAccount on the control plane with only the access install-satelite needs, so satelite admins don't need
+// an admin context for the control plane
+type IntegrationAccount struct {
+	namespace     string
+	name          string
+	secretName    string
+	contextName   string
+	server        string
+	tokenDuration time.Duration
+
+	clientset kubernetes.Interface
+	discovery discovery.DiscoveryInterface
+	rawConfig clientcmdapi.Config
+}
+
+// creates an integration account in the current context's control plane.  secretName is the Secret satelite client
+// secrets are stored in, contextName is the context in the generated kubeconfig, the current context's name if empty,
+// and server overrides the API server's url.  A tokenDuration of 0 uses a token that doesn't expire
+func NewIntegrationAccount(namespace string, name string, secretName string, contextName string, server string, tokenDuration time.Duration) (*IntegrationAccount, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+
+	rawConfig, err := kubeConfig.RawConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := kubeConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if contextName == "" {
+		contextName = rawConfig.CurrentContext
+	}
+
+	return &IntegrationAccount{
+		namespace:     namespace,
+		name:          name,
+		secretName:    secretName,
+		contextName:   contextName,
+		server:        server,
+		tokenDuration: tokenDuration,
+		clientset:     clientset,
+		discovery:     clientset.Discovery(),
+		rawConfig:     rawConfig,
+	}, nil
+}
+
+// creates or updates the ServiceAccount, its Role and RoleBinding and writes a kubeconfig with its token to
+// outputPath
+func (account *IntegrationAccount) Create(outputPath string) error {
+	rules, err := account.roleRules()
+	if err != nil {
+		return err
+	}
+
+	err = account.applyServiceAccount()
+	if err != nil {
+		return err
+	}
+
+	err = account.applyClientSecrets()
+	if err != nil {
+		return err
+	}
+
+	err = account.applyRole(rules)
+	if err != nil {
+		return err
+	}
+
+	err = account.applyRoleBinding()
+	if err != nil {
+		return err
+	}
+
+	token, err := account.token()
+	if err != nil {
+		return err
+	}
+
+	kubeconfig, err := account.kubeconfig(token)
+	if err != nil {
+		return err
+	}
+
+	// written with only the owner able to read it
+	err = clientcmd.WriteToFile(*kubeconfig, outputPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote the kubeconfig for %s to %s, use context %s as install-satelite's control plane context with --control-plane-kubeconfig %s --control-plane-secret-name %s --control-plane-helm-driver %s --fetch-control-plane-chain\n", account.name, outputPath, account.contextName, outputPath, account.secretName, IntegrationAccountHelmDriver)
+
+	return nil
+}
+
+// the access install-satelite needs in the control plane's namespace:
+//
+//	secrets                   - get and update the Secret satelite client secrets are stored in
+//	configmaps                - helm's release storage
+//	openunisons               - read the control plane's configuration
+//	ingresses                 - check the control plane's host is served with TLS
+//	openunison.tremolo.io/*   - the objects the add-cluster chart creates
+//
+// Helm lists its release storage by label, which can't be limited to its own objects, so releases are stored in
+// ConfigMaps and the account can't read any other Secret.  The client secret Secret is created with the account,
+// since creating a Secret can't be limited with resourceNames
+func (account *IntegrationAccount) roleRules() ([]rbacv1.PolicyRule, error) {
+	rules := []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{account.secretName}, Verbs: []string{"get", "update"}},
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: helmStorageVerbs},
+		{APIGroups: []string{openUnisonGroup}, Resources: []string{openUnisonResource}, Verbs: readVerbs},
+		{APIGroups: []string{"networking.k8s.io"}, Resources: []string{"ingresses"}, Verbs: readVerbs},
+	}
+
+	resources, err := account.openUnisonResources()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resources) > 0 {
+		rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{openUnisonGroup}, Resources: resources, Verbs: readWriteVerbs})
+	}
+
+	return rules, nil
+}
+
+// the namespaced resources in the openunison.tremolo.io group other than openunisons, in every served version
+func (account *IntegrationAccount) openUnisonResources() ([]string, error) {
+	groups, err := account.discovery.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the cluster's APIs: %v", err)
+	}
+
+	found := map[string]bool{}
+	installed := false
+
+	for _, group := range groups.Groups {
+		if group.Name != openUnisonGroup {
+			continue
+		}
+
+		installed = true
+
+		for _, version := range group.Versions {
+			resourceList, err := account.discovery.ServerResourcesForGroupVersion(version.GroupVersion)
+			if err != nil {
+				return nil, fmt.Errorf("could not discover %s: %v", version.GroupVersion, err)
+			}
+
+			for _, resource := range resourceList.APIResources {
+				// subresources are covered by their resource
+				if !resource.Namespaced || strings.Contains(resource.Name, "/") || resource.Name == openUnisonResource {
+					continue
+				}
+
+				found[resource.Name] = true
+			}
+		}
+	}
+
+	if !installed {
+		return nil, fmt.Errorf("the OpenUnison CRD %s.%s isn't installed, run ouctl against the control plane", openUnisonResource, openUnisonGroup)
+	}
+
+	resources := make([]string, 0, len(found))
+	for resource := range found {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	return resources, nil
+}
+
+func (account *IntegrationAccount) applyServiceAccount() error {
+	serviceAccounts := account.clientset.CoreV1().ServiceAccounts(account.namespace)
+
+	_, err := serviceAccounts.Get(context.TODO(), account.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("Creating ServiceAccount %s/%s\n", account.namespace, account.name)
+		_, err = serviceAccounts.Create(context.TODO(), &v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: account.name, Namespace: account.namespace},
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		fmt.Printf("ServiceAccount %s/%s already exists\n", account.namespace, account.name)
+	}
+
+	return err
+}
+
+// creates the Secret satelite client secrets are stored in, the account can only read and update it
+func (account *IntegrationAccount) applyClientSecrets() error {
+	secrets := account.clientset.CoreV1().Secrets(account.namespace)
+
+	_, err := secrets.Get(context.TODO(), account.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("Creating client secret Secret %s/%s\n", account.namespace, account.secretName)
+		_, err = secrets.Create(context.TODO(), &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: account.secretName, Namespace: account.namespace},
+			Data:       map[string][]byte{},
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		fmt.Printf("Client secret Secret %s/%s already exists\n", account.namespace, account.secretName)
+	}
+
+	return err
+}
+
+func (account *IntegrationAccount) applyRole(rules []rbacv1.PolicyRule) error {
+	roles := account.clientset.RbacV1().Roles(account.namespace)
+
+	role, err := roles.Get(context.TODO(), account.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("Creating Role %s/%s\n", account.namespace, account.name)
+		_, err = roles.Create(context.TODO(), &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: account.name, Namespace: account.namespace},
+			Rules:      rules,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updating Role %s/%s\n", account.namespace, account.name)
+	role.Rules = rules
+	_, err = roles.Update(context.TODO(), role, metav1.UpdateOptions{})
+
+	return err
+}
+
+func (account *IntegrationAccount) applyRoleBinding() error {
+	roleBindings := account.clientset.RbacV1().RoleBindings(account.namespace)
+
+	roleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: account.name, Namespace: account.namespace},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: account.name},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: account.name, Namespace: account.namespace}},
+	}
+
+	existing, err := roleBindings.Get(context.TODO(), account.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("Creating RoleBinding %s/%s\n", account.namespace, account.name)
+		_, err = roleBindings.Create(context.TODO(), roleBinding, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// the role a binding refers to can't be changed
+	if existing.RoleRef != roleBinding.RoleRef {
+		return fmt.Errorf("RoleBinding %s/%s refers to %s %s, delete it to create the integration account", account.namespace, account.name, existing.RoleRef.Kind, existing.RoleRef.Name)
+	}
+
+	fmt.Printf("Updating RoleBinding %s/%s\n", account.namespace, account.name)
+	existing.Subjects = roleBinding.Subjects
+	_, err = roleBindings.Update(context.TODO(), existing, metav1.UpdateOptions{})
+
+	return err
+}
+
+// a token that expires after tokenDuration, or one stored in a service account token Secret that doesn't expire
+func (account *IntegrationAccount) token() (string, error) {
+	if account.tokenDuration > 0 {
+		seconds := int64(account.tokenDuration.Seconds())
+
+		tokenRequest, err := account.clientset.CoreV1().ServiceAccounts(account.namespace).CreateToken(context.TODO(), account.name, &authenticationv1.TokenRequest{
+			Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &seconds},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return "", fmt.Errorf("could not create a token for %s: %v", account.name, err)
+		}
+
+		fmt.Printf("Created a token for %s that expires %s\n", account.name, tokenRequest.Status.ExpirationTimestamp.UTC().Format(time.RFC3339))
+
+		return tokenRequest.Status.Token, nil
+	}
+
+	secrets := account.clientset.CoreV1().Secrets(account.namespace)
+	secretName := account.name + "-token"
+
+	_, err := secrets.Get(context.TODO(), secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("Creating token Secret %s/%s\n", account.namespace, secretName)
+		_, err = secrets.Create(context.TODO(), &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        secretName,
+				Namespace:   account.namespace,
+				Annotations: map[string]string{v1.ServiceAccountNameKey: account.name},
+			},
+			Type: v1.SecretTypeServiceAccountToken,
+		}, metav1.CreateOptions{})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// the token is added by the token controller
+	for i := 0; i < 30; i++ {
+		secret, err := secrets.Get(context.TODO(), secretName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		if token := secret.Data[v1.ServiceAccountTokenKey]; len(token) > 0 {
+			return string(token), nil
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return "", fmt.Errorf("the token for %s wasn't added to Secret %s/%s", account.name, account.namespace, secretName)
+}
+
+// a kubeconfig for the current context's cluster that authenticates with the token
+func (account *IntegrationAccount) kubeconfig(token string) (*clientcmdapi.Config, error) {
+	currentContext, ok := account.rawConfig.Contexts[account.rawConfig.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("there's no current context")
+	}
+
+	currentCluster, ok := account.rawConfig.Clusters[currentContext.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s of context %s doesn't exist", currentContext.Cluster, account.rawConfig.CurrentContext)
+	}
+
+	cluster := currentCluster.DeepCopy()
+	cluster.LocationOfOrigin = ""
+
+	// the kubeconfig is used on other machines, so the CA is included
+	if cluster.CertificateAuthority != "" {
+		caData, err := os.ReadFile(cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+
+		cluster.CertificateAuthorityData = caData
+		cluster.CertificateAuthority = ""
+	}
+
+	if account.server != "" {
+		cluster.Server = account.server
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters[account.contextName] = cluster
+	kubeconfig.AuthInfos[account.name] = &clientcmdapi.AuthInfo{Token: token}
+	kubeconfig.Contexts[account.contextName] = &clientcmdapi.Context{
+		Cluster:   account.contextName,
+		AuthInfo:  account.name,
+		Namespace: account.namespace,
+	}
+	kubeconfig.CurrentContext = account.contextName
+
+	return kubeconfig, nil
+}
@@ -0,0 +1,71 @@
+package openunison
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIntegrationAccountRoleRules(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	discovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	discovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: openUnisonGroup + "/v6",
+		APIResources: []metav1.APIResource{
+			{Name: openUnisonResource, Namespaced: true},
+			{Name: openUnisonResource + "/status", Namespaced: true},
+			{Name: "trusts", Namespaced: true},
+			{Name: "authmechs", Namespaced: false},
+		},
+	}}
+
+	account := &IntegrationAccount{namespace: "openunison", name: "ouctl-satelite-integration", secretName: SateliteClientSecretName, clientset: clientset, discovery: discovery}
+
+	rules, err := account.roleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretRules := 0
+	for _, rule := range rules {
+		if !reflect.DeepEqual(rule.Resources, []string{"secrets"}) {
+			continue
+		}
+
+		secretRules++
+
+		if !reflect.DeepEqual(rule.ResourceNames, []string{SateliteClientSecretName}) {
+			t.Errorf("secrets aren't limited to %s: %v", SateliteClientSecretName, rule.ResourceNames)
+		}
+
+		if !reflect.DeepEqual(rule.Verbs, []string{"get", "update"}) {
+			t.Errorf("secrets have verbs %v, expected get and update", rule.Verbs)
+		}
+	}
+
+	if secretRules != 1 {
+		t.Errorf("expected one rule for secrets, got %d", secretRules)
+	}
+
+	last := rules[len(rules)-1]
+	if !reflect.DeepEqual(last.Resources, []string{"trusts"}) {
+		t.Errorf("the add-cluster chart's resources are %v, expected trusts", last.Resources)
+	}
+
+	// the client secret Secret is created once, without changing an existing one
+	for i := 0; i < 2; i++ {
+		err = account.applyClientSecrets()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := clientset.CoreV1().Secrets("openunison").Get(context.TODO(), SateliteClientSecretName, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
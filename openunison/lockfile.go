@@ -0,0 +1,221 @@
+package openunison
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// the default path of the lock file
+const DefaultLockFile = "ouctl.lock"
+
+// configures the lock file charts are recorded in and checked against
+type ChartLock struct {
+	// path of the lock file
+	Path string
+	// if true, only charts that match the lock file are installed
+	Locked bool
+	// if true, the charts are recorded in the lock file after a successful run
+	Record bool
+}
+
+// the charts resolved by a successful run
+type LockFile struct {
+	Charts []LockedChart `yaml:"charts"`
+}
+
+// a chart as it was resolved
+type LockedChart struct {
+	// the chart reference without a version, such as tremolo/orchestra or oci://registry/charts/orchestra
+	Name string `yaml:"name"`
+	// the chart's name from Chart.yaml
+	Chart      string `yaml:"chart"`
+	Version    string `yaml:"version"`
+	Repository string `yaml:"repository"`
+	// the sha256 digest of the chart's archive
+	Digest string `yaml:"digest"`
+	// the digest of the chart's OCI manifest, only for OCI charts
+	ManifestDigest string `yaml:"manifestDigest,omitempty"`
+	// the commit the chart was checked out from, only for charts from git
+	Commit string `yaml:"commit,omitempty"`
+}
+
+// loads the lock file, if it doesn't exist an empty lock file is returned
+func loadLockFile(path string) (*LockFile, error) {
+	lockFile := &LockFile{Charts: make([]LockedChart, 0)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lockFile, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse lock file %s: %v", path, err)
+	}
+
+	return lockFile, nil
+}
+
+// the locked chart for a chart reference without a version, nil if it isn't locked
+func (lockFile *LockFile) find(name string) *LockedChart {
+	for i := range lockFile.Charts {
+		if lockFile.Charts[i].Name == name {
+			return &lockFile.Charts[i]
+		}
+	}
+
+	return nil
+}
+
+// adds or replaces a chart
+func (lockFile *LockFile) record(lockedChart LockedChart) {
+	existing := lockFile.find(lockedChart.Name)
+	if existing != nil {
+		*existing = lockedChart
+	} else {
+		lockFile.Charts = append(lockFile.Charts, lockedChart)
+	}
+}
+
+func (lockFile *LockFile) save(path string) error {
+	sort.Slice(lockFile.Charts, func(i, j int) bool {
+		return lockFile.Charts[i].Name < lockFile.Charts[j].Name
+	})
+
+	data, err := marshalManifest(lockFile)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// the sha256 digest of a file
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// the sha256 digest of data
+func dataDigest(data []byte) string {
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// the url of the repository a chart reference like tremolo/orchestra is from
+func chartRepositoryURL(chartName string, settings *cli.EnvSettings) string {
+	repoName, _, found := strings.Cut(chartName, "/")
+	if !found {
+		return ""
+	}
+
+	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	if err != nil {
+		return ""
+	}
+
+	entry := repoFile.Get(repoName)
+	if entry == nil {
+		return ""
+	}
+
+	return entry.URL
+}
+
+// in locked mode, adds the locked version to a chart reference without one
+func (ou *OpenUnisonDeployment) lockedChartRef(configChartName string) (string, error) {
+	if !ou.chartLock.Locked {
+		return configChartName, nil
+	}
+
+	if _, chartVersion := splitChartVersion(configChartName); chartVersion != "" {
+		return configChartName, nil
+	}
+
+	lockedChart := ou.lockFile.find(configChartName)
+	if lockedChart == nil {
+		return "", fmt.Errorf("chart %s is not in %s, run without --locked to add it", configChartName, ou.chartLock.Path)
+	}
+
+	fmt.Printf("Using locked version %s of %s\n", lockedChart.Version, configChartName)
+
+	return configChartName + "@" + lockedChart.Version, nil
+}
+
+// records a resolved chart, in locked mode the chart must match the lock file
+func (ou *OpenUnisonDeployment) checkLock(resolved LockedChart) error {
+	if ou.chartLock.Locked {
+		lockedChart := ou.lockFile.find(resolved.Name)
+		if lockedChart == nil {
+			return fmt.Errorf("chart %s is not in %s, run without --locked to add it", resolved.Name, ou.chartLock.Path)
+		}
+
+		if lockedChart.Version != resolved.Version {
+			return fmt.Errorf("chart %s is version %s, but %s is locked to %s", resolved.Name, resolved.Version, ou.chartLock.Path, lockedChart.Version)
+		}
+
+		if resolved.Digest == "" && resolved.Commit == "" {
+			return fmt.Errorf("chart %s isn't an archive, its digest can't be checked against %s", resolved.Name, ou.chartLock.Path)
+		}
+
+		if lockedChart.Commit != resolved.Commit {
+			return fmt.Errorf("chart %s is from commit %s, but %s is locked to %s", resolved.Name, resolved.Commit, ou.chartLock.Path, lockedChart.Commit)
+		}
+
+		if lockedChart.Digest != resolved.Digest {
+			return fmt.Errorf("chart %s version %s has digest %s, but %s is locked to %s", resolved.Name, resolved.Version, resolved.Digest, ou.chartLock.Path, lockedChart.Digest)
+		}
+
+		if lockedChart.ManifestDigest != "" && resolved.ManifestDigest != "" && lockedChart.ManifestDigest != resolved.ManifestDigest {
+			return fmt.Errorf("chart %s version %s has OCI manifest digest %s, but %s is locked to %s", resolved.Name, resolved.Version, resolved.ManifestDigest, ou.chartLock.Path, lockedChart.ManifestDigest)
+		}
+
+		fmt.Printf("Chart %s matches %s\n", resolved.Name, ou.chartLock.Path)
+	}
+
+	ou.resolvedCharts[resolved.Name] = resolved
+
+	return nil
+}
+
+// writes the charts resolved during this run to the lock file
+func (ou *OpenUnisonDeployment) SaveLockFile() error {
+	if ou.chartLock.Path == "" || ou.chartLock.Locked || !ou.chartLock.Record {
+		return nil
+	}
+
+	for _, resolved := range ou.resolvedCharts {
+		if resolved.Digest == "" && resolved.Commit == "" {
+			fmt.Printf("Chart %s isn't an archive and isn't added to %s\n", resolved.Name, ou.chartLock.Path)
+			continue
+		}
+
+		ou.lockFile.record(resolved)
+	}
+
+	fmt.Printf("Writing lock file %s\n", ou.chartLock.Path)
+
+	return ou.lockFile.save(ou.chartLock.Path)
+}
@@ -0,0 +1,64 @@
+package openunison
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLockFile(t *testing.T) {
+	resolved := LockedChart{Name: "tremolo/orchestra", Chart: "orchestra", Version: "2.3.45", Repository: "https://nexus.tremolo.io/repository/helm/", Digest: "sha256:abcd"}
+
+	tests := []struct {
+		name    string
+		lock    ChartLock
+		written bool
+	}{
+		{name: "the default path isn't written", lock: ChartLock{Path: "ouctl.lock"}},
+		{name: "--lock-file is set", lock: ChartLock{Path: "ouctl.lock", Record: true}, written: true},
+		{name: "--locked only reads the lock file", lock: ChartLock{Path: "ouctl.lock", Locked: true, Record: true}},
+		{name: "--lock-file ''", lock: ChartLock{Record: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.lock.Path != "" {
+				test.lock.Path = filepath.Join(dir, test.lock.Path)
+			}
+
+			ou := &OpenUnisonDeployment{
+				chartLock:      test.lock,
+				lockFile:       &LockFile{Charts: make([]LockedChart, 0)},
+				resolvedCharts: map[string]LockedChart{resolved.Name: resolved},
+			}
+
+			err := ou.SaveLockFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if written := len(entries) > 0; written != test.written {
+				t.Fatalf("lock file written is %v, expected %v", written, test.written)
+			}
+
+			if !test.written {
+				return
+			}
+
+			lockFile, err := loadLockFile(test.lock.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if locked := lockFile.find(resolved.Name); locked == nil || *locked != resolved {
+				t.Errorf("the lock file has %+v", lockFile.Charts)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package openunison
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tremolosecurity/openunison-control/openunisonmodel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	openUnisonGroup    = "openunison.tremolo.io"
+	openUnisonResource = "openunisons"
+
+	// the CRD version openunisonmodel is generated from
+	openUnisonModelVersion = "v6"
+)
+
+// converts an object of a known version to the model's version, in place.  Any other version is refused
+var openUnisonConversions = map[string]func(obj map[string]interface{}) error{
+	"v1": convertOpenUnisonFields,
+	"v2": convertOpenUnisonFields,
+	"v3": convertOpenUnisonFields,
+	"v4": convertOpenUnisonFields,
+	"v5": convertOpenUnisonFields,
+	openUnisonModelVersion: func(obj map[string]interface{}) error {
+		return nil
+	},
+}
+
+// converts the fields ouctl reads from the shapes older versions allow to the model's.  Name and value pairs may be
+// maps instead of lists of name and value objects, and host names may be plain strings instead of objects.  Fields
+// that already have the model's shape are left alone
+func convertOpenUnisonFields(obj map[string]interface{}) error {
+	obj["apiVersion"] = openUnisonGroup + "/" + openUnisonModelVersion
+
+	spec, ok := obj["spec"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	err := convertNameValues(spec, "non_secret_data")
+	if err != nil {
+		return err
+	}
+
+	hosts, _ := spec["hosts"].([]interface{})
+	for i, h := range hosts {
+		host, ok := h.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("hosts[%d] isn't an object", i)
+		}
+
+		err = convertNameValues(host, "annotations")
+		if err != nil {
+			return fmt.Errorf("hosts[%d]: %v", i, err)
+		}
+
+		names, _ := host["names"].([]interface{})
+		for j, name := range names {
+			if hostName, ok := name.(string); ok {
+				names[j] = map[string]interface{}{"name": hostName}
+			}
+		}
+	}
+
+	keyStore, _ := spec["key_store"].(map[string]interface{})
+	keyPairs, _ := keyStore["key_pairs"].(map[string]interface{})
+	if keyPairs != nil {
+		err = convertNameValues(keyPairs, "create_keypair_template")
+		if err != nil {
+			return fmt.Errorf("key_store.key_pairs: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// converts a map in field to a list of name and value objects sorted by name
+func convertNameValues(obj map[string]interface{}, field string) error {
+	values, ok := obj[field].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]interface{}, 0, len(values))
+	for _, name := range names {
+		value, ok := values[name].(string)
+		if !ok {
+			return fmt.Errorf("%s.%s isn't a string", field, name)
+		}
+
+		list = append(list, map[string]interface{}{"name": name, "value": value})
+	}
+
+	obj[field] = list
+
+	return nil
+}
+
+// an OpenUnison object converted to the model's version
+type openUnisonObject struct {
+	Name      string
+	Namespace string
+	// the version the object was read as
+	Version string
+
+	openunisonmodel.OpenUnison
+}
+
+// reads and patches OpenUnison objects with the version the API server prefers, if ouctl knows it
+type openUnisonClient struct {
+	resource dynamic.NamespaceableResourceInterface
+	version  string
+}
+
+// creates a client for the cluster's OpenUnison CRD, using discovery to find the version to use
+func newOpenUnisonClient(config *rest.Config) (*openUnisonClient, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the cluster's APIs: %v", err)
+	}
+
+	version, err := negotiateOpenUnisonVersion(groups)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("OpenUnison CRD Version : %v\n", version)
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openUnisonClient{
+		resource: dynamicClient.Resource(schema.GroupVersionResource{Group: openUnisonGroup, Version: version, Resource: openUnisonResource}),
+		version:  version,
+	}, nil
+}
+
+// the preferred version if ouctl can convert it, otherwise the first served version it can
+func negotiateOpenUnisonVersion(groups *metav1.APIGroupList) (string, error) {
+	for _, group := range groups.Groups {
+		if group.Name != openUnisonGroup {
+			continue
+		}
+
+		if _, ok := openUnisonConversions[group.PreferredVersion.Version]; ok {
+			return group.PreferredVersion.Version, nil
+		}
+
+		served := make([]string, 0, len(group.Versions))
+		for _, version := range group.Versions {
+			if _, ok := openUnisonConversions[version.Version]; ok {
+				fmt.Printf("OpenUnison CRD prefers version %s, which ouctl doesn't know, using %s\n", group.PreferredVersion.Version, version.Version)
+				return version.Version, nil
+			}
+
+			served = append(served, version.Version)
+		}
+
+		return "", fmt.Errorf("the cluster serves OpenUnison versions %s, ouctl only knows %s", strings.Join(served, ", "), strings.Join(knownOpenUnisonVersions(), ", "))
+	}
+
+	return "", fmt.Errorf("the OpenUnison CRD %s.%s isn't installed", openUnisonResource, openUnisonGroup)
+}
+
+func knownOpenUnisonVersions() []string {
+	versions := make([]string, 0, len(openUnisonConversions))
+	for version := range openUnisonConversions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	return versions
+}
+
+func (client *openUnisonClient) get(namespace string, name string) (*openUnisonObject, error) {
+	obj, err := client.resource.Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.decode(obj)
+}
+
+func (client *openUnisonClient) list(namespace string) ([]*openUnisonObject, error) {
+	objs, err := client.resource.Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	openunisons := make([]*openUnisonObject, 0, len(objs.Items))
+	for i := range objs.Items {
+		openunison, err := client.decode(&objs.Items[i])
+		if err != nil {
+			return nil, err
+		}
+
+		openunisons = append(openunisons, openunison)
+	}
+
+	return openunisons, nil
+}
+
+// the events' objects are *unstructured.Unstructured, decode them with decode
+func (client *openUnisonClient) watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return client.resource.Namespace(namespace).Watch(context.TODO(), opts)
+}
+
+// patches an object, the patch is in the version the client negotiated
+func (client *openUnisonClient) patch(namespace string, name string, patchType types.PatchType, data []byte) (*openUnisonObject, error) {
+	obj, err := client.resource.Namespace(namespace).Patch(context.TODO(), name, patchType, data, metav1.PatchOptions{FieldManager: crdFieldManager})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.decode(obj)
+}
+
+// converts an object to the model's version and decodes it
+func (client *openUnisonClient) decode(obj *unstructured.Unstructured) (*openUnisonObject, error) {
+	_, version, found := strings.Cut(obj.GetAPIVersion(), "/")
+	if !found {
+		version = client.version
+	}
+
+	convert, ok := openUnisonConversions[version]
+	if !ok {
+		return nil, fmt.Errorf("OpenUnison %s/%s is version %s, ouctl only knows %s", obj.GetNamespace(), obj.GetName(), version, strings.Join(knownOpenUnisonVersions(), ", "))
+	}
+
+	content := obj.DeepCopy().UnstructuredContent()
+	err := convert(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert OpenUnison %s/%s from %s: %v", obj.GetNamespace(), obj.GetName(), version, err)
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	openunison := &openUnisonObject{Name: obj.GetName(), Namespace: obj.GetNamespace(), Version: version}
+	err = json.Unmarshal(data, &openunison.OpenUnison)
+	if err != nil {
+		return nil, fmt.Errorf("OpenUnison %s/%s is malformed: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	if openunison.Spec == nil {
+		return nil, fmt.Errorf("OpenUnison %s/%s has no spec", obj.GetNamespace(), obj.GetName())
+	}
+
+	return openunison, nil
+}
@@ -0,0 +1,197 @@
+package openunison
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func openUnisonGroups(preferred string, versions ...string) *metav1.APIGroupList {
+	group := metav1.APIGroup{Name: openUnisonGroup, PreferredVersion: metav1.GroupVersionForDiscovery{Version: preferred}}
+	for _, version := range versions {
+		group.Versions = append(group.Versions, metav1.GroupVersionForDiscovery{GroupVersion: openUnisonGroup + "/" + version, Version: version})
+	}
+
+	return &metav1.APIGroupList{Groups: []metav1.APIGroup{{Name: "apps"}, group}}
+}
+
+func TestNegotiateOpenUnisonVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		groups   *metav1.APIGroupList
+		expected string
+		err      string
+	}{
+		{name: "preferred", groups: openUnisonGroups("v6", "v6", "v5"), expected: "v6"},
+		{name: "older preferred", groups: openUnisonGroups("v5", "v5"), expected: "v5"},
+		{name: "unknown preferred", groups: openUnisonGroups("v7", "v7", "v6"), expected: "v6"},
+		{name: "no known version", groups: openUnisonGroups("v8", "v8", "v7"), err: "serves OpenUnison versions v8, v7"},
+		{name: "not installed", groups: &metav1.APIGroupList{Groups: []metav1.APIGroup{{Name: "apps"}}}, err: "isn't installed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := negotiateOpenUnisonVersion(test.groups)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != test.expected {
+				t.Errorf("negotiated %s, expected %s", version, test.expected)
+			}
+		})
+	}
+}
+
+func openUnisonUnstructured(version string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := map[string]interface{}{
+		"apiVersion": openUnisonGroup + "/" + version,
+		"kind":       "OpenUnison",
+		"metadata":   map[string]interface{}{"name": "orchestra", "namespace": "openunison"},
+	}
+
+	if spec != nil {
+		obj["spec"] = spec
+	}
+
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func TestDecodeOpenUnison(t *testing.T) {
+	client := &openUnisonClient{version: "v6"}
+
+	t.Run("model version", func(t *testing.T) {
+		obj, err := client.decode(openUnisonUnstructured("v6", map[string]interface{}{
+			"non_secret_data": []interface{}{map[string]interface{}{"name": "K8S_URL", "value": "https://k8s.example.com"}},
+			"hosts": []interface{}{map[string]interface{}{
+				"ingress_type": "nginx",
+				"names":        []interface{}{map[string]interface{}{"name": "k8sou.example.com", "env_var": "OU_HOST"}},
+			}},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if obj.Version != "v6" || obj.Spec.NonSecretData[0].Name != "K8S_URL" || obj.Spec.Hosts[0].Names[0].EnvVar != "OU_HOST" {
+			t.Errorf("decoded %+v", obj.Spec)
+		}
+	})
+
+	t.Run("older version with maps and string names", func(t *testing.T) {
+		obj, err := client.decode(openUnisonUnstructured("v5", map[string]interface{}{
+			"non_secret_data": map[string]interface{}{"OU_HOST": "k8sou.example.com", "K8S_URL": "https://k8s.example.com"},
+			"hosts": []interface{}{map[string]interface{}{
+				"annotations": map[string]interface{}{"cert-manager.io/cluster-issuer": "ca"},
+				"names":       []interface{}{"k8sou.example.com"},
+			}},
+			"key_store": map[string]interface{}{
+				"key_pairs": map[string]interface{}{
+					"create_keypair_template": map[string]interface{}{"O": "Tremolo Security"},
+					"keys":                    []interface{}{map[string]interface{}{"name": "unison-ca"}},
+				},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if obj.Version != "v5" {
+			t.Errorf("version is %s, expected v5", obj.Version)
+		}
+
+		nonSecretData := obj.Spec.NonSecretData
+		if len(nonSecretData) != 2 || nonSecretData[0].Name != "K8S_URL" || nonSecretData[1].Value != "k8sou.example.com" {
+			t.Errorf("non_secret_data is %+v", nonSecretData)
+		}
+
+		host := obj.Spec.Hosts[0]
+		if host.Names[0].Name != "k8sou.example.com" || host.Annotations[0].Value != "ca" {
+			t.Errorf("host is %+v", host)
+		}
+
+		if obj.Spec.KeyStore.KeyPairs.CreateKeypairTemplate[0].Name != "O" || obj.Spec.KeyStore.KeyPairs.Keys[0].Name != "unison-ca" {
+			t.Errorf("key_pairs is %+v", obj.Spec.KeyStore.KeyPairs)
+		}
+	})
+
+	t.Run("the original object isn't changed", func(t *testing.T) {
+		original := openUnisonUnstructured("v5", map[string]interface{}{"non_secret_data": map[string]interface{}{"OU_HOST": "k8sou.example.com"}})
+
+		_, err := client.decode(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if original.GetAPIVersion() != openUnisonGroup+"/v5" {
+			t.Errorf("apiVersion changed to %s", original.GetAPIVersion())
+		}
+
+		if _, ok := original.Object["spec"].(map[string]interface{})["non_secret_data"].(map[string]interface{}); !ok {
+			t.Error("non_secret_data was converted in the original object")
+		}
+	})
+
+	errorTests := []struct {
+		name string
+		obj  *unstructured.Unstructured
+		err  string
+	}{
+		{name: "unknown version", obj: openUnisonUnstructured("v7", map[string]interface{}{}), err: "is version v7"},
+		{name: "malformed", obj: openUnisonUnstructured("v6", map[string]interface{}{"hosts": "k8sou.example.com"}), err: "is malformed"},
+		{name: "unconvertible", obj: openUnisonUnstructured("v5", map[string]interface{}{"non_secret_data": map[string]interface{}{"replicas": int64(1)}}), err: "could not convert"},
+		{name: "no spec", obj: openUnisonUnstructured("v6", nil), err: "has no spec"},
+	}
+
+	for _, test := range errorTests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := client.decode(test.obj)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestOpenUnisonClientListAndPatch(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: openUnisonGroup, Version: "v5", Resource: openUnisonResource}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "OpenUnisonList"},
+		openUnisonUnstructured("v5", map[string]interface{}{"non_secret_data": map[string]interface{}{"OU_HOST": "k8sou.example.com"}}),
+	)
+
+	client := &openUnisonClient{resource: dynamicClient.Resource(gvr), version: "v5"}
+
+	openunisons, err := client.list("openunison")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(openunisons) != 1 || openunisons[0].Spec.NonSecretData[0].Value != "k8sou.example.com" {
+		t.Fatalf("listed %+v", openunisons)
+	}
+
+	patched, err := client.patch("openunison", "orchestra", types.MergePatchType, []byte(`{"spec":{"replicas":2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if patched.Spec.Replicas != 2 || patched.Spec.NonSecretData[0].Name != "OU_HOST" {
+		t.Errorf("patched %+v", patched.Spec)
+	}
+}
@@ -0,0 +1,201 @@
+package openunison
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/shlex"
+	"helm.sh/helm/v3/pkg/postrender"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+// post-renderers keyed with this name are used for every release that doesn't have its own
+const AllChartsPostRenderer = "*"
+
+// the file the chart's rendered manifests are written to in a kustomize post-renderer's directory
+const kustomizeRenderedManifests = "ouctl-rendered-manifests.yaml"
+
+// creates the post-renderer of each release.  A directory is a kustomize patch set, anything else is an executable
+// that reads the rendered manifests on stdin and writes the patched manifests to stdout.  The spec is split like a
+// shell command line, so a path or argument with spaces has to be quoted or escaped
+func newPostRenderers(postRenderers map[string]string) (map[string]postrender.PostRenderer, error) {
+	renderers := make(map[string]postrender.PostRenderer)
+
+	for releaseName, spec := range postRenderers {
+		fields, err := shlex.Split(spec)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the post-renderer for %s: %v", releaseName, err)
+		}
+
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("post-renderer for %s is empty", releaseName)
+		}
+
+		path := fields[0]
+
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			if len(fields) > 1 {
+				return nil, fmt.Errorf("post-renderer for %s is a kustomize directory and can't have arguments", releaseName)
+			}
+
+			renderer, err := newKustomizePostRenderer(path)
+			if err != nil {
+				return nil, fmt.Errorf("post-renderer for %s: %v", releaseName, err)
+			}
+
+			renderers[releaseName] = renderer
+		} else {
+			renderer, err := postrender.NewExec(path, fields[1:]...)
+			if err != nil {
+				return nil, fmt.Errorf("post-renderer for %s: %v", releaseName, err)
+			}
+
+			renderers[releaseName] = renderer
+		}
+	}
+
+	return renderers, nil
+}
+
+// the post-renderers for a release, the release's own post-renderer runs before images are relocated so that
+// images added by patches are relocated too.  The image post-renderer is returned to record what it relocated
+func (ou *OpenUnisonDeployment) postRenderer(releaseName string, namespace string) (postrender.PostRenderer, *imagePostRenderer) {
+	chain := make(chainedPostRenderer, 0)
+
+	if renderer, ok := ou.postRenderers[releaseName]; ok {
+		fmt.Printf("Using post-renderer %s for %s\n", ou.postRendererSpecs[releaseName], releaseName)
+		chain = append(chain, renderer)
+	} else if renderer, ok := ou.postRenderers[AllChartsPostRenderer]; ok {
+		fmt.Printf("Using post-renderer %s for %s\n", ou.postRendererSpecs[AllChartsPostRenderer], releaseName)
+		chain = append(chain, renderer)
+	}
+
+	var imageRenderer *imagePostRenderer
+	if ou.imageRelocation.Enabled() {
+		imageRenderer = ou.imageRelocation.postRenderer(namespace, ou.setupImagePullSecret)
+		chain = append(chain, imageRenderer)
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return chain, imageRenderer
+}
+
+// runs each post-renderer on the output of the one before it
+type chainedPostRenderer []postrender.PostRenderer
+
+func (chain chainedPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	var err error
+
+	for _, renderer := range chain {
+		renderedManifests, err = renderer.Run(renderedManifests)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return renderedManifests, nil
+}
+
+// applies the kustomization in a directory to the rendered manifests
+type kustomizePostRenderer struct {
+	dir string
+	// the kustomization file's name in the directory
+	kustomizationFile string
+}
+
+func newKustomizePostRenderer(dir string) (*kustomizePostRenderer, error) {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return &kustomizePostRenderer{dir: dir, kustomizationFile: name}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no kustomization.yaml", dir)
+}
+
+// the directory is copied into memory with the rendered manifests added to its resources, so the directory is never
+// changed and only needs the patches
+func (renderer *kustomizePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	const root = "/ouctl-post-renderer"
+
+	memFs := filesys.MakeFsInMemory()
+
+	err := filepath.WalkDir(renderer.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(renderer.dir, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.ToSlash(filepath.Join(root, rel))
+
+		if d.IsDir() {
+			return memFs.MkdirAll(target)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return memFs.WriteFile(target, data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", renderer.dir, err)
+	}
+
+	kustomizationPath := root + "/" + renderer.kustomizationFile
+
+	data, err := memFs.ReadFile(kustomizationPath)
+	if err != nil {
+		return nil, err
+	}
+
+	kustomization := &types.Kustomization{}
+	err = yaml.Unmarshal(data, kustomization)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filepath.Join(renderer.dir, renderer.kustomizationFile), err)
+	}
+
+	kustomization.Resources = append(kustomization.Resources, kustomizeRenderedManifests)
+
+	data, err = yaml.Marshal(kustomization)
+	if err != nil {
+		return nil, err
+	}
+
+	err = memFs.WriteFile(kustomizationPath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = memFs.WriteFile(root+"/"+kustomizeRenderedManifests, renderedManifests.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(memFs, root)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply the kustomization in %s: %v", renderer.dir, err)
+	}
+
+	out, err := resources.AsYaml()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(out), nil
+}
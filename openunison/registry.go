@@ -0,0 +1,219 @@
+package openunison
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	orasdocker "oras.land/oras-go/pkg/auth/docker"
+	registryauth "oras.land/oras-go/pkg/registry/remote/auth"
+)
+
+// configures how OCI registries are connected to and authenticated with
+type RegistryOptions struct {
+	// path to a PEM file with the CA certificate
+	CaCertPath string
+	// client certificate and key for registries that require mutual TLS
+	CertFile string
+	KeyFile  string
+
+	InsecureSkipTLSVerify bool
+	PlainHTTP             bool
+
+	Username string
+	// a path or secret source for the password
+	PasswordPath string
+	// a path or secret source for a bearer token sent to the registry
+	TokenPath string
+	// a docker config.json to read credentials from, helm's registry configuration and docker's are used if not set
+	ConfigPath string
+
+	// if set, OCI charts are saved to this directory and reused, otherwise they are only loaded in memory
+	CacheDir string
+}
+
+// the http client for OCI registries
+func (options RegistryOptions) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipTLSVerify,
+	}
+
+	if options.CaCertPath != "" {
+		caCert, err := os.ReadFile(options.CaCertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		caPool := x509.NewCertPool()
+		if ok := caPool.AppendCertsFromPEM(caCert); !ok {
+			return nil, fmt.Errorf("failed to append CA cert from %s", options.CaCertPath)
+		}
+
+		tlsConfig.RootCAs = caPool
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, fmt.Errorf("a registry client certificate requires both a certificate and a key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load registry client certificate: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// the username, password and token to authenticate with, empty if credentials are read from a docker config
+func (options RegistryOptions) credentials() (string, string, string, error) {
+	password := ""
+	if options.PasswordPath != "" {
+		secret, err := readSecret(options.PasswordPath)
+		if err != nil {
+			return "", "", "", fmt.Errorf("could not read the registry password: %v", err)
+		}
+
+		password = string(secret)
+	}
+
+	if (options.Username == "") != (password == "") {
+		return "", "", "", fmt.Errorf("a registry username requires a password")
+	}
+
+	token := ""
+	if options.TokenPath != "" {
+		secret, err := readSecret(options.TokenPath)
+		if err != nil {
+			return "", "", "", fmt.Errorf("could not read the registry token: %v", err)
+		}
+
+		token = string(secret)
+	}
+
+	return options.Username, password, token, nil
+}
+
+// the docker config files credentials are read from, helm's registry configuration is used first if it exists
+func (options RegistryOptions) configFiles(settings *cli.EnvSettings) []string {
+	if options.ConfigPath != "" {
+		return []string{options.ConfigPath}
+	}
+
+	configs := make([]string, 0)
+	if _, err := os.Stat(settings.RegistryConfig); err == nil {
+		configs = append(configs, settings.RegistryConfig)
+	}
+
+	return configs
+}
+
+// a helm registry client
+func (options RegistryOptions) newClient(settings *cli.EnvSettings) (*registry.Client, error) {
+	httpClient, err := options.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, token, err := options.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := []registry.ClientOption{
+		registry.ClientOptEnableCache(true),
+		registry.ClientOptDebug(true),
+		registry.ClientOptHTTPClient(httpClient),
+	}
+
+	if options.PlainHTTP {
+		clientOptions = append(clientOptions, registry.ClientOptPlainHTTP())
+	}
+
+	if options.ConfigPath != "" {
+		clientOptions = append(clientOptions, registry.ClientOptCredentialsFile(options.ConfigPath))
+	}
+
+	if username != "" {
+		clientOptions = append(clientOptions, registry.ClientOptBasicAuth(username, password))
+	}
+
+	if token != "" {
+		resolver, err := options.resolver(settings)
+		if err != nil {
+			return nil, err
+		}
+
+		clientOptions = append(clientOptions,
+			registry.ClientOptResolver(resolver),
+			registry.ClientOptRegistryAuthorizer(&registryauth.Client{
+				Client: httpClient,
+				Cache:  registryauth.DefaultCache,
+				Credential: func(ctx context.Context, reg string) (registryauth.Credential, error) {
+					return registryauth.Credential{AccessToken: token}, nil
+				},
+			}))
+	}
+
+	ociClient, err := registry.NewClient(clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize OCI client: %v", err)
+	}
+
+	return ociClient, nil
+}
+
+// a resolver for reading manifests and blobs that aren't charts, such as signatures
+func (options RegistryOptions) resolver(settings *cli.EnvSettings) (remotes.Resolver, error) {
+	httpClient, err := options.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, token, err := options.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials func(string) (string, string, error)
+
+	if username != "" {
+		credentials = func(string) (string, string, error) {
+			return username, password, nil
+		}
+	} else {
+		authClient, err := orasdocker.NewClientWithDockerFallback(options.configFiles(settings)...)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = authClient.(*orasdocker.Client).Credential
+	}
+
+	headers := http.Header{}
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		Credentials: credentials,
+		Client:      httpClient,
+		PlainHTTP:   options.PlainHTTP,
+		Headers:     headers,
+	}), nil
+}
@@ -0,0 +1,398 @@
+package openunison
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the ConfigMap the relocated images of each release are recorded in
+const imageRelocationConfigMap = "ouctl-image-relocation"
+
+// configures how images are rewritten to come from a private registry
+type ImageRelocation struct {
+	// every image not matched by a mapping is moved to this registry, keeping its path
+	Registry string `yaml:"registry"`
+	// image prefixes and their replacement, the longest matching prefix wins
+	Mappings map[string]string `yaml:"mappings"`
+
+	// if set, an image pull secret is created from this docker config.json
+	DockerConfigPath string `yaml:"dockerConfig"`
+	// the name of the image pull secret added to every pod
+	PullSecretName string `yaml:"pullSecretName"`
+}
+
+// loads the relocation map, if there is one, and overrides its registry and pull secret with the flags that are set
+func NewImageRelocation(pathToRelocationMap string, registry string, dockerConfigPath string, pullSecretName string) (ImageRelocation, error) {
+	relocation := ImageRelocation{Mappings: map[string]string{}}
+
+	if pathToRelocationMap != "" {
+		data, err := os.ReadFile(pathToRelocationMap)
+		if err != nil {
+			return relocation, err
+		}
+
+		err = yaml.Unmarshal(data, &relocation)
+		if err != nil {
+			return relocation, fmt.Errorf("could not parse %s: %v", pathToRelocationMap, err)
+		}
+
+		if relocation.Mappings == nil {
+			relocation.Mappings = map[string]string{}
+		}
+	}
+
+	if registry != "" {
+		relocation.Registry = registry
+	}
+
+	if dockerConfigPath != "" {
+		relocation.DockerConfigPath = dockerConfigPath
+	}
+
+	if pullSecretName != "" {
+		relocation.PullSecretName = pullSecretName
+	}
+
+	relocation.Registry = strings.TrimSuffix(relocation.Registry, "/")
+
+	if relocation.DockerConfigPath != "" && relocation.PullSecretName == "" {
+		relocation.PullSecretName = "ouctl-image-pull"
+	}
+
+	return relocation, nil
+}
+
+// true if images are rewritten or a pull secret is added, so charts need the post-renderer
+func (relocation ImageRelocation) Enabled() bool {
+	return relocation.Registry != "" || len(relocation.Mappings) > 0 || relocation.PullSecretName != ""
+}
+
+// the image from the private registry
+func (relocation ImageRelocation) relocate(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		// templated or otherwise invalid references are left for the cluster to reject
+		return image
+	}
+
+	fullName := named.String()
+
+	longest := ""
+	for prefix := range relocation.Mappings {
+		if len(prefix) > len(longest) && (strings.HasPrefix(fullName, prefix) || strings.HasPrefix(image, prefix)) {
+			longest = prefix
+		}
+	}
+
+	if longest != "" {
+		if strings.HasPrefix(image, longest) {
+			return relocation.Mappings[longest] + strings.TrimPrefix(image, longest)
+		}
+
+		return relocation.Mappings[longest] + strings.TrimPrefix(fullName, longest)
+	}
+
+	if relocation.Registry == "" {
+		return image
+	}
+
+	return relocation.Registry + "/" + strings.TrimPrefix(fullName, reference.Domain(named)+"/")
+}
+
+// true if the field holds an image, such as a container's image or OpenUnison's activemq_image
+func isImageKey(key string) bool {
+	return key == "image" || strings.HasSuffix(key, "_image")
+}
+
+// a helm post-renderer that rewrites images and adds the image pull secret, recording each image it relocated
+type imagePostRenderer struct {
+	relocation ImageRelocation
+	relocated  map[string]string
+
+	// the release's namespace, for objects that don't set one
+	namespace string
+	// makes sure the pull secret is in a namespace, returning false if it can't be used there
+	setupPullSecret func(namespace string) (bool, error)
+	// the namespaces the pull secret can be used in
+	pullSecretNamespaces map[string]bool
+}
+
+func (relocation ImageRelocation) postRenderer(namespace string, setupPullSecret func(namespace string) (bool, error)) *imagePostRenderer {
+	return &imagePostRenderer{
+		relocation:           relocation,
+		relocated:            map[string]string{},
+		namespace:            namespace,
+		setupPullSecret:      setupPullSecret,
+		pullSecretNamespaces: map[string]bool{},
+	}
+}
+
+func (renderer *imagePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	decoder := yaml.NewDecoder(renderedManifests)
+	out := new(bytes.Buffer)
+
+	for {
+		obj := make(map[string]interface{})
+		err := decoder.Decode(&obj)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(obj) == 0 {
+			continue
+		}
+
+		renderer.relocateImages(obj)
+
+		if renderer.relocation.PullSecretName != "" {
+			err = renderer.addPullSecret(obj)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := marshalManifest(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+
+	return out, nil
+}
+
+func (renderer *imagePostRenderer) relocateImages(node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			if image, ok := value.(string); ok && isImageKey(key) && image != "" {
+				relocated := renderer.relocation.relocate(image)
+				if relocated != image {
+					renderer.relocated[image] = relocated
+					n[key] = relocated
+				}
+			} else {
+				renderer.relocateImages(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range n {
+			renderer.relocateImages(value)
+		}
+	}
+}
+
+// adds the pull secret to pod specs, and to OpenUnison so the operator adds it to the pods it creates, in the
+// namespaces the pull secret is in
+func (renderer *imagePostRenderer) addPullSecret(obj map[string]interface{}) error {
+	kind, _ := obj["kind"].(string)
+
+	var path []string
+
+	switch kind {
+	case "Pod":
+		path = []string{"spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		path = []string{"spec", "template", "spec"}
+	case "CronJob":
+		path = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	case "OpenUnison":
+		spec, ok := obj["spec"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		deploymentData, ok := spec["deployment_data"].(map[string]interface{})
+		if ok {
+			if pullSecret, _ := deploymentData["pull_secret"].(string); pullSecret != "" {
+				return nil
+			}
+		}
+
+		available, err := renderer.pullSecretAvailable(obj)
+		if err != nil || !available {
+			return err
+		}
+
+		if deploymentData == nil {
+			deploymentData = make(map[string]interface{})
+			spec["deployment_data"] = deploymentData
+		}
+
+		deploymentData["pull_secret"] = renderer.relocation.PullSecretName
+
+		return nil
+	default:
+		return nil
+	}
+
+	var current interface{} = obj
+	for _, name := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		current = m[name]
+	}
+
+	podSpec, ok := current.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	pullSecrets, _ := podSpec["imagePullSecrets"].([]interface{})
+	for _, pullSecret := range pullSecrets {
+		if m, ok := pullSecret.(map[string]interface{}); ok && m["name"] == renderer.relocation.PullSecretName {
+			return nil
+		}
+	}
+
+	available, err := renderer.pullSecretAvailable(obj)
+	if err != nil || !available {
+		return err
+	}
+
+	podSpec["imagePullSecrets"] = append(pullSecrets, map[string]interface{}{"name": renderer.relocation.PullSecretName})
+
+	return nil
+}
+
+// true if the pull secret is in the object's namespace, setting it up the first time the namespace is seen
+func (renderer *imagePostRenderer) pullSecretAvailable(obj map[string]interface{}) (bool, error) {
+	namespace := renderer.namespace
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		if objNamespace, _ := metadata["namespace"].(string); objNamespace != "" {
+			namespace = objNamespace
+		}
+	}
+
+	if renderer.setupPullSecret == nil {
+		return true, nil
+	}
+
+	available, found := renderer.pullSecretNamespaces[namespace]
+	if found {
+		return available, nil
+	}
+
+	available, err := renderer.setupPullSecret(namespace)
+	if err != nil {
+		return false, err
+	}
+
+	renderer.pullSecretNamespaces[namespace] = available
+
+	return available, nil
+}
+
+// creates the image pull secret from the docker config in the namespace.  Without a docker config the secret named by
+// --image-pull-secret-name has to already be in every namespace.  If the secret can't be read or created in the
+// namespace, such as on the control plane with an integration account, it isn't added to the namespace's pods
+func (ou *OpenUnisonDeployment) setupImagePullSecret(namespace string) (bool, error) {
+	if ou.imageRelocation.DockerConfigPath == "" {
+		return true, nil
+	}
+
+	dockerConfig, err := os.ReadFile(ou.imageRelocation.DockerConfigPath)
+	if err != nil {
+		return false, err
+	}
+
+	var current *v1.Secret
+	secret, err := ou.clientset.CoreV1().Secrets(namespace).Get(context.TODO(), ou.imageRelocation.PullSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ou.imageRelocation.PullSecretName,
+				Namespace: namespace,
+			},
+		}
+	} else if apierrors.IsForbidden(err) {
+		fmt.Printf("Can't read the image pull secret %s in %s, not adding it to the namespace's pods\n", ou.imageRelocation.PullSecretName, namespace)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else {
+		if secret.Type == v1.SecretTypeDockerConfigJson && bytes.Equal(secret.Data[v1.DockerConfigJsonKey], dockerConfig) {
+			return true, nil
+		}
+
+		current = secret.DeepCopy()
+	}
+
+	secret.Type = v1.SecretTypeDockerConfigJson
+	secret.Data = map[string][]byte{v1.DockerConfigJsonKey: dockerConfig}
+
+	err = ou.saveSecret(ou.satelateContextName, secret, current, nil)
+	if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+		fmt.Printf("Can't create the image pull secret %s in %s, not adding it to the namespace's pods: %v\n", ou.imageRelocation.PullSecretName, namespace, err)
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// records the images relocated in a release so the private registry can be checked against what's deployed
+func (ou *OpenUnisonDeployment) recordImageRelocation(name string, renderer *imagePostRenderer) error {
+	if len(renderer.relocated) == 0 {
+		return nil
+	}
+
+	images := make([]string, 0)
+	for image := range renderer.relocated {
+		images = append(images, image)
+	}
+
+	sort.Strings(images)
+
+	var mapping strings.Builder
+	for _, image := range images {
+		mapping.WriteString(image + ": " + renderer.relocated[image] + "\n")
+	}
+
+	configMaps := ou.clientset.CoreV1().ConfigMaps(ou.namespace)
+
+	configMap, err := configMaps.Get(context.TODO(), imageRelocationConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      imageRelocationConfigMap,
+				Namespace: ou.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "ouctl",
+				},
+			},
+			Data: map[string]string{name: mapping.String()},
+		}
+
+		_, err = configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+
+	configMap.Data[name] = mapping.String()
+
+	_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,191 @@
+package openunison
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRelocate(t *testing.T) {
+	relocation := ImageRelocation{
+		Registry: "mirror.example.com",
+		Mappings: map[string]string{
+			"ghcr.io/tremolosecurity/":                        "mirror.example.com/tremolo/",
+			"ghcr.io/tremolosecurity/openunison-k8s":          "mirror.example.com/ou/openunison",
+			"docker.io/library/busybox":                       "mirror.example.com/base/busybox",
+			"quay.io/jetstack/cert-manager-controller:v1.1.0": "mirror.example.com/pinned/cert-manager-controller:v1.1.0",
+		},
+	}
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		// the longest matching prefix wins
+		{image: "ghcr.io/tremolosecurity/openunison-k8s:1.0.42", expected: "mirror.example.com/ou/openunison:1.0.42"},
+		{image: "ghcr.io/tremolosecurity/activemq-docker:latest", expected: "mirror.example.com/tremolo/activemq-docker:latest"},
+		// images are matched after being normalized
+		{image: "busybox", expected: "mirror.example.com/base/busybox"},
+		{image: "busybox:1.36", expected: "mirror.example.com/base/busybox:1.36"},
+		{image: "library/busybox@sha256:" + strings.Repeat("a", 64), expected: "mirror.example.com/base/busybox@sha256:" + strings.Repeat("a", 64)},
+		{image: "quay.io/jetstack/cert-manager-controller:v1.1.0", expected: "mirror.example.com/pinned/cert-manager-controller:v1.1.0"},
+		// everything else is moved to the registry, keeping its path
+		{image: "nginx:1.25", expected: "mirror.example.com/library/nginx:1.25"},
+		{image: "registry.k8s.io/ingress-nginx/controller:v1.9.0", expected: "mirror.example.com/ingress-nginx/controller:v1.9.0"},
+		{image: "localhost:5000/tools/kubectl", expected: "mirror.example.com/tools/kubectl"},
+		// invalid references are left alone
+		{image: "{{ .Values.image }}", expected: "{{ .Values.image }}"},
+		{image: "Invalid/Image", expected: "Invalid/Image"},
+	}
+
+	for _, test := range tests {
+		if relocated := relocation.relocate(test.image); relocated != test.expected {
+			t.Errorf("%s was relocated to %s, expected %s", test.image, relocated, test.expected)
+		}
+	}
+
+	withoutRegistry := ImageRelocation{Mappings: map[string]string{"docker.io/library/": "mirror.example.com/library/"}}
+	if relocated := withoutRegistry.relocate("quay.io/jetstack/cert-manager-webhook:v1.1.0"); relocated != "quay.io/jetstack/cert-manager-webhook:v1.1.0" {
+		t.Errorf("an unmapped image was relocated to %s without a registry", relocated)
+	}
+
+	if relocated := withoutRegistry.relocate("nginx"); relocated != "mirror.example.com/library/nginx" {
+		t.Errorf("nginx was relocated to %s", relocated)
+	}
+}
+
+const testRenderedManifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: openunison-operator
+spec:
+  template:
+    spec:
+      containers:
+      - name: operator
+        image: ghcr.io/tremolosecurity/openunison-k8s-operator:latest
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: check-certs
+  namespace: other
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          imagePullSecrets:
+          - name: existing
+          containers:
+          - name: check
+            image: busybox
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: forbidden
+  namespace: control-plane
+spec:
+  containers:
+  - name: pod
+    image: busybox
+---
+apiVersion: openunison.tremolo.io/v6
+kind: OpenUnison
+metadata:
+  name: orchestra
+spec:
+  image: ghcr.io/tremolosecurity/openunison-k8s:latest
+  activemq_image: ghcr.io/tremolosecurity/activemq-docker:latest
+`
+
+func TestImagePostRenderer(t *testing.T) {
+	relocation := ImageRelocation{Registry: "mirror.example.com", Mappings: map[string]string{}, PullSecretName: "mirror-pull"}
+
+	setupCalls := make([]string, 0)
+	setupPullSecret := func(namespace string) (bool, error) {
+		setupCalls = append(setupCalls, namespace)
+		return namespace != "control-plane", nil
+	}
+
+	renderer := relocation.postRenderer("openunison", setupPullSecret)
+
+	out, err := renderer.Run(bytes.NewBufferString(testRenderedManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs := make(map[string]map[string]interface{})
+	decoder := yaml.NewDecoder(out)
+	for {
+		obj := make(map[string]interface{})
+		if decoder.Decode(&obj) != nil {
+			break
+		}
+
+		objs[obj["kind"].(string)] = obj
+	}
+
+	pullSecrets := func(kind string, path ...string) []string {
+		var current interface{} = objs[kind]
+		for _, name := range path {
+			current = current.(map[string]interface{})[name]
+		}
+
+		names := make([]string, 0)
+		pullSecrets, _ := current.(map[string]interface{})["imagePullSecrets"].([]interface{})
+		for _, pullSecret := range pullSecrets {
+			names = append(names, pullSecret.(map[string]interface{})["name"].(string))
+		}
+
+		return names
+	}
+
+	if names := pullSecrets("Deployment", "spec", "template", "spec"); !reflect.DeepEqual(names, []string{"mirror-pull"}) {
+		t.Errorf("the Deployment in the release's namespace has pull secrets %v", names)
+	}
+
+	if names := pullSecrets("CronJob", "spec", "jobTemplate", "spec", "template", "spec"); !reflect.DeepEqual(names, []string{"existing", "mirror-pull"}) {
+		t.Errorf("the CronJob in another namespace has pull secrets %v", names)
+	}
+
+	if names := pullSecrets("Pod", "spec"); len(names) != 0 {
+		t.Errorf("the pull secret was added in a namespace it couldn't be created in: %v", names)
+	}
+
+	spec := objs["OpenUnison"]["spec"].(map[string]interface{})
+	if pullSecret := spec["deployment_data"].(map[string]interface{})["pull_secret"]; pullSecret != "mirror-pull" {
+		t.Errorf("OpenUnison's pull_secret is %v", pullSecret)
+	}
+
+	if spec["activemq_image"] != "mirror.example.com/tremolosecurity/activemq-docker:latest" {
+		t.Errorf("activemq_image is %v", spec["activemq_image"])
+	}
+
+	// each namespace is set up once
+	if !reflect.DeepEqual(setupCalls, []string{"openunison", "other", "control-plane"}) {
+		t.Errorf("the pull secret was set up in %v", setupCalls)
+	}
+
+	if renderer.relocated["busybox"] != "mirror.example.com/library/busybox" || len(renderer.relocated) != 4 {
+		t.Errorf("recorded %v", renderer.relocated)
+	}
+}
+
+func TestImagePostRendererSetupError(t *testing.T) {
+	relocation := ImageRelocation{Mappings: map[string]string{}, PullSecretName: "mirror-pull"}
+
+	renderer := relocation.postRenderer("openunison", func(namespace string) (bool, error) {
+		return false, fmt.Errorf("could not read the docker config")
+	})
+
+	_, err := renderer.Run(bytes.NewBufferString(testRenderedManifests))
+	if err == nil || !strings.Contains(err.Error(), "could not read the docker config") {
+		t.Fatalf("expected the pull secret's error, got %v", err)
+	}
+}
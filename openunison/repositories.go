@@ -0,0 +1,189 @@
+package openunison
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// the repository the default charts are in
+	TremoloRepoName       = "tremolo"
+	DefaultTremoloRepoURL = "https://nexus.tremolo.io/repository/helm/"
+)
+
+// configures the Tremolo repository and how helm repositories are connected to
+type RepositoryOptions struct {
+	// if set, the Tremolo repository is added with, or changed to, this url
+	URL string
+
+	Username string
+	// a path or secret source for the password
+	PasswordPath string
+
+	CaFile                string
+	CertFile              string
+	KeyFile               string
+	InsecureSkipTLSVerify bool
+}
+
+// adds the credentials and TLS options to the options charts are located with
+func (options RepositoryOptions) apply(chartPathOptions *action.ChartPathOptions) error {
+	if options.Username != "" {
+		if options.PasswordPath == "" {
+			return fmt.Errorf("a repository username requires a password")
+		}
+
+		password, err := readSecret(options.PasswordPath)
+		if err != nil {
+			return fmt.Errorf("could not read the repository password: %v", err)
+		}
+
+		chartPathOptions.Username = options.Username
+		chartPathOptions.Password = string(password)
+	}
+
+	chartPathOptions.CaFile = options.CaFile
+	chartPathOptions.CertFile = options.CertFile
+	chartPathOptions.KeyFile = options.KeyFile
+	chartPathOptions.InsecureSkipTLSverify = options.InsecureSkipTLSVerify
+
+	return nil
+}
+
+// true if the chart is referenced as repository/chart instead of a path or url
+func isRepositoryChart(chartName string) bool {
+	if strings.Contains(chartName, "://") || filepath.IsAbs(chartName) || strings.HasPrefix(chartName, ".") || !strings.Contains(chartName, "/") {
+		return false
+	}
+
+	// helm prefers local paths
+	_, err := os.Stat(chartName)
+	return err != nil
+}
+
+// makes sure the chart's repository is configured and has an index, adding the Tremolo repository if it's missing
+func (ou *OpenUnisonDeployment) ensureRepository(chartName string, settings *cli.EnvSettings) error {
+	if !isRepositoryChart(chartName) {
+		return nil
+	}
+
+	repoName, _, _ := strings.Cut(chartName, "/")
+
+	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	if errors.Is(err, fs.ErrNotExist) {
+		repoFile = repo.NewFile()
+	} else if err != nil {
+		return fmt.Errorf("could not load helm repositories from %s: %v", settings.RepositoryConfig, err)
+	}
+
+	entry := repoFile.Get(repoName)
+
+	if entry == nil {
+		if repoName != TremoloRepoName {
+			return fmt.Errorf("helm repository %s for chart %s isn't configured, add it with 'helm repo add %s <url>'", repoName, chartName, repoName)
+		}
+
+		entry = &repo.Entry{Name: TremoloRepoName, URL: DefaultTremoloRepoURL}
+		if ou.repositoryOptions.URL != "" {
+			entry.URL = ou.repositoryOptions.URL
+		}
+
+		fmt.Printf("Adding helm repository %s, %s\n", entry.Name, entry.URL)
+	} else if repoName == TremoloRepoName && ou.repositoryOptions.URL != "" && strings.TrimSuffix(entry.URL, "/") != strings.TrimSuffix(ou.repositoryOptions.URL, "/") {
+		fmt.Printf("Changing helm repository %s from %s to %s\n", entry.Name, entry.URL, ou.repositoryOptions.URL)
+		entry.URL = ou.repositoryOptions.URL
+	} else {
+		// already configured, only download the index if it's never been downloaded
+		if _, err := os.Stat(filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(repoName))); err == nil {
+			return nil
+		}
+
+		return ou.updateRepository(repoName, settings)
+	}
+
+	// TLS options are saved with the repository the same as 'helm repo add', credentials are only used for this run
+	entry.CAFile = ou.repositoryOptions.CaFile
+	entry.CertFile = ou.repositoryOptions.CertFile
+	entry.KeyFile = ou.repositoryOptions.KeyFile
+	entry.InsecureSkipTLSverify = ou.repositoryOptions.InsecureSkipTLSVerify
+
+	repoFile.Update(entry)
+
+	err = os.MkdirAll(filepath.Dir(settings.RepositoryConfig), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = repoFile.WriteFile(settings.RepositoryConfig, 0644)
+	if err != nil {
+		return err
+	}
+
+	return ou.updateRepository(repoName, settings)
+}
+
+// downloads the repository's index, once per run
+func (ou *OpenUnisonDeployment) updateRepository(repoName string, settings *cli.EnvSettings) error {
+	if ou.updatedRepositories[repoName] {
+		return nil
+	}
+
+	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	if err != nil {
+		return fmt.Errorf("could not load helm repositories from %s: %v", settings.RepositoryConfig, err)
+	}
+
+	entry := repoFile.Get(repoName)
+	if entry == nil {
+		return fmt.Errorf("helm repository %s isn't configured", repoName)
+	}
+
+	if ou.repositoryOptions.Username != "" {
+		password, err := readSecret(ou.repositoryOptions.PasswordPath)
+		if err != nil {
+			return fmt.Errorf("could not read the repository password: %v", err)
+		}
+
+		entry.Username = ou.repositoryOptions.Username
+		entry.Password = string(password)
+	}
+
+	if ou.repositoryOptions.CaFile != "" {
+		entry.CAFile = ou.repositoryOptions.CaFile
+	}
+
+	if ou.repositoryOptions.CertFile != "" {
+		entry.CertFile = ou.repositoryOptions.CertFile
+		entry.KeyFile = ou.repositoryOptions.KeyFile
+	}
+
+	entry.InsecureSkipTLSverify = entry.InsecureSkipTLSverify || ou.repositoryOptions.InsecureSkipTLSVerify
+
+	chartRepo, err := repo.NewChartRepository(entry, getter.All(settings))
+	if err != nil {
+		return err
+	}
+
+	chartRepo.CachePath = settings.RepositoryCache
+
+	fmt.Printf("Downloading the index of helm repository %s, %s\n", entry.Name, entry.URL)
+
+	_, err = chartRepo.DownloadIndexFile()
+	if err != nil {
+		return fmt.Errorf("could not download the index of helm repository %s from %s: %v", entry.Name, entry.URL, err)
+	}
+
+	ou.updatedRepositories[repoName] = true
+
+	return nil
+}
@@ -0,0 +1,557 @@
+package openunison
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Secrets are created and updated with the Kubernetes API
+	SecretOutputApi = "api"
+	// Secrets are written as SealedSecrets, encrypted offline with the controller's certificate
+	SecretOutputSealedSecret = "sealedsecret"
+	// Secrets are written as ExternalSecrets that reference a secret store
+	SecretOutputExternalSecret = "externalsecret"
+)
+
+// configures how the Secrets ouctl manages are written
+type SecretOutput struct {
+	Mode      string
+	OutputDir string
+
+	SealedSecretsCertPath string
+
+	ExternalSecretStore     string
+	ExternalSecretStoreKind string
+	// the remote key, {cluster}, {namespace} and {name} are replaced
+	ExternalSecretKeyPath string
+	// if set, values that need to be added to the secret store are written to a file per property, in a directory per
+	// remote key.  Required when ouctl generates a value, since it can't be recovered any other way
+	ExternalSecretValuesDir string
+}
+
+// checks that the options needed for the mode are set
+func (output SecretOutput) Validate() error {
+	switch output.Mode {
+	case "", SecretOutputApi:
+		return nil
+	case SecretOutputSealedSecret:
+		if output.SealedSecretsCertPath == "" {
+			return fmt.Errorf("--sealed-secrets-cert is required when the secret output is %s", SecretOutputSealedSecret)
+		}
+	case SecretOutputExternalSecret:
+		if output.ExternalSecretStore == "" {
+			return fmt.Errorf("--external-secret-store is required when the secret output is %s", SecretOutputExternalSecret)
+		}
+	default:
+		return fmt.Errorf("unknown secret output %s, must be one of %s, %s or %s", output.Mode, SecretOutputApi, SecretOutputSealedSecret, SecretOutputExternalSecret)
+	}
+
+	return nil
+}
+
+// true if Secrets are written with the Kubernetes API
+func (output SecretOutput) IsApi() bool {
+	return output.Mode == "" || output.Mode == SecretOutputApi
+}
+
+// the file a Secret's manifest is written to, cluster is the kubectl context the Secret belongs to and may be empty
+func (output SecretOutput) manifestPath(cluster string, namespace string, name string) string {
+	fileName := namespace + "-" + name + "-" + output.Mode + ".yaml"
+	if cluster != "" {
+		fileName = cluster + "-" + fileName
+	}
+
+	return filepath.Join(output.OutputDir, fileName)
+}
+
+// the keys already stored in a previously generated manifest
+func (output SecretOutput) existingKeys(cluster string, namespace string, name string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+
+	if output.IsApi() {
+		return keys, nil
+	}
+
+	manifest, err := output.loadManifest(cluster, namespace, name)
+	if err != nil || manifest == nil {
+		return keys, err
+	}
+
+	spec, _ := manifest["spec"].(map[string]interface{})
+
+	if output.Mode == SecretOutputSealedSecret {
+		encryptedData, _ := spec["encryptedData"].(map[string]interface{})
+		for key := range encryptedData {
+			keys[key] = true
+		}
+	} else {
+		data, _ := spec["data"].([]interface{})
+		for _, d := range data {
+			if entry, ok := d.(map[string]interface{}); ok {
+				if secretKey, ok := entry["secretKey"].(string); ok {
+					keys[secretKey] = true
+				}
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+func (output SecretOutput) loadManifest(cluster string, namespace string, name string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(output.manifestPath(cluster, namespace, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (output SecretOutput) writeManifest(cluster string, namespace string, name string, manifest map[string]interface{}) error {
+	data, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(output.OutputDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	path := output.manifestPath(cluster, namespace, name)
+	fmt.Printf("Writing %s\n", path)
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// marshals a Kubernetes manifest to YAML with the usual two space indent
+func marshalManifest(manifest interface{}) ([]byte, error) {
+	var out bytes.Buffer
+
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// writes a secret, current is the Secret as it was read from the cluster or nil if it doesn't exist.  cluster is the
+// kubectl context the Secret belongs to and is only used to name manifests.  generated are the keys ouctl generated
+// values for, which only exist in memory until they're saved
+func (ou *OpenUnisonDeployment) saveSecret(cluster string, secret *v1.Secret, current *v1.Secret, generated []string) error {
+	var err error
+
+	switch ou.secretOutput.Mode {
+	case SecretOutputSealedSecret:
+		err = ou.secretOutput.writeSealedSecret(cluster, secret, current)
+	case SecretOutputExternalSecret:
+		err = ou.secretOutput.writeExternalSecret(cluster, secret, current, generated)
+	default:
+		if current == nil {
+			fmt.Printf("Creating secret %s\n", secret.Name)
+			_, err = ou.clientset.CoreV1().Secrets(secret.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+		} else {
+			fmt.Printf("Updating secret %s\n", secret.Name)
+			_, err = ou.clientset.CoreV1().Secrets(secret.Namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+		}
+	}
+
+	return err
+}
+
+// true if the key's value is the same as what's in the cluster
+func unchangedSecretKey(key string, secret *v1.Secret, current *v1.Secret) bool {
+	if current == nil {
+		return false
+	}
+
+	currentValue, ok := current.Data[key]
+	return ok && bytes.Equal(currentValue, secret.Data[key])
+}
+
+// the annotation on a SealedSecret with a digest of each sealed value, so a value that hasn't changed can be found
+// without the cluster's Secret, which doesn't exist yet with GitOps
+const sealedValueDigestsAnnotation = "ouctl.openunison.tremolo.io/sealed-value-digests"
+
+// a salted argon2id digest of a sealed value, slow to compute so the digests in the manifest don't make guessing
+// low entropy values any easier than it would be with the value's length
+func sealedValueDigest(salt []byte, value []byte) string {
+	digest := argon2.IDKey(value, salt, 1, 64*1024, 4, 32)
+	return base64.StdEncoding.EncodeToString(append(append([]byte{}, salt...), digest...))
+}
+
+func newSealedValueDigest(value []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	return sealedValueDigest(salt, value), nil
+}
+
+// true if the digest was made from the value
+func sealedValueMatches(digest string, value []byte) bool {
+	data, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil || len(data) != 16+32 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(sealedValueDigest(data[:16], value)), []byte(digest)) == 1
+}
+
+// writes a SealedSecret, keys already sealed are kept unless their value changed so re-runs don't produce new
+// ciphertext.  A value is unchanged if it matches the digest recorded in the manifest, or the cluster's Secret for
+// manifests from before digests were recorded
+func (output SecretOutput) writeSealedSecret(cluster string, secret *v1.Secret, current *v1.Secret) error {
+	publicKey, err := loadSealedSecretsKey(output.SealedSecretsCertPath)
+	if err != nil {
+		return err
+	}
+
+	encryptedData := make(map[string]interface{})
+	digests := make(map[string]string)
+
+	manifest, err := output.loadManifest(cluster, secret.Namespace, secret.Name)
+	if err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		spec, _ := manifest["spec"].(map[string]interface{})
+		if existing, ok := spec["encryptedData"].(map[string]interface{}); ok {
+			encryptedData = existing
+		}
+
+		metadata, _ := manifest["metadata"].(map[string]interface{})
+		annotations, _ := metadata["annotations"].(map[string]interface{})
+		if existing, ok := annotations[sealedValueDigestsAnnotation].(string); ok {
+			err = json.Unmarshal([]byte(existing), &digests)
+			if err != nil {
+				return fmt.Errorf("could not parse %s on %s: %v", sealedValueDigestsAnnotation, output.manifestPath(cluster, secret.Namespace, secret.Name), err)
+			}
+		}
+	}
+
+	// strict scope, the SealedSecret can only be unsealed with this name in this namespace
+	label := []byte(secret.Namespace + "/" + secret.Name)
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := secret.Data[key]
+
+		if _, sealed := encryptedData[key]; sealed {
+			digest, recorded := digests[key]
+
+			if recorded && sealedValueMatches(digest, value) {
+				continue
+			}
+
+			if !recorded && unchangedSecretKey(key, secret, current) {
+				digests[key], err = newSealedValueDigest(value)
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+		}
+
+		ciphertext, err := hybridEncrypt(rand.Reader, publicKey, value, label)
+		if err != nil {
+			return err
+		}
+
+		encryptedData[key] = base64.StdEncoding.EncodeToString(ciphertext)
+
+		digests[key], err = newSealedValueDigest(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	digestsJSON, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+
+	secretType := secret.Type
+	if secretType == "" {
+		secretType = v1.SecretTypeOpaque
+	}
+
+	manifest = map[string]interface{}{
+		"apiVersion": "bitnami.com/v1alpha1",
+		"kind":       "SealedSecret",
+		"metadata": map[string]interface{}{
+			"name":      secret.Name,
+			"namespace": secret.Namespace,
+			"annotations": map[string]interface{}{
+				sealedValueDigestsAnnotation: string(digestsJSON),
+			},
+		},
+		"spec": map[string]interface{}{
+			"encryptedData": encryptedData,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":      secret.Name,
+					"namespace": secret.Namespace,
+				},
+				"type": string(secretType),
+			},
+		},
+	}
+
+	// annotations are added to the Secret the controller creates
+	if len(secret.Annotations) > 0 {
+		spec := manifest["spec"].(map[string]interface{})
+		templateMetadata := spec["template"].(map[string]interface{})["metadata"].(map[string]interface{})
+		templateMetadata["annotations"] = secret.Annotations
+	}
+
+	return output.writeManifest(cluster, secret.Namespace, secret.Name, manifest)
+}
+
+// loads the public key from the sealed secrets controller's certificate
+func loadSealedSecretsKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate in %s", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the certificate in %s doesn't have an RSA public key", path)
+	}
+
+	return publicKey, nil
+}
+
+// encrypts the same way as kubeseal, a random AES-GCM session key encrypted with RSA-OAEP and prefixed with its length
+func hybridEncrypt(rnd io.Reader, publicKey *rsa.PublicKey, plaintext []byte, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := io.ReadFull(rnd, sessionKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aed, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rnd, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+
+	// the session key is only used once, so a zero nonce is safe
+	zeroNonce := make([]byte, aed.NonceSize())
+
+	return aed.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
+
+// the remote key for a Secret in the secret store
+func (output SecretOutput) externalSecretKey(cluster string, namespace string, name string) string {
+	keyPath := output.ExternalSecretKeyPath
+	if keyPath == "" {
+		keyPath = "{cluster}/{namespace}/{name}"
+	}
+
+	keyPath = strings.NewReplacer("{cluster}", cluster, "{namespace}", namespace, "{name}", name).Replace(keyPath)
+
+	// an empty placeholder shouldn't leave an empty path segment
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(keyPath, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// writes an ExternalSecret with a property for every key.  The values can't be written to the store by ouctl, so
+// the keys that need to be added or updated are listed and written to ExternalSecretValuesDir.  Generated values
+// would be lost without ExternalSecretValuesDir, so it's an error if they need to be stored and it isn't set
+func (output SecretOutput) writeExternalSecret(cluster string, secret *v1.Secret, current *v1.Secret, generated []string) error {
+	existingKeys, err := output.existingKeys(cluster, secret.Namespace, secret.Name)
+	if err != nil {
+		return err
+	}
+
+	remoteKey := output.externalSecretKey(cluster, secret.Namespace, secret.Name)
+
+	keys := make([]string, 0)
+	for key := range existingKeys {
+		keys = append(keys, key)
+	}
+
+	toStore := make([]string, 0)
+	for key := range secret.Data {
+		if !existingKeys[key] {
+			keys = append(keys, key)
+		}
+
+		if !unchangedSecretKey(key, secret, current) {
+			toStore = append(toStore, key)
+		}
+	}
+
+	sort.Strings(keys)
+	sort.Strings(toStore)
+
+	if output.ExternalSecretValuesDir == "" {
+		lost := make([]string, 0)
+		for _, key := range generated {
+			if _, ok := secret.Data[key]; ok && !unchangedSecretKey(key, secret, current) {
+				lost = append(lost, key)
+			}
+		}
+
+		if len(lost) > 0 {
+			sort.Strings(lost)
+			return fmt.Errorf("--external-secret-values-dir is required, ouctl generated %s for %s and the values must be added to %s", strings.Join(lost, ", "), remoteKey, output.ExternalSecretStore)
+		}
+	}
+
+	data := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		data = append(data, map[string]interface{}{
+			"secretKey": key,
+			"remoteRef": map[string]interface{}{
+				"key":      remoteKey,
+				"property": key,
+			},
+		})
+	}
+
+	storeKind := output.ExternalSecretStoreKind
+	if storeKind == "" {
+		storeKind = "SecretStore"
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "external-secrets.io/v1beta1",
+		"kind":       "ExternalSecret",
+		"metadata": map[string]interface{}{
+			"name":      secret.Name,
+			"namespace": secret.Namespace,
+		},
+		"spec": map[string]interface{}{
+			"refreshInterval": "1h",
+			"secretStoreRef": map[string]interface{}{
+				"name": output.ExternalSecretStore,
+				"kind": storeKind,
+			},
+			"target": map[string]interface{}{
+				"name":           secret.Name,
+				"creationPolicy": "Owner",
+			},
+			"data": data,
+		},
+	}
+
+	// annotations are added to the Secret the operator creates
+	if len(secret.Annotations) > 0 {
+		target := manifest["spec"].(map[string]interface{})["target"].(map[string]interface{})
+		target["template"] = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": secret.Annotations,
+			},
+		}
+	}
+
+	err = output.writeManifest(cluster, secret.Namespace, secret.Name, manifest)
+	if err != nil {
+		return err
+	}
+
+	if len(toStore) == 0 {
+		return nil
+	}
+
+	fmt.Printf("The following properties of %s in %s must be set before %s can be synced: %s\n", remoteKey, output.ExternalSecretStore, secret.Name, strings.Join(toStore, ", "))
+
+	if output.ExternalSecretValuesDir != "" {
+		// each value is written as is to its own file, so nothing needs to be unescaped before it's stored
+		valuesDir := filepath.Join(output.ExternalSecretValuesDir, strings.ReplaceAll(remoteKey, "/", "-"))
+		err = os.MkdirAll(valuesDir, 0700)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("WARNING: writing the plaintext values for %s to %s, readable only by you.  Delete them once they're added to %s\n", remoteKey, valuesDir, output.ExternalSecretStore)
+
+		for _, key := range toStore {
+			err = os.WriteFile(filepath.Join(valuesDir, key), secret.Data[key], 0600)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package openunison
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// a sealed secrets controller key and the path to its certificate
+func sealedSecretsKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sealed-secret"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, certPath
+}
+
+// decrypts the way the sealed secrets controller does
+func hybridDecrypt(privateKey *rsa.PrivateKey, ciphertext []byte, label []byte) ([]byte, error) {
+	rsaLen := int(binary.BigEndian.Uint16(ciphertext))
+	rsaCiphertext := ciphertext[2 : 2+rsaLen]
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, rsaCiphertext, label)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aed, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return aed.Open(nil, make([]byte, aed.NonceSize()), ciphertext[2+rsaLen:], nil)
+}
+
+func sealedData(t *testing.T, output SecretOutput) map[string]string {
+	t.Helper()
+
+	manifest, err := output.loadManifest("satelite", "openunison", "orchestra-secrets-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedData := manifest["spec"].(map[string]interface{})["encryptedData"].(map[string]interface{})
+
+	sealed := make(map[string]string)
+	for key, value := range encryptedData {
+		sealed[key] = value.(string)
+	}
+
+	return sealed
+}
+
+func TestWriteSealedSecret(t *testing.T) {
+	privateKey, certPath := sealedSecretsKey(t)
+
+	output := SecretOutput{Mode: SecretOutputSealedSecret, OutputDir: t.TempDir(), SealedSecretsCertPath: certPath}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "orchestra-secrets-source", Namespace: "openunison"},
+		Data: map[string][]byte{
+			"K8S_DB_SECRET":      []byte("start123"),
+			"OIDC_CLIENT_SECRET": []byte("secret"),
+		},
+	}
+
+	err := output.writeSealedSecret("satelite", secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := sealedData(t, output)
+
+	for key, value := range secret.Data {
+		ciphertext, err := base64.StdEncoding.DecodeString(sealed[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plaintext, err := hybridDecrypt(privateKey, ciphertext, []byte("openunison/orchestra-secrets-source"))
+		if err != nil {
+			t.Fatalf("could not unseal %s: %v", key, err)
+		}
+
+		if string(plaintext) != string(value) {
+			t.Errorf("%s unsealed to %q, expected %q", key, plaintext, value)
+		}
+
+		// strict scope, another name or namespace can't unseal it
+		for _, label := range []string{"other/orchestra-secrets-source", "openunison/other", ""} {
+			if _, err := hybridDecrypt(privateKey, ciphertext, []byte(label)); err == nil {
+				t.Errorf("%s was unsealed with the scope %q", key, label)
+			}
+		}
+	}
+
+	// without the cluster's Secret, unchanged values are found from the manifest's digests
+	err = output.writeSealedSecret("satelite", secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resealed := sealedData(t, output)
+	for key := range secret.Data {
+		if resealed[key] != sealed[key] {
+			t.Errorf("%s was sealed again though it didn't change", key)
+		}
+	}
+
+	secret.Data["OIDC_CLIENT_SECRET"] = []byte("rotated")
+
+	err = output.writeSealedSecret("satelite", secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := sealedData(t, output)
+	if rotated["K8S_DB_SECRET"] != sealed["K8S_DB_SECRET"] {
+		t.Error("K8S_DB_SECRET was sealed again though it didn't change")
+	}
+
+	ciphertext, _ := base64.StdEncoding.DecodeString(rotated["OIDC_CLIENT_SECRET"])
+	plaintext, err := hybridDecrypt(privateKey, ciphertext, []byte("openunison/orchestra-secrets-source"))
+	if err != nil || string(plaintext) != "rotated" {
+		t.Errorf("the changed OIDC_CLIENT_SECRET unsealed to %q, %v", plaintext, err)
+	}
+}
+
+func TestSealedValueDigest(t *testing.T) {
+	digest, err := newSealedValueDigest([]byte("start123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sealedValueMatches(digest, []byte("start123")) {
+		t.Error("the digest doesn't match its value")
+	}
+
+	if sealedValueMatches(digest, []byte("start124")) {
+		t.Error("the digest matches another value")
+	}
+
+	other, err := newSealedValueDigest([]byte("start123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other == digest {
+		t.Error("digests of the same value aren't salted")
+	}
+
+	if sealedValueMatches("bm90IGEgZGlnZXN0", []byte("start123")) {
+		t.Error("a malformed digest matches")
+	}
+}
@@ -0,0 +1,116 @@
+package openunison
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maps a section of the values.yaml to the key it needs in orchestra-secrets-source
+type SecretRequirement struct {
+	// the section in values.yaml, nested sections are separated with a '.'
+	Section string
+	// the key in orchestra-secrets-source, empty if the section doesn't need a secret
+	Key string
+	// true if the section configures how users authenticate, at least one is required
+	Authentication bool
+	// the flag that sets the key, used in error messages
+	Flag string
+	// if set, decides if the key is required instead of whether the section is in the values
+	Required func(helmValues map[string]interface{}) bool
+}
+
+// the known sections that need secrets, in order of precedence for -s.  The database and smtp passwords are required
+// whenever provisioning is enabled, even if the section isn't in the values
+var secretRequirements = []SecretRequirement{
+	{Section: "oidc", Key: "OIDC_CLIENT_SECRET", Authentication: true},
+	{Section: "github", Key: "GITHUB_SECRET_ID", Authentication: true},
+	{Section: "active_directory", Key: "AD_BIND_PASSWORD", Authentication: true},
+	{Section: "saml", Authentication: true},
+	{Section: "database", Key: "OU_JDBC_PASSWORD", Flag: "-b or --database-secret-path", Required: isNaasFromHelm},
+	{Section: "smtp", Key: "SMTP_PASSWORD", Flag: "-t or --smtp-secret-path", Required: isNaasFromHelm},
+}
+
+// adds a section that needs a secret, so new authentication and integration sections are validated by setupSecret.
+// Registered authentication sections come after the built in ones for -s
+func RegisterSecretRequirement(requirement SecretRequirement) error {
+	if requirement.Section == "" {
+		return fmt.Errorf("a secret requirement needs a section")
+	}
+
+	for _, existing := range secretRequirements {
+		if existing.Section == requirement.Section {
+			return fmt.Errorf("the %s section already has a secret requirement", requirement.Section)
+		}
+
+		if requirement.Key != "" && existing.Key == requirement.Key {
+			return fmt.Errorf("%s is already required by the %s section", requirement.Key, existing.Section)
+		}
+	}
+
+	secretRequirements = append(secretRequirements, requirement)
+
+	return nil
+}
+
+// true if the section is in the values
+func hasSection(helmValues map[string]interface{}, section string) bool {
+	var current interface{} = helmValues
+
+	for _, name := range strings.Split(section, ".") {
+		values, ok := current.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		current, ok = values[name]
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// returns the requirements for every configured section, failing if no authentication is configured
+func requiredSecrets(helmValues map[string]interface{}) ([]SecretRequirement, error) {
+	required := make([]SecretRequirement, 0)
+	foundAuth := false
+	authSections := make([]string, 0)
+
+	for _, requirement := range secretRequirements {
+		if requirement.Authentication {
+			authSections = append(authSections, requirement.Section)
+		}
+
+		if requirement.Required != nil {
+			if !requirement.Required(helmValues) {
+				continue
+			}
+		} else if !hasSection(helmValues, requirement.Section) {
+			continue
+		}
+
+		if requirement.Authentication {
+			foundAuth = true
+		}
+
+		required = append(required, requirement)
+	}
+
+	if !foundAuth {
+		return nil, fmt.Errorf("No authentication found, one of %s required", strings.Join(authSections, ", "))
+	}
+
+	return required, nil
+}
+
+// the authentication key set by -s, the first configured authentication section that needs a secret
+func primaryAuthSecretKey(required []SecretRequirement) string {
+	for _, requirement := range required {
+		if requirement.Authentication && requirement.Key != "" {
+			return requirement.Key
+		}
+	}
+
+	return ""
+}
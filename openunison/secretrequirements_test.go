@@ -0,0 +1,165 @@
+package openunison
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func requirementKeys(required []SecretRequirement) []string {
+	keys := make([]string, 0)
+	for _, requirement := range required {
+		keys = append(keys, requirement.Section+"="+requirement.Key)
+	}
+
+	return keys
+}
+
+func TestRequiredSecrets(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     map[string]interface{}
+		expected   []string
+		primaryKey string
+		err        string
+	}{
+		{
+			name:       "oidc",
+			values:     map[string]interface{}{"oidc": map[string]interface{}{}},
+			expected:   []string{"oidc=OIDC_CLIENT_SECRET"},
+			primaryKey: "OIDC_CLIENT_SECRET",
+		},
+		{
+			name:       "oidc with active directory for groups",
+			values:     map[string]interface{}{"active_directory": map[string]interface{}{}, "oidc": map[string]interface{}{}},
+			expected:   []string{"oidc=OIDC_CLIENT_SECRET", "active_directory=AD_BIND_PASSWORD"},
+			primaryKey: "OIDC_CLIENT_SECRET",
+		},
+		{
+			name:       "saml doesn't need a secret",
+			values:     map[string]interface{}{"saml": map[string]interface{}{}, "github": map[string]interface{}{}},
+			expected:   []string{"github=GITHUB_SECRET_ID", "saml="},
+			primaryKey: "GITHUB_SECRET_ID",
+		},
+		{
+			name:     "only saml",
+			values:   map[string]interface{}{"saml": map[string]interface{}{}},
+			expected: []string{"saml="},
+		},
+		{
+			name: "provisioning without database or smtp sections",
+			values: map[string]interface{}{
+				"active_directory": map[string]interface{}{},
+				"openunison":       map[string]interface{}{"enable_provisioning": true},
+			},
+			expected:   []string{"active_directory=AD_BIND_PASSWORD", "database=OU_JDBC_PASSWORD", "smtp=SMTP_PASSWORD"},
+			primaryKey: "AD_BIND_PASSWORD",
+		},
+		{
+			name: "database and smtp sections without provisioning",
+			values: map[string]interface{}{
+				"oidc":       map[string]interface{}{},
+				"database":   map[string]interface{}{},
+				"smtp":       map[string]interface{}{},
+				"openunison": map[string]interface{}{"enable_provisioning": false},
+			},
+			expected:   []string{"oidc=OIDC_CLIENT_SECRET"},
+			primaryKey: "OIDC_CLIENT_SECRET",
+		},
+		{
+			name:   "no authentication",
+			values: map[string]interface{}{"database": map[string]interface{}{}, "openunison": map[string]interface{}{}},
+			err:    "one of oidc, github, active_directory, saml required",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			required, err := requiredSecrets(test.values)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if keys := requirementKeys(required); !reflect.DeepEqual(keys, test.expected) {
+				t.Errorf("required %v, expected %v", keys, test.expected)
+			}
+
+			if primaryKey := primaryAuthSecretKey(required); primaryKey != test.primaryKey {
+				t.Errorf("-s sets %q, expected %q", primaryKey, test.primaryKey)
+			}
+		})
+	}
+}
+
+func TestRegisterSecretRequirement(t *testing.T) {
+	builtIn := secretRequirements
+	t.Cleanup(func() {
+		secretRequirements = builtIn
+	})
+
+	secretRequirements = append([]SecretRequirement{}, builtIn...)
+
+	err := RegisterSecretRequirement(SecretRequirement{Section: "ldap.bind", Key: "LDAP_BIND_PASSWORD", Authentication: true, Flag: "--secret LDAP_BIND_PASSWORD=source"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RegisterSecretRequirement(SecretRequirement{Section: "scim", Key: "SCIM_TOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a nested section is only required when it's in the values
+	required, err := requiredSecrets(map[string]interface{}{"ldap": map[string]interface{}{"bind": map[string]interface{}{}}, "scim": "enabled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := requirementKeys(required); !reflect.DeepEqual(keys, []string{"ldap.bind=LDAP_BIND_PASSWORD", "scim=SCIM_TOKEN"}) {
+		t.Errorf("required %v", keys)
+	}
+
+	if primaryKey := primaryAuthSecretKey(required); primaryKey != "LDAP_BIND_PASSWORD" {
+		t.Errorf("-s sets %q", primaryKey)
+	}
+
+	// built in authentication sections come first for -s
+	required, err = requiredSecrets(map[string]interface{}{"ldap": map[string]interface{}{"bind": map[string]interface{}{}}, "github": map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if primaryKey := primaryAuthSecretKey(required); primaryKey != "GITHUB_SECRET_ID" {
+		t.Errorf("-s sets %q, expected GITHUB_SECRET_ID", primaryKey)
+	}
+
+	_, err = requiredSecrets(map[string]interface{}{"ldap": map[string]interface{}{}})
+	if err == nil || !strings.Contains(err.Error(), "saml, ldap.bind required") {
+		t.Errorf("expected the registered section in the error, got %v", err)
+	}
+
+	errorTests := []struct {
+		requirement SecretRequirement
+		err         string
+	}{
+		{requirement: SecretRequirement{Key: "NO_SECTION"}, err: "needs a section"},
+		{requirement: SecretRequirement{Section: "oidc", Key: "OTHER_SECRET"}, err: "the oidc section already has"},
+		{requirement: SecretRequirement{Section: "okta", Key: "OIDC_CLIENT_SECRET"}, err: "OIDC_CLIENT_SECRET is already required by the oidc section"},
+	}
+
+	for _, test := range errorTests {
+		err := RegisterSecretRequirement(test.requirement)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected an error containing %q, got %v", test.err, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package openunison
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+
+// named character sets that can be used by a SecretPolicy
+var secretCharsets = map[string]string{
+	"alphanumeric": alphanumeric,
+	// symbols that are safe in env vars, properties files and yaml without quoting
+	"alphanumeric-symbols": alphanumeric + "-_.~+=",
+	"hex":                  "0123456789abcdef",
+}
+
+// the shortest secret a policy is allowed to generate
+const minSecretLength = 16
+
+// describes how generated secrets are created and audited
+type SecretPolicy struct {
+	Length  int
+	Charset string
+}
+
+// creates a secret policy, charset is either a named set (alphanumeric, alphanumeric-symbols, hex) or the literal characters to use
+func NewSecretPolicy(length int, charset string) (SecretPolicy, error) {
+	if length < minSecretLength {
+		return SecretPolicy{}, fmt.Errorf("secret length must be at least %d, got %d", minSecretLength, length)
+	}
+
+	chars, ok := secretCharsets[charset]
+	if !ok {
+		chars = uniqueChars(charset)
+	}
+
+	if len([]rune(chars)) < 16 {
+		return SecretPolicy{}, fmt.Errorf("secret charset '%s' must be one of %s or contain at least 16 unique characters", charset, strings.Join(secretCharsetNames(), ", "))
+	}
+
+	return SecretPolicy{Length: length, Charset: chars}, nil
+}
+
+// generates a new secret using crypto/rand
+func (policy SecretPolicy) Generate() (string, error) {
+	chars := []rune(policy.Charset)
+	max := big.NewInt(int64(len(chars)))
+
+	b := make([]rune, policy.Length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("could not generate secret: %v", err)
+		}
+
+		b[i] = chars[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
+// returns the reasons a secret doesn't meet the policy, empty if it does
+func (policy SecretPolicy) Check(secret []byte) []string {
+	problems := make([]string, 0)
+	value := []rune(string(secret))
+
+	if len(value) < policy.Length {
+		problems = append(problems, fmt.Sprintf("length %d is less than %d", len(value), policy.Length))
+	}
+
+	invalid := make(map[rune]bool)
+	for _, c := range value {
+		if !strings.ContainsRune(policy.Charset, c) {
+			invalid[c] = true
+		}
+	}
+
+	if len(invalid) > 0 {
+		problems = append(problems, fmt.Sprintf("%d character(s) outside of the allowed charset", len(invalid)))
+	}
+
+	return problems
+}
+
+func uniqueChars(chars string) string {
+	seen := make(map[rune]bool)
+	var b strings.Builder
+
+	for _, c := range chars {
+		if !seen[c] {
+			seen[c] = true
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+func secretCharsetNames() []string {
+	names := make([]string, 0, len(secretCharsets))
+	for name := range secretCharsets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// true if the key in orchestra-secrets-source is generated by ouctl instead of supplied by the user
+func isGeneratedSecretKey(key string) bool {
+	return key == "unisonKeystorePassword" || key == "K8S_DB_SECRET" || isSateliteSecretKey(key)
+}
+
+// true if the key is a client secret generated for a satelite
+func isSateliteSecretKey(key string) bool {
+	return strings.HasPrefix(key, "cluster-idp-")
+}
+
+// true if OpenUnison has to be redeployed to use a new value for the key
+func requiresRedeploy(key string) bool {
+	return key == "unisonKeystorePassword" || key == "K8S_DB_SECRET"
+}
+
+const (
+	// labels backups with the Secret they're a copy of, so they can be pruned
+	secretBackupLabel = "ouctl.openunison.tremolo.io/backup-of"
+	// set on OpenUnison objects when their secrets are regenerated, so the operator redeploys them
+	secretsRegeneratedAnnotation = "ouctl.openunison.tremolo.io/secrets-regenerated"
+)
+
+// the result of checking a single generated secret against the policy
+type SecretAuditResult struct {
+	Key         string
+	Problems    []string
+	Regenerated bool
+}
+
+// audits the generated secrets in a secrets source Secret
+type SecretAudit struct {
+	namespace  string
+	secretName string
+	policy     SecretPolicy
+	// the number of backups to keep, 0 keeps all of them
+	keepBackups int
+
+	clientset  kubernetes.Interface
+	restConfig *rest.Config
+	// created when OpenUnison is redeployed, since the control plane's satelite secrets don't need it
+	openunisons *openUnisonClient
+}
+
+// creates a new audit of the generated secrets stored in secretName, keeping the newest keepBackups backups
+func NewSecretAudit(namespace string, secretName string, policy SecretPolicy, keepBackups int) (*SecretAudit, error) {
+	if keepBackups < 0 {
+		return nil, fmt.Errorf("the number of backups to keep can't be negative")
+	}
+
+	restConfig, err := loadRestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretAudit{
+		namespace:   namespace,
+		secretName:  secretName,
+		policy:      policy,
+		keepBackups: keepBackups,
+		clientset:   clientset,
+		restConfig:  restConfig,
+	}, nil
+}
+
+// checks every generated key, if regenerate is true non-compliant keys are replaced.  Satelite client secrets are only replaced when includeSatelites is true
+func (audit *SecretAudit) Run(regenerate bool, includeSatelites bool) ([]SecretAuditResult, error) {
+	secret, err := audit.clientset.CoreV1().Secrets(audit.namespace).Get(context.TODO(), audit.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for key := range secret.Data {
+		if isGeneratedSecretKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	results := make([]SecretAuditResult, 0, len(keys))
+	toRegenerate := make([]string, 0)
+
+	for _, key := range keys {
+		result := SecretAuditResult{Key: key, Problems: audit.policy.Check(secret.Data[key])}
+
+		if len(result.Problems) > 0 && regenerate && (includeSatelites || !isSateliteSecretKey(key)) {
+			toRegenerate = append(toRegenerate, key)
+			result.Regenerated = true
+		}
+
+		results = append(results, result)
+	}
+
+	if len(toRegenerate) == 0 {
+		return results, nil
+	}
+
+	// keep a copy of the current values so the change can be rolled back
+	backup := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      audit.secretName + "-backup-" + strconv.FormatInt(time.Now().Unix(), 10),
+			Namespace: audit.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "ouctl",
+				secretBackupLabel:              audit.secretName,
+			},
+		},
+		Data: secret.Data,
+		Type: secret.Type,
+	}
+
+	fmt.Printf("Backing up %s to %s\n", audit.secretName, backup.Name)
+	_, err = audit.clientset.CoreV1().Secrets(audit.namespace).Create(context.TODO(), backup, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range toRegenerate {
+		value, err := audit.policy.Generate()
+		if err != nil {
+			return nil, err
+		}
+
+		secret.Data[key] = []byte(value)
+	}
+
+	// the resource version from the read is kept so a concurrent change fails instead of being overwritten
+	_, err = audit.clientset.CoreV1().Secrets(audit.namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = audit.pruneBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range toRegenerate {
+		if requiresRedeploy(key) {
+			return results, audit.redeploy()
+		}
+	}
+
+	return results, nil
+}
+
+// deletes all but the newest keepBackups backups of the Secret
+func (audit *SecretAudit) pruneBackups() error {
+	if audit.keepBackups == 0 {
+		return nil
+	}
+
+	backups, err := audit.clientset.CoreV1().Secrets(audit.namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: secretBackupLabel + "=" + audit.secretName,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the name ends with when the backup was made
+	backupTime := func(backup v1.Secret) int64 {
+		timestamp, _ := strconv.ParseInt(strings.TrimPrefix(backup.Name, audit.secretName+"-backup-"), 10, 64)
+		return timestamp
+	}
+
+	items := backups.Items
+	sort.Slice(items, func(i, j int) bool {
+		return backupTime(items[i]) > backupTime(items[j])
+	})
+
+	for i := audit.keepBackups; i < len(items); i++ {
+		fmt.Printf("Deleting backup %s\n", items[i].Name)
+
+		err = audit.clientset.CoreV1().Secrets(audit.namespace).Delete(context.TODO(), items[i].Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the operator only reads the secret when an OpenUnison object changes, so every OpenUnison using the Secret is
+// annotated for the operator to regenerate its configuration and its deployment is restarted
+func (audit *SecretAudit) redeploy() error {
+	if audit.openunisons == nil {
+		openunisons, err := newOpenUnisonClient(audit.restConfig)
+		if err != nil {
+			return fmt.Errorf("could not redeploy OpenUnison, redeploy it to use the regenerated secrets: %v", err)
+		}
+
+		audit.openunisons = openunisons
+	}
+
+	openunisons, err := audit.openunisons.list(audit.namespace)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	redeployed := 0
+
+	for _, openunison := range openunisons {
+		if openunison.Spec == nil || openunison.Spec.SourceSecret != audit.secretName {
+			continue
+		}
+
+		fmt.Printf("Redeploying OpenUnison %s\n", openunison.Name)
+
+		patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, secretsRegeneratedAnnotation, now)
+		_, err = audit.openunisons.patch(audit.namespace, openunison.Name, types.MergePatchType, []byte(patch))
+		if err != nil {
+			return err
+		}
+
+		// the same annotation kubectl rollout restart sets
+		deploymentName := "openunison-" + openunison.Name
+		patch = fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, now)
+
+		_, err = audit.clientset.AppsV1().Deployments(audit.namespace).Patch(context.TODO(), deploymentName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+		if apierrors.IsNotFound(err) {
+			fmt.Printf("Deployment %s not found, the operator will create it\n", deploymentName)
+		} else if err != nil {
+			return err
+		} else {
+			fmt.Printf("Restarted %s\n", deploymentName)
+		}
+
+		redeployed++
+	}
+
+	if redeployed == 0 {
+		fmt.Printf("No OpenUnison in %s uses %s, redeploy OpenUnison to use the regenerated secrets\n", audit.namespace, audit.secretName)
+	}
+
+	return nil
+}
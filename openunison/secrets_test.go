@@ -0,0 +1,304 @@
+package openunison
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewSecretPolicy(t *testing.T) {
+	tests := []struct {
+		length  int
+		charset string
+		chars   string
+		err     string
+	}{
+		{length: 64, charset: "alphanumeric", chars: alphanumeric},
+		{length: 16, charset: "hex", chars: "0123456789abcdef"},
+		{length: 32, charset: "alphanumeric-symbols", chars: alphanumeric + "-_.~+="},
+		// duplicates in a literal charset don't make secrets weaker
+		{length: 32, charset: "aabbccddeeffgghhiijjkkllmmnnoopp", chars: "abcdefghijklmnop"},
+		{length: 32, charset: "äöüßéèêáàâíìîóòô", chars: "äöüßéèêáàâíìîóòô"},
+		{length: 15, charset: "alphanumeric", err: "must be at least 16"},
+		{length: 32, charset: "aabbccddeeffgghhiijjkkllmmnnoo", err: "at least 16 unique characters"},
+		{length: 32, charset: "base64", err: "must be one of alphanumeric, alphanumeric-symbols, hex"},
+	}
+
+	for _, test := range tests {
+		policy, err := NewSecretPolicy(test.length, test.charset)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%d %s: expected an error containing %q, got %v", test.length, test.charset, test.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d %s: %v", test.length, test.charset, err)
+			continue
+		}
+
+		if policy.Length != test.length || policy.Charset != test.chars {
+			t.Errorf("%d %s: policy is %+v", test.length, test.charset, policy)
+		}
+	}
+}
+
+func TestSecretPolicyGenerate(t *testing.T) {
+	for _, charset := range []string{"alphanumeric", "hex", "äöüßéèêáàâíìîóòô"} {
+		policy, err := NewSecretPolicy(32, charset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[string]bool)
+
+		for i := 0; i < 20; i++ {
+			secret, err := policy.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len([]rune(secret)) != 32 {
+				t.Errorf("%s: generated %d characters", charset, len([]rune(secret)))
+			}
+
+			if problems := policy.Check([]byte(secret)); len(problems) > 0 {
+				t.Errorf("%s: a generated secret doesn't meet its policy: %v", charset, problems)
+			}
+
+			if seen[secret] {
+				t.Errorf("%s: generated %s twice", charset, secret)
+			}
+
+			seen[secret] = true
+		}
+	}
+}
+
+func TestSecretPolicyCheck(t *testing.T) {
+	policy, err := NewSecretPolicy(16, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		secret   string
+		problems []string
+	}{
+		{secret: "0123456789abcdef", problems: []string{}},
+		{secret: "0123456789abcdef0123", problems: []string{}},
+		{secret: "0123", problems: []string{"length 4 is less than 16"}},
+		{secret: "0123456789ABCDEF", problems: []string{"6 character(s) outside of the allowed charset"}},
+		{secret: "xyz", problems: []string{"length 3 is less than 16", "3 character(s) outside of the allowed charset"}},
+		// characters, not bytes, are counted
+		{secret: "ééééééééééééééé", problems: []string{"length 15 is less than 16", "1 character(s) outside of the allowed charset"}},
+	}
+
+	for _, test := range tests {
+		if problems := policy.Check([]byte(test.secret)); !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: problems are %v, expected %v", test.secret, problems, test.problems)
+		}
+	}
+}
+
+func secretBackup(name string, backupOf string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "openunison",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "ouctl", secretBackupLabel: backupOf},
+		},
+	}
+}
+
+func TestSecretAuditRegenerate(t *testing.T) {
+	policy, err := NewSecretPolicy(32, "alphanumeric")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "orchestra-secrets-source", Namespace: "openunison"},
+			Data: map[string][]byte{
+				"unisonKeystorePassword": []byte("start123"),
+				"K8S_DB_SECRET":          []byte("abcdefghijklmnopqrstuvwxyz0123456789"),
+				"cluster-idp-satelite":   []byte("short"),
+				"OIDC_CLIENT_SECRET":     []byte("secret"),
+			},
+		},
+		secretBackup("orchestra-secrets-source-backup-100", "orchestra-secrets-source"),
+		secretBackup("orchestra-secrets-source-backup-200", "orchestra-secrets-source"),
+		secretBackup("other-backup-50", "other"),
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "openunison-orchestra", Namespace: "openunison"}},
+	)
+
+	gvr := schema.GroupVersionResource{Group: openUnisonGroup, Version: "v6", Resource: openUnisonResource}
+
+	other := openUnisonUnstructured("v6", map[string]interface{}{"source_secret": "other"})
+	other.SetName("other")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "OpenUnisonList"},
+		openUnisonUnstructured("v6", map[string]interface{}{"source_secret": "orchestra-secrets-source"}),
+		other,
+	)
+
+	audit := &SecretAudit{
+		namespace:   "openunison",
+		secretName:  "orchestra-secrets-source",
+		policy:      policy,
+		keepBackups: 2,
+		clientset:   clientset,
+		openunisons: &openUnisonClient{resource: dynamicClient.Resource(gvr), version: "v6"},
+	}
+
+	results, err := audit.Run(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SecretAuditResult{
+		{Key: "K8S_DB_SECRET", Problems: []string{}},
+		{Key: "cluster-idp-satelite", Problems: []string{"length 5 is less than 32"}},
+		{Key: "unisonKeystorePassword", Problems: []string{"length 8 is less than 32"}, Regenerated: true},
+	}
+
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("results are %+v, expected %+v", results, expected)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("openunison").Get(context.TODO(), "orchestra-secrets-source", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(policy.Check(secret.Data["unisonKeystorePassword"])) > 0 {
+		t.Errorf("unisonKeystorePassword wasn't regenerated: %s", secret.Data["unisonKeystorePassword"])
+	}
+
+	// only generated keys that fail the policy are changed, satelite secrets need --include-satelites
+	for key, value := range map[string]string{"K8S_DB_SECRET": "abcdefghijklmnopqrstuvwxyz0123456789", "cluster-idp-satelite": "short", "OIDC_CLIENT_SECRET": "secret"} {
+		if string(secret.Data[key]) != value {
+			t.Errorf("%s was changed to %s", key, secret.Data[key])
+		}
+	}
+
+	secrets, err := clientset.CoreV1().Secrets("openunison").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	var backup *v1.Secret
+	for i, item := range secrets.Items {
+		names = append(names, item.Name)
+
+		if strings.HasPrefix(item.Name, "orchestra-secrets-source-backup-") && item.Name != "orchestra-secrets-source-backup-200" {
+			backup = &secrets.Items[i]
+		}
+	}
+
+	sort.Strings(names)
+
+	// the oldest backup is pruned, backups of other Secrets are left alone
+	if len(names) != 4 || names[0] != "orchestra-secrets-source" || names[2] != "orchestra-secrets-source-backup-200" || names[3] != "other-backup-50" || backup == nil {
+		t.Fatalf("the Secrets are %v", names)
+	}
+
+	if backup.Labels[secretBackupLabel] != "orchestra-secrets-source" || string(backup.Data["unisonKeystorePassword"]) != "start123" {
+		t.Errorf("the backup is %+v", backup)
+	}
+
+	orchestra, err := dynamicClient.Resource(gvr).Namespace("openunison").Get(context.TODO(), "orchestra", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if orchestra.GetAnnotations()[secretsRegeneratedAnnotation] == "" {
+		t.Error("the OpenUnison using the Secret wasn't annotated for the operator")
+	}
+
+	otherOpenUnison, err := dynamicClient.Resource(gvr).Namespace("openunison").Get(context.TODO(), "other", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := otherOpenUnison.GetAnnotations()[secretsRegeneratedAnnotation]; found {
+		t.Error("an OpenUnison using another Secret was annotated")
+	}
+
+	deployment, err := clientset.AppsV1().Deployments("openunison").Get(context.TODO(), "openunison-orchestra", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deployment.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] == "" {
+		t.Error("the deployment wasn't restarted")
+	}
+}
+
+func TestSecretAuditSateliteSecrets(t *testing.T) {
+	policy, err := NewSecretPolicy(32, "alphanumeric")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: SateliteClientSecretName, Namespace: "openunison"},
+		Data:       map[string][]byte{"cluster-idp-satelite": []byte("short")},
+	})
+
+	// no OpenUnison client, satelite client secrets don't need a redeploy
+	audit := &SecretAudit{namespace: "openunison", secretName: SateliteClientSecretName, policy: policy, clientset: clientset}
+
+	results, err := audit.Run(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Regenerated {
+		t.Errorf("results without --regenerate are %+v", results)
+	}
+
+	results, err = audit.Run(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || !results[0].Regenerated {
+		t.Errorf("results are %+v", results)
+	}
+
+	secret, err := clientset.CoreV1().Secrets("openunison").Get(context.TODO(), SateliteClientSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(policy.Check(secret.Data["cluster-idp-satelite"])) > 0 {
+		t.Errorf("the satelite's client secret wasn't regenerated: %s", secret.Data["cluster-idp-satelite"])
+	}
+
+	// keepBackups 0 keeps every backup
+	backups, err := clientset.CoreV1().Secrets("openunison").List(context.TODO(), metav1.ListOptions{LabelSelector: secretBackupLabel + "=" + SateliteClientSecretName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups.Items) != 1 {
+		t.Errorf("%d backups were made", len(backups.Items))
+	}
+}
@@ -0,0 +1,134 @@
+package openunison
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reads a secrets file from a secret source, such as a path or '-' for stdin, into a map of keys for
+// orchestra-secrets-source.  The file may either be a flat YAML map or a dotenv file
+func loadSecretsFile(ref string) (map[string][]byte, error) {
+	source, err := ParseSecretSource(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Loading secrets from %s...\n", source)
+
+	data, err := source.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := parseSecrets(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse secrets from %s: %v", source, err)
+	}
+
+	fmt.Printf("...loaded %d secrets\n", len(secrets))
+
+	return secrets, nil
+}
+
+// parses secrets as YAML, falling back to dotenv when the data isn't a YAML map.  Values are used exactly as written,
+// so number-like secrets such as 012 or 0x1F aren't converted
+func parseSecrets(data []byte) (map[string][]byte, error) {
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(data, doc)
+
+	if err == nil && doc.Kind == 0 {
+		return map[string][]byte{}, nil
+	}
+
+	if err == nil && len(doc.Content) == 1 && doc.Content[0].Kind == yaml.MappingNode && !hasDotEnvKeys(doc.Content[0]) {
+		secrets := make(map[string][]byte)
+		mapping := doc.Content[0]
+
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			key := mapping.Content[i].Value
+			value := mapping.Content[i+1]
+
+			if value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+
+			if value.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("value for %s must be a string", key)
+			}
+
+			if value.Tag == "!!null" {
+				return nil, fmt.Errorf("no value for %s", key)
+			}
+
+			secrets[key] = []byte(value.Value)
+		}
+
+		return secrets, nil
+	}
+
+	return parseDotEnv(data)
+}
+
+// a dotenv line with a colon in the value can parse as YAML, but its key will still contain the =
+func hasDotEnvKeys(mapping *yaml.Node) bool {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if strings.Contains(mapping.Content[i].Value, "=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parses KEY=VALUE lines, values may be single or double quoted.  Blank lines, lines starting with # and an
+// export prefix are ignored
+func parseDotEnv(data []byte) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+
+		if !found || key == "" {
+			return nil, fmt.Errorf("line %d is not in KEY=VALUE format", lineNumber)
+		}
+
+		value = strings.TrimSpace(value)
+
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d has an invalid quoted value: %v", lineNumber, err)
+			}
+
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+
+		secrets[key] = []byte(value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
@@ -0,0 +1,253 @@
+package openunison
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/google/shlex"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// a location a credential can be read from
+type SecretSource interface {
+	Read() ([]byte, error)
+	String() string
+}
+
+// parses a secret source reference:
+//
+//	env:VAR                          - an environment variable
+//	file:path                        - a file, '-' reads stdin
+//	exec:command                     - the stdout of a credential helper
+//	k8s:context/namespace/name/key   - a key in a Secret, an empty context uses the context that was current when
+//	                                   ouctl started, even after ouctl switches contexts
+//
+// anything without a prefix is treated as a path to a file.  An unknown prefix is an error, so a misspelled source
+// isn't read as a path, unless the whole reference is a file that exists or the prefix is a Windows drive letter
+func ParseSecretSource(ref string) (SecretSource, error) {
+	scheme, value, found := strings.Cut(ref, ":")
+
+	if !found {
+		return &fileSecretSource{path: ref}, nil
+	}
+
+	switch scheme {
+	case "env":
+		if value == "" {
+			return nil, fmt.Errorf("no environment variable in %s", ref)
+		}
+
+		return &envSecretSource{name: value}, nil
+	case "file":
+		return &fileSecretSource{path: value}, nil
+	case "exec":
+		args, err := shlex.Split(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse command in %s: %v", ref, err)
+		}
+
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no command in %s", ref)
+		}
+
+		return &execSecretSource{args: args}, nil
+	case "k8s":
+		// context names may contain a '/', so the namespace, name and key are taken from the end
+		parts := strings.Split(value, "/")
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("%s must be in the form k8s:context/namespace/name/key", ref)
+		}
+
+		n := len(parts)
+
+		return &kubernetesSecretSource{
+			context:   strings.Join(parts[0:n-3], "/"),
+			namespace: parts[n-3],
+			name:      parts[n-2],
+			key:       parts[n-1],
+		}, nil
+	default:
+		if len(scheme) == 1 {
+			return &fileSecretSource{path: ref}, nil
+		}
+
+		if _, err := os.Stat(ref); err == nil {
+			return &fileSecretSource{path: ref}, nil
+		}
+
+		return nil, fmt.Errorf("unknown secret source %s: in %s, use env:, file:, exec: or k8s:, or file:%s for a path", scheme, ref, ref)
+	}
+}
+
+// reads a single credential from a secret source reference, removing surrounding whitespace
+func readSecret(ref string) ([]byte, error) {
+	source, err := ParseSecretSource(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return readSecretSource(source)
+}
+
+// reads a single credential from a parsed secret source, removing surrounding whitespace
+func readSecretSource(source SecretSource) ([]byte, error) {
+	secret, err := source.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(secret), nil
+}
+
+type envSecretSource struct {
+	name string
+}
+
+func (source *envSecretSource) Read() ([]byte, error) {
+	value, ok := os.LookupEnv(source.name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", source.name)
+	}
+
+	return []byte(value), nil
+}
+
+func (source *envSecretSource) String() string {
+	return "env:" + source.name
+}
+
+type fileSecretSource struct {
+	path string
+}
+
+// SOPS encrypted files are decrypted
+func (source *fileSecretSource) Read() ([]byte, error) {
+	var data []byte
+	var err error
+
+	if source.path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(source.path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err = decryptSops(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %s: %v", source, err)
+	}
+
+	return data, nil
+}
+
+func (source *fileSecretSource) String() string {
+	if source.path == "-" {
+		return "stdin"
+	}
+
+	return source.path
+}
+
+// the terminal credential helpers can prompt on
+var terminalPath = "/dev/tty"
+
+type execSecretSource struct {
+	args []string
+}
+
+// credential helpers don't share ouctl's stdin, which may be the secrets file from --secrets -.  They can prompt on
+// the terminal, if there is one, otherwise their stdin is empty
+func (source *execSecretSource) Read() ([]byte, error) {
+	cmd := exec.Command(source.args[0], source.args[1:]...)
+
+	if terminal, err := os.Open(terminalPath); err == nil {
+		defer terminal.Close()
+		cmd.Stdin = terminal
+	}
+
+	// credential helpers may log, only stdout is the secret
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run %s: %v", source.args[0], err)
+	}
+
+	return out, nil
+}
+
+func (source *execSecretSource) String() string {
+	return "exec:" + source.args[0]
+}
+
+var startupContextName string
+var startupContextOnce sync.Once
+
+// records the kubeconfig's current context before ouctl switches to another context, so k8s: sources without a
+// context always read from the cluster the user started with
+func recordStartupContext() string {
+	startupContextOnce.Do(func() {
+		curCfg, err := clientcmd.NewDefaultPathOptions().GetStartingConfig()
+		if err == nil {
+			startupContextName = curCfg.CurrentContext
+		}
+	})
+
+	return startupContextName
+}
+
+type kubernetesSecretSource struct {
+	context   string
+	namespace string
+	name      string
+	key       string
+}
+
+func (source *kubernetesSecretSource) Read() ([]byte, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	contextName := source.context
+	if contextName == "" {
+		contextName = recordStartupContext()
+	}
+
+	configOverrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+
+	config, err := kubeConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := clientset.CoreV1().Secrets(source.namespace).Get(context.TODO(), source.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := secret.Data[source.key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in Secret %s/%s", source.key, source.namespace, source.name)
+	}
+
+	return value, nil
+}
+
+func (source *kubernetesSecretSource) String() string {
+	return fmt.Sprintf("k8s:%s/%s/%s/%s", source.context, source.namespace, source.name, source.key)
+}
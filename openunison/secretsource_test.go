@@ -0,0 +1,111 @@
+package openunison
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSecretSource(t *testing.T) {
+	dir := t.TempDir()
+
+	// a path with a ':' that isn't a source
+	colonPath := filepath.Join(dir, "client:secret")
+	err := os.WriteFile(colonPath, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref      string
+		expected SecretSource
+		err      string
+	}{
+		{ref: "/etc/ouctl/secret", expected: &fileSecretSource{path: "/etc/ouctl/secret"}},
+		{ref: "file:/etc/ouctl/a:b", expected: &fileSecretSource{path: "/etc/ouctl/a:b"}},
+		{ref: "file:-", expected: &fileSecretSource{path: "-"}},
+		{ref: "env:CLIENT_SECRET", expected: &envSecretSource{name: "CLIENT_SECRET"}},
+		{ref: "exec:vault kv get -field='client secret' secret/openunison", expected: &execSecretSource{args: []string{"vault", "kv", "get", "-field=client secret", "secret/openunison"}}},
+		{ref: "k8s:admin/cluster/openunison/orchestra-secrets-source/OIDC_CLIENT_SECRET", expected: &kubernetesSecretSource{context: "admin/cluster", namespace: "openunison", name: "orchestra-secrets-source", key: "OIDC_CLIENT_SECRET"}},
+		{ref: "k8s:/openunison/orchestra-secrets-source/OIDC_CLIENT_SECRET", expected: &kubernetesSecretSource{namespace: "openunison", name: "orchestra-secrets-source", key: "OIDC_CLIENT_SECRET"}},
+		{ref: `C:\ouctl\secret`, expected: &fileSecretSource{path: `C:\ouctl\secret`}},
+		{ref: colonPath, expected: &fileSecretSource{path: colonPath}},
+		{ref: "vualt:secret/openunison", err: "unknown secret source vualt:"},
+		{ref: filepath.Join(dir, "missing:secret"), err: "unknown secret source"},
+		{ref: "env:", err: "no environment variable"},
+		{ref: "exec:", err: "no command"},
+		{ref: "exec:vault 'unterminated", err: "could not parse command"},
+		{ref: "k8s:openunison/orchestra-secrets-source", err: "must be in the form"},
+	}
+
+	for _, test := range tests {
+		source, err := ParseSecretSource(test.ref)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.ref, test.err, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.ref, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(source, test.expected) {
+			t.Errorf("%s was parsed as %#v, expected %#v", test.ref, source, test.expected)
+		}
+	}
+}
+
+func TestExecSecretSourceStdin(t *testing.T) {
+	terminalPath = filepath.Join(t.TempDir(), "no-terminal")
+	t.Cleanup(func() {
+		terminalPath = "/dev/tty"
+	})
+
+	// stdin is the secrets file from --secrets -
+	stdin, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stdin.WriteString("OIDC_CLIENT_SECRET: from-stdin\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stdin.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = originalStdin
+	})
+
+	secret, err := readSecret("exec:sh -c 'cat; echo from-helper'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(secret) != "from-helper" {
+		t.Errorf("the credential helper read %q", secret)
+	}
+
+	// the secrets file is still there for --secrets -
+	secrets, err := readSecret("file:-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(secrets) != "OIDC_CLIENT_SECRET: from-stdin" {
+		t.Errorf("stdin had %q", secrets)
+	}
+}
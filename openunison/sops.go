@@ -0,0 +1,530 @@
+package openunison
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// a value encrypted by SOPS
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+
+// the age encrypted data keys in a SOPS dotenv file
+var sopsDotEnvAgeKey = regexp.MustCompile(`^sops_age__list_[0-9]+__map_enc$`)
+
+// decrypts a SOPS encrypted YAML, JSON or dotenv file using age identities.  If data isn't encrypted with SOPS
+// it's returned as is with encrypted set to false.  YAML and JSON documents are returned as YAML, dotenv files as
+// dotenv and SOPS binary files as the original data.
+//
+// Each value is authenticated with AES-GCM using its path in the document, and the document's MAC is verified the
+// same way sops does so values can't be removed, reordered or replaced with plaintext.
+func decryptSops(data []byte) (plaintext []byte, encrypted bool, err error) {
+	if isSopsDotEnv(data) {
+		plaintext, err = decryptSopsDotEnv(data)
+		return plaintext, true, err
+	}
+
+	doc := &yaml.Node{}
+	if yaml.Unmarshal(data, doc) != nil || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return data, false, nil
+	}
+
+	root := doc.Content[0]
+
+	metadataIndex := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" && root.Content[i+1].Kind == yaml.MappingNode {
+			metadataIndex = i
+		}
+	}
+
+	if metadataIndex < 0 {
+		return data, false, nil
+	}
+
+	metadata := sopsMetadata{}
+	err = root.Content[metadataIndex+1].Decode(&metadata)
+	if err != nil || (metadata.Mac == "" && metadata.LastModified == "") {
+		return data, false, nil
+	}
+
+	root.Content = append(root.Content[:metadataIndex], root.Content[metadataIndex+2:]...)
+
+	encryptedKeys := make([]string, 0)
+	for _, ageKey := range metadata.Age {
+		encryptedKeys = append(encryptedKeys, ageKey.Enc)
+	}
+
+	dataKey, err := decryptSopsDataKey(encryptedKeys)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// sops reads JSON numbers as floats, so they're added to the MAC the same way
+	mac := newSopsMac(metadata.MacOnlyEncrypted)
+	mac.floatNumbers = bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+
+	plaintext, err = decryptSopsDocument(doc, metadata, dataKey, mac)
+	return plaintext, true, err
+}
+
+// the parts of a document's sops metadata needed to decrypt it
+type sopsMetadata struct {
+	Mac              string `yaml:"mac"`
+	LastModified     string `yaml:"lastmodified"`
+	MacOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+	Age              []struct {
+		Enc string `yaml:"enc"`
+	} `yaml:"age"`
+
+	UnencryptedSuffix       string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix         string `yaml:"encrypted_suffix"`
+	UnencryptedRegex        string `yaml:"unencrypted_regex"`
+	EncryptedRegex          string `yaml:"encrypted_regex"`
+	UnencryptedCommentRegex string `yaml:"unencrypted_comment_regex"`
+	EncryptedCommentRegex   string `yaml:"encrypted_comment_regex"`
+}
+
+// whether sops encrypted the value at path, using the same rules it does.  known is false when the file's rules
+// depend on comments, which aren't tracked, so any value may be plaintext
+func (metadata sopsMetadata) shouldBeEncrypted(path []string) (encrypted bool, known bool) {
+	if metadata.UnencryptedCommentRegex != "" || metadata.EncryptedCommentRegex != "" {
+		return false, false
+	}
+
+	anyKey := func(matches func(key string) bool) bool {
+		for _, key := range path {
+			if matches(key) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	matchesRegex := func(expr string) func(key string) bool {
+		return func(key string) bool {
+			matched, _ := regexp.MatchString(expr, key)
+			return matched
+		}
+	}
+
+	encrypted = true
+
+	if metadata.UnencryptedSuffix != "" && anyKey(func(key string) bool { return strings.HasSuffix(key, metadata.UnencryptedSuffix) }) {
+		encrypted = false
+	}
+
+	if metadata.EncryptedSuffix != "" {
+		encrypted = anyKey(func(key string) bool { return strings.HasSuffix(key, metadata.EncryptedSuffix) })
+	}
+
+	if metadata.UnencryptedRegex != "" && anyKey(matchesRegex(metadata.UnencryptedRegex)) {
+		encrypted = false
+	}
+
+	if metadata.EncryptedRegex != "" {
+		encrypted = anyKey(matchesRegex(metadata.EncryptedRegex))
+	}
+
+	return encrypted, true
+}
+
+// decrypts a YAML or JSON document with its sops metadata removed
+func decryptSopsDocument(doc *yaml.Node, metadata sopsMetadata, dataKey []byte, mac *sopsMac) ([]byte, error) {
+	doc.HeadComment = ""
+	doc.FootComment = ""
+
+	err := decryptSopsNode(doc.Content[0], dataKey, nil, metadata, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mac.verify(metadata.Mac, metadata.LastModified, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// binary files are stored as a single data key
+	root := doc.Content[0]
+	if len(root.Content) == 2 && root.Content[0].Value == "data" && root.Content[1].Kind == yaml.ScalarNode {
+		return []byte(root.Content[1].Value), nil
+	}
+
+	return yaml.Marshal(doc)
+}
+
+func isSopsDotEnv(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "sops_mac=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decryptSopsDotEnv(data []byte) ([]byte, error) {
+	lines := make([]string, 0)
+	encryptedKeys := make([]string, 0)
+	metadata := sopsMetadata{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, _ := strings.Cut(line, "=")
+
+		switch {
+		case sopsDotEnvAgeKey.MatchString(key):
+			encryptedKeys = append(encryptedKeys, strings.ReplaceAll(value, "\\n", "\n"))
+		case key == "sops_mac":
+			metadata.Mac = value
+		case key == "sops_lastmodified":
+			metadata.LastModified = value
+		case key == "sops_mac_only_encrypted":
+			metadata.MacOnlyEncrypted = value == "true"
+		case key == "sops_unencrypted_suffix":
+			metadata.UnencryptedSuffix = value
+		case key == "sops_encrypted_suffix":
+			metadata.EncryptedSuffix = value
+		case key == "sops_unencrypted_regex":
+			metadata.UnencryptedRegex = value
+		case key == "sops_encrypted_regex":
+			metadata.EncryptedRegex = value
+		case key == "sops_unencrypted_comment_regex":
+			metadata.UnencryptedCommentRegex = value
+		case key == "sops_encrypted_comment_regex":
+			metadata.EncryptedCommentRegex = value
+		case !strings.HasPrefix(key, "sops_"):
+			lines = append(lines, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dataKey, err := decryptSopsDataKey(encryptedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := newSopsMac(metadata.MacOnlyEncrypted)
+
+	var out bytes.Buffer
+
+	for _, line := range lines {
+		key, value, found := strings.Cut(line, "=")
+
+		// encrypted comments are left out of the plaintext
+		if strings.HasPrefix(line, "#") && sopsValue.MatchString(line[1:]) {
+			continue
+		}
+
+		// comments and blank lines aren't part of the MAC
+		if found && !strings.HasPrefix(line, "#") {
+			encrypted, known := metadata.shouldBeEncrypted([]string{key})
+			if known && encrypted && !sopsValue.MatchString(value) {
+				return nil, fmt.Errorf("%s isn't encrypted, but the SOPS file says it should be", key)
+			}
+
+			if (!known || encrypted) && sopsValue.MatchString(value) {
+				decrypted, err := decryptSopsValue(value, dataKey, key+":")
+				if err != nil {
+					return nil, fmt.Errorf("could not decrypt %s: %v", key, err)
+				}
+
+				err = mac.add(decrypted, true)
+				if err != nil {
+					return nil, err
+				}
+
+				line = key + "=" + strconv.Quote(fmt.Sprintf("%v", decrypted))
+			} else {
+				err = mac.add(strings.ReplaceAll(value, "\\n", "\n"), false)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+
+	err = mac.verify(metadata.Mac, metadata.LastModified, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// decrypts every encrypted value in the document in place, in document order so the values can be added to the
+// MAC.  The additional data for each value is the path of map keys to it
+func decryptSopsNode(node *yaml.Node, dataKey []byte, path []string, metadata sopsMetadata, mac *sopsMac) error {
+	// encrypted comments are left out of the plaintext
+	node.HeadComment = ""
+	node.LineComment = ""
+	node.FootComment = ""
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		node.Style = 0
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			key.Style = 0
+			key.HeadComment = ""
+			key.LineComment = ""
+			key.FootComment = ""
+
+			err := decryptSopsNode(node.Content[i+1], dataKey, append(path, key.Value), metadata, mac)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case yaml.SequenceNode:
+		node.Style = 0
+		for _, value := range node.Content {
+			err := decryptSopsNode(value, dataKey, path, metadata, mac)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			return nil
+		}
+
+		encrypted, known := metadata.shouldBeEncrypted(path)
+		if known && encrypted && !sopsValue.MatchString(node.Value) {
+			return fmt.Errorf("%s isn't encrypted, but the SOPS file says it should be", strings.Join(path, "."))
+		}
+
+		if (known && !encrypted) || !sopsValue.MatchString(node.Value) {
+			var value interface{}
+			err := node.Decode(&value)
+			if err != nil {
+				return err
+			}
+
+			return mac.add(value, false)
+		}
+
+		decrypted, err := decryptSopsValue(node.Value, dataKey, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("could not decrypt %s: %v", strings.Join(path, "."), err)
+		}
+
+		err = mac.add(decrypted, true)
+		if err != nil {
+			return err
+		}
+
+		return node.Encode(decrypted)
+	default:
+		// sops never writes aliases
+		return fmt.Errorf("%s can't be decrypted, SOPS files don't contain aliases", strings.Join(path, "."))
+	}
+}
+
+// the known bytes sops starts the MAC with when only encrypted values are part of it
+var sopsMacOnlyEncryptedInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// the SHA-512 of a document's values, in the order they appear
+type sopsMac struct {
+	hash          hash.Hash
+	onlyEncrypted bool
+	floatNumbers  bool
+}
+
+func newSopsMac(onlyEncrypted bool) *sopsMac {
+	mac := &sopsMac{hash: sha512.New(), onlyEncrypted: onlyEncrypted}
+
+	if onlyEncrypted {
+		mac.hash.Write(sopsMacOnlyEncryptedInitialization)
+	}
+
+	return mac
+}
+
+// adds a plaintext value, formatted the way sops does
+func (mac *sopsMac) add(value interface{}, encrypted bool) error {
+	if mac.onlyEncrypted && !encrypted {
+		return nil
+	}
+
+	switch v := value.(type) {
+	case string:
+		mac.hash.Write([]byte(v))
+	case int:
+		return mac.add(int64(v), encrypted)
+	case int64:
+		if mac.floatNumbers {
+			return mac.add(float64(v), encrypted)
+		}
+
+		mac.hash.Write([]byte(strconv.FormatInt(v, 10)))
+	case uint64:
+		// only JSON files can have integers too big for an int64, YAML ones are refused by sops
+		if mac.floatNumbers {
+			return mac.add(float64(v), encrypted)
+		}
+
+		mac.hash.Write([]byte(strconv.FormatUint(v, 10)))
+	case float64:
+		mac.hash.Write([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	case bool:
+		if v {
+			mac.hash.Write([]byte("True"))
+		} else {
+			mac.hash.Write([]byte("False"))
+		}
+	default:
+		return fmt.Errorf("can't verify a SOPS value of type %T", value)
+	}
+
+	return nil
+}
+
+// decrypts the document's MAC, which is authenticated with its last modified time, and compares it to the values
+func (mac *sopsMac) verify(encryptedMac string, lastModified string, dataKey []byte) error {
+	if !sopsValue.MatchString(encryptedMac) {
+		return fmt.Errorf("the file is encrypted with SOPS but has no MAC")
+	}
+
+	modified, err := time.Parse(time.RFC3339, lastModified)
+	if err != nil {
+		return fmt.Errorf("could not parse SOPS lastmodified %s: %v", lastModified, err)
+	}
+
+	expected, err := decryptSopsValue(encryptedMac, dataKey, modified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("could not decrypt the SOPS MAC: %v", err)
+	}
+
+	computed := fmt.Sprintf("%X", mac.hash.Sum(nil))
+	if expected != computed {
+		return fmt.Errorf("the SOPS MAC doesn't match, the file was modified after it was encrypted")
+	}
+
+	return nil
+}
+
+func decryptSopsValue(value string, dataKey []byte, additionalData string) (interface{}, error) {
+	parts := sopsValue.FindStringSubmatch(value)
+
+	encryptedData, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := gcm.Open(nil, iv, append(encryptedData, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := string(decrypted)
+
+	switch parts[4] {
+	case "str", "bytes", "comment":
+		return plaintext, nil
+	case "int":
+		return strconv.Atoi(plaintext)
+	case "float":
+		return strconv.ParseFloat(plaintext, 64)
+	case "bool":
+		return strconv.ParseBool(plaintext)
+	default:
+		return nil, fmt.Errorf("unknown type %s", parts[4])
+	}
+}
+
+// decrypts the SOPS data key with the first age key that matches an identity
+func decryptSopsDataKey(encryptedKeys []string) ([]byte, error) {
+	if len(encryptedKeys) == 0 {
+		return nil, fmt.Errorf("the file is encrypted with SOPS but not with age, only age keys are supported")
+	}
+
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, encryptedKey := range encryptedKeys {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(encryptedKey)), identities...)
+		if err != nil {
+			continue
+		}
+
+		return io.ReadAll(r)
+	}
+
+	return nil, fmt.Errorf("none of the age identities can decrypt the SOPS data key")
+}
+
+// loads age identities the same way SOPS does, from SOPS_AGE_KEY, SOPS_AGE_KEY_FILE or the default keys.txt
+func loadAgeIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+
+	keyFile := os.Getenv("SOPS_AGE_KEY_FILE")
+	if keyFile == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("SOPS_AGE_KEY_FILE is not set: %v", err)
+		}
+
+		keyFile = filepath.Join(configDir, "sops", "age", "keys.txt")
+	}
+
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load age keys, set SOPS_AGE_KEY_FILE: %v", err)
+	}
+	defer f.Close()
+
+	return age.ParseIdentities(f)
+}
@@ -0,0 +1,286 @@
+package openunison
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the fixtures in testdata/sops were encrypted by sops 3.9.4 with testdata/sops/age.key
+func readSopsFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join("testdata", "sops", "age.key"))
+
+	data, err := os.ReadFile(filepath.Join("testdata", "sops", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecryptSops(t *testing.T) {
+	yamlSecrets := map[string]interface{}{
+		"K8S_DB_SECRET":          "start123",
+		"unisonKeystorePassword": "start456",
+		"replicas":               3,
+		"ratio":                  0.75,
+		"enabled":                true,
+		"serial_unencrypted":     9223372036854775807,
+		"nested": map[string]interface{}{
+			"list":     []interface{}{"one", 2},
+			"password": "with: colon",
+		},
+	}
+
+	tests := []struct {
+		fixture  string
+		expected map[string]interface{}
+	}{
+		{fixture: "secrets.yaml", expected: yamlSecrets},
+		{fixture: "mac-only-encrypted.yaml", expected: yamlSecrets},
+		{
+			fixture: "secrets.json",
+			expected: map[string]interface{}{
+				"K8S_DB_SECRET":          "start123",
+				"unisonKeystorePassword": "start456",
+				"replicas":               3,
+				"enabled":                true,
+				"serial_unencrypted":     9007199254740992,
+				"big_unencrypted":        float64(18446744073709552000),
+				"nested": map[string]interface{}{
+					"list": []interface{}{"one", 2.5},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			plaintext, encrypted, err := decryptSops(readSopsFixture(t, test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !encrypted {
+				t.Fatal("expected the fixture to be detected as encrypted")
+			}
+
+			decrypted := map[string]interface{}{}
+			err = yaml.Unmarshal(plaintext, &decrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decrypted, test.expected) {
+				t.Errorf("decrypted %v, expected %v", decrypted, test.expected)
+			}
+
+			if strings.Contains(string(plaintext), "ENC[") {
+				t.Errorf("the plaintext still has encrypted values or comments:\n%s", plaintext)
+			}
+		})
+	}
+
+	t.Run("secrets.env", func(t *testing.T) {
+		plaintext, encrypted, err := decryptSops(readSopsFixture(t, "secrets.env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "K8S_DB_SECRET=\"start123\"\nunisonKeystorePassword=\"start456\"\n"
+		if !encrypted || string(plaintext) != expected {
+			t.Errorf("decrypted %q, expected %q", plaintext, expected)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		plaintext, encrypted, err := decryptSops(readSopsFixture(t, "secrets.bin.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !encrypted || string(plaintext) != "binary\x00data\n" {
+			t.Errorf("decrypted %q", plaintext)
+		}
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		data := []byte("K8S_DB_SECRET: start123\n")
+
+		plaintext, encrypted, err := decryptSops(data)
+		if err != nil || encrypted || string(plaintext) != string(data) {
+			t.Errorf("expected plaintext to be returned as is, got %q, %v, %v", plaintext, encrypted, err)
+		}
+	})
+}
+
+func TestDecryptSopsTampered(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		tamper  func(data string) string
+		err     string
+	}{
+		{
+			name:    "unencrypted value changed",
+			fixture: "secrets.yaml",
+			tamper: func(data string) string {
+				return strings.Replace(data, "serial_unencrypted: 9223372036854775807", "serial_unencrypted: 1", 1)
+			},
+			err: "the SOPS MAC doesn't match",
+		},
+		{
+			name:    "encrypted value removed",
+			fixture: "secrets.yaml",
+			tamper: func(data string) string {
+				lines := strings.Split(data, "\n")
+				for i, line := range lines {
+					if strings.HasPrefix(line, "enabled:") {
+						lines = append(lines[:i], lines[i+1:]...)
+						break
+					}
+				}
+
+				return strings.Join(lines, "\n")
+			},
+			err: "the SOPS MAC doesn't match",
+		},
+		{
+			name:    "encrypted value moved to another key",
+			fixture: "secrets.yaml",
+			tamper: func(data string) string {
+				return strings.Replace(data, "unisonKeystorePassword:", "K8S_LDAP_PASSWORD:", 1)
+			},
+			err: "could not decrypt K8S_LDAP_PASSWORD",
+		},
+		{
+			name:    "unencrypted JSON number changed",
+			fixture: "secrets.json",
+			tamper: func(data string) string {
+				return strings.Replace(data, "9007199254740992", "9007199254740994", 1)
+			},
+			err: "the SOPS MAC doesn't match",
+		},
+		{
+			name:    "dotenv value replaced with plaintext",
+			fixture: "secrets.env",
+			tamper: func(data string) string {
+				lines := strings.Split(data, "\n")
+				for i, line := range lines {
+					if strings.HasPrefix(line, "K8S_DB_SECRET=") {
+						lines[i] = "K8S_DB_SECRET=start123"
+					}
+				}
+
+				return strings.Join(lines, "\n")
+			},
+			err: "K8S_DB_SECRET isn't encrypted",
+		},
+		{
+			name:    "value replaced with plaintext",
+			fixture: "secrets.yaml",
+			tamper: func(data string) string {
+				lines := strings.Split(data, "\n")
+				for i, line := range lines {
+					if strings.HasPrefix(line, "K8S_DB_SECRET:") {
+						lines[i] = "K8S_DB_SECRET: start123"
+					}
+				}
+
+				return strings.Join(lines, "\n")
+			},
+			err: "K8S_DB_SECRET isn't encrypted",
+		},
+		{
+			name:    "MAC of only encrypted values",
+			fixture: "mac-only-encrypted.yaml",
+			tamper: func(data string) string {
+				lines := strings.Split(data, "\n")
+				for i, line := range lines {
+					if strings.HasPrefix(line, "replicas:") {
+						lines = append(lines[:i], lines[i+1:]...)
+						break
+					}
+				}
+
+				return strings.Join(lines, "\n")
+			},
+			err: "the SOPS MAC doesn't match",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := readSopsFixture(t, test.fixture)
+
+			tampered := test.tamper(string(data))
+			if tampered == string(data) {
+				t.Fatal("the fixture wasn't changed")
+			}
+
+			_, _, err := decryptSops([]byte(tampered))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestDecryptSopsWrongKey(t *testing.T) {
+	data := readSopsFixture(t, "secrets.yaml")
+
+	t.Setenv("SOPS_AGE_KEY", "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+
+	_, _, err := decryptSops(data)
+	if err == nil || !strings.Contains(err.Error(), "none of the age identities") {
+		t.Fatalf("expected the data key not to decrypt, got %v", err)
+	}
+}
+
+func TestSopsMacAdd(t *testing.T) {
+	tests := []struct {
+		value        interface{}
+		floatNumbers bool
+		expected     string
+	}{
+		{value: "start123", expected: "start123"},
+		{value: 3, expected: "3"},
+		{value: int64(9223372036854775807), expected: "9223372036854775807"},
+		{value: uint64(18446744073709551615), expected: "18446744073709551615"},
+		{value: 0.75, expected: "0.75"},
+		{value: true, expected: "True"},
+		{value: false, expected: "False"},
+		{value: 3, floatNumbers: true, expected: "3"},
+		{value: 9007199254740993, floatNumbers: true, expected: "9007199254740992"},
+		{value: uint64(18446744073709551615), floatNumbers: true, expected: "18446744073709552000"},
+	}
+
+	for _, test := range tests {
+		mac := newSopsMac(false)
+		mac.floatNumbers = test.floatNumbers
+
+		err := mac.add(test.value, false)
+		if err != nil {
+			t.Fatalf("%T %v: %v", test.value, test.value, err)
+		}
+
+		expected := newSopsMac(false)
+		expected.hash.Write([]byte(test.expected))
+
+		if string(mac.hash.Sum(nil)) != string(expected.hash.Sum(nil)) {
+			t.Errorf("%T %v wasn't added as %s", test.value, test.value, test.expected)
+		}
+	}
+
+	mac := newSopsMac(false)
+	if err := mac.add([]string{"a"}, false); err == nil {
+		t.Error("expected a value sops can't convert to fail")
+	}
+}
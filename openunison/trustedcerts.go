@@ -0,0 +1,198 @@
+package openunison
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tremolosecurity/openunison-control/helmmodel"
+	"gopkg.in/yaml.v3"
+)
+
+// a values.yaml's trusted_certs.  Only the trusted_certs key is re-written when it's saved, the rest of the file
+// keeps its order and comments
+type TrustedCertsFile struct {
+	Certs helmmodel.TrustedCerts
+
+	path     string
+	original []byte
+	mode     os.FileMode
+	doc      *yaml.Node
+}
+
+// loads trusted_certs from a values.yaml, SOPS encrypted files can't be edited
+func LoadTrustedCertsFile(path string) (*TrustedCertsFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, encrypted, err := decryptSops(data)
+	if encrypted {
+		return nil, fmt.Errorf("%s is encrypted with SOPS, edit trusted_certs with sops", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(data, doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	if doc.Kind == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s isn't a values file", path)
+	}
+
+	var values interface{}
+	if _, valueNode := trustedCertsNode(doc); valueNode != nil {
+		err = valueNode.Decode(&values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certs, err := helmmodel.ParseTrustedCerts(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &TrustedCertsFile{
+		Certs:    certs,
+		path:     path,
+		original: data,
+		mode:     info.Mode().Perm(),
+		doc:      doc,
+	}, nil
+}
+
+// adds the certificate in pemPath, or replaces the certificate with the name.  Returns the name the certificate is
+// trusted with, which is an existing entry's if it's already trusted
+func (f *TrustedCertsFile) Add(name string, pemPath string) (string, error) {
+	pemData, err := os.ReadFile(pemPath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, removed := range f.Certs.Reconcile() {
+		fmt.Printf("Removing trusted_certs entry %s\n", removed)
+	}
+
+	return f.Certs.Set(name, pemData)
+}
+
+func (f *TrustedCertsFile) Remove(name string) error {
+	if !f.Certs.Remove(name) {
+		return fmt.Errorf("%s has no trusted certificate named %s", f.path, name)
+	}
+
+	for _, removed := range f.Certs.Reconcile() {
+		fmt.Printf("Removing trusted_certs entry %s\n", removed)
+	}
+
+	return nil
+}
+
+// writes trusted_certs back to the values.yaml.  The file is replaced with a rename so it's never partially written,
+// and isn't saved if it was changed since it was loaded
+func (f *TrustedCertsFile) Save() error {
+	valueNode := &yaml.Node{}
+	err := valueNode.Encode(f.Certs.Values())
+	if err != nil {
+		return err
+	}
+
+	_, existing := trustedCertsNode(f.doc)
+	if existing != nil {
+		valueNode.HeadComment = existing.HeadComment
+		valueNode.LineComment = existing.LineComment
+		valueNode.FootComment = existing.FootComment
+		*existing = *valueNode
+	} else {
+		root := f.doc.Content[0]
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "trusted_certs"}, valueNode)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(f.doc)
+	if err != nil {
+		return err
+	}
+	encoder.Close()
+
+	current, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(current, f.original) {
+		return fmt.Errorf("%s was changed while trusted_certs was being updated, not saving", f.path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(f.mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", f.path, err)
+	}
+
+	err = os.Rename(tmp.Name(), f.path)
+	if err != nil {
+		return err
+	}
+
+	f.original = buf.Bytes()
+
+	return nil
+}
+
+// the trusted_certs key and value in a values document, nil if it isn't set
+func trustedCertsNode(doc *yaml.Node) (*yaml.Node, *yaml.Node) {
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "trusted_certs" {
+			return root.Content[i], root.Content[i+1]
+		}
+	}
+
+	return nil, nil
+}
+
+// warns about trusted certificates that are invalid, expired or expire soon
+func printTrustedCertWarnings(certs helmmodel.TrustedCerts) {
+	for _, status := range certs.Status(certificateExpiryWarning) {
+		if status.Error != "" {
+			fmt.Printf("WARNING: trusted certificate %s isn't valid - %s\n", status.Name, status.Error)
+		} else if status.Expired {
+			fmt.Printf("WARNING: trusted certificate %s (%s) expired on %s\n", status.Name, status.Subject, status.NotAfter.UTC().Format(time.RFC3339))
+		} else if status.ExpiresSoon {
+			fmt.Printf("WARNING: trusted certificate %s (%s) expires on %s\n", status.Name, status.Subject, status.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+}
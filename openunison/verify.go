@@ -0,0 +1,182 @@
+package openunison
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+// the annotation cosign stores a signature of the layer's payload in
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// configures how charts are verified before they're installed
+type ChartVerification struct {
+	// if true, every chart must be signed by a trusted key
+	Verify bool
+	// the keyring used to verify provenance files of charts from repositories
+	Keyring string
+	// paths to PEM public keys trusted to sign OCI charts with cosign
+	CosignKeys []string
+}
+
+// the payload cosign signs, only the fields that are checked
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// loads the public keys trusted to sign OCI charts
+func loadCosignKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0)
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM public key", path)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the public key in %s: %v", path, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// true if the signature of the payload was created by the key
+func verifySignature(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	}
+
+	return false
+}
+
+// verifies an OCI chart's manifest was signed by one of the trusted cosign keys.  Signatures are read from the
+// sha256-<digest>.sig tag cosign stores them in, using the same credentials as the chart
+func (ou *OpenUnisonDeployment) verifyCosignSignature(chartName string, manifestDigest string, settings *cli.EnvSettings) error {
+	if len(ou.chartVerification.CosignKeys) == 0 {
+		return fmt.Errorf("chart %s is from an OCI registry, verifying it requires --cosign-key", chartName)
+	}
+
+	keys, err := loadCosignKeys(ou.chartVerification.CosignKeys)
+	if err != nil {
+		return err
+	}
+
+	resolver, err := ou.registryOptions.resolver(settings)
+	if err != nil {
+		return err
+	}
+
+	signatureRef := strings.TrimPrefix(chartName, "oci://") + ":" + strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+
+	name, desc, err := resolver.Resolve(context.TODO(), signatureRef)
+	if err != nil {
+		return fmt.Errorf("chart %s is not signed, could not find %s: %v", chartName, signatureRef, err)
+	}
+
+	fetcher, err := resolver.Fetcher(context.TODO(), name)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := fetchBlob(fetcher, desc)
+	if err != nil {
+		return err
+	}
+
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return fmt.Errorf("could not parse signature manifest %s: %v", signatureRef, err)
+	}
+
+	for _, layer := range manifest.Layers {
+		encodedSignature, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+		if err != nil {
+			continue
+		}
+
+		payload, err := fetchBlob(fetcher, layer)
+		if err != nil {
+			return err
+		}
+
+		var signed cosignPayload
+		err = json.Unmarshal(payload, &signed)
+		if err != nil || signed.Critical.Image.DockerManifestDigest != manifestDigest {
+			// a signature of a different manifest
+			continue
+		}
+
+		for _, key := range keys {
+			if verifySignature(key, payload, signature) {
+				fmt.Printf("Chart %s is signed by a trusted key\n", chartName)
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("chart %s manifest %s is not signed by a trusted key", chartName, manifestDigest)
+}
+
+// reads a blob, checking it matches its digest
+func fetchBlob(fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := fetcher.Fetch(context.TODO(), desc)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(data)
+	if desc.Digest.String() != fmt.Sprintf("sha256:%x", digest) {
+		return nil, fmt.Errorf("blob %s does not match its digest", desc.Digest)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,285 @@
+package openunison
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+// a key pair to sign cosign payloads with, the public key is written as a PEM file like --cosign-key expects
+type cosignTestKey struct {
+	name    string
+	signer  crypto.Signer
+	keyPath string
+}
+
+// signs the payload the same way cosign does for the key's type
+func (key cosignTestKey) sign(t *testing.T, payload []byte) []byte {
+	t.Helper()
+
+	var signature []byte
+	var err error
+
+	digest := sha256.Sum256(payload)
+
+	switch k := key.signer.(type) {
+	case *ecdsa.PrivateKey:
+		signature, err = ecdsa.SignASN1(rand.Reader, k, digest[:])
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, payload)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signature
+}
+
+// an ECDSA, RSA and ed25519 key
+func cosignTestKeys(t *testing.T) []cosignTestKey {
+	t.Helper()
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keys := []cosignTestKey{{name: "ecdsa", signer: ecdsaKey}, {name: "rsa", signer: rsaKey}, {name: "ed25519", signer: ed25519Key}}
+
+	for i, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key.signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[i].keyPath = filepath.Join(dir, key.name+".pub")
+		err = os.WriteFile(keys[i].keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return keys
+}
+
+// the payload cosign signs for a manifest
+func cosignTestPayload(manifestDigest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/charts/orchestra"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, manifestDigest))
+}
+
+func blobDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// a registry that only has the charts/orchestra repository, tags maps a tag to a manifest
+type testRegistry struct {
+	tags  map[string][]byte
+	blobs map[string][]byte
+}
+
+func (registry *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/v2/charts/orchestra/"
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, prefix+"manifests/"):
+		reference := strings.TrimPrefix(r.URL.Path, prefix+"manifests/")
+
+		manifest, ok := registry.tags[reference]
+		if !ok {
+			manifest, ok = registry.blobs[reference]
+		}
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", blobDigest(manifest))
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+
+		if r.Method != http.MethodHead {
+			w.Write(manifest)
+		}
+	case strings.HasPrefix(r.URL.Path, prefix+"blobs/"):
+		blob, ok := registry.blobs[strings.TrimPrefix(r.URL.Path, prefix+"blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+
+		if r.Method != http.MethodHead {
+			w.Write(blob)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stores a signature manifest cosign would create in the sha256-<digest>.sig tag of manifestDigest
+func (registry *testRegistry) addSignature(t *testing.T, manifestDigest string, payload []byte, signature []byte) {
+	t.Helper()
+
+	config := []byte("{}")
+	registry.blobs[blobDigest(config)] = config
+	registry.blobs[blobDigest(payload)] = payload
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"config":        map[string]interface{}{"mediaType": ocispec.MediaTypeImageConfig, "digest": blobDigest(config), "size": len(config)},
+		"layers": []interface{}{
+			map[string]interface{}{
+				"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+				"digest":      blobDigest(payload),
+				"size":        len(payload),
+				"annotations": map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry.blobs[blobDigest(manifest)] = manifest
+	registry.tags[strings.Replace(manifestDigest, ":", "-", 1)+".sig"] = manifest
+}
+
+func TestVerifySignature(t *testing.T) {
+	keys := cosignTestKeys(t)
+	payload := cosignTestPayload(blobDigest([]byte("manifest")))
+
+	for i, key := range keys {
+		trusted, err := loadCosignKeys([]string{key.keyPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature := key.sign(t, payload)
+
+		if !verifySignature(trusted[0], payload, signature) {
+			t.Errorf("%s: the signature wasn't verified", key.name)
+		}
+
+		if verifySignature(trusted[0], cosignTestPayload(blobDigest([]byte("other"))), signature) {
+			t.Errorf("%s: the signature of another payload was verified", key.name)
+		}
+
+		other := keys[(i+1)%len(keys)]
+		if verifySignature(trusted[0], payload, other.sign(t, payload)) {
+			t.Errorf("%s: a signature by the %s key was verified", key.name, other.name)
+		}
+	}
+}
+
+func TestVerifyCosignSignature(t *testing.T) {
+	keys := cosignTestKeys(t)
+
+	untrustedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted := cosignTestKey{name: "untrusted", signer: untrustedKey}
+
+	manifestDigest := blobDigest([]byte("orchestra manifest"))
+	otherDigest := blobDigest([]byte("another manifest"))
+
+	registryConfig := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(registryConfig, []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// key signs the payload for the signed digest, only the trusted keys are passed as --cosign-key
+		key     cosignTestKey
+		signed  string
+		trusted []cosignTestKey
+		err     string
+	}{
+		{name: "ecdsa", key: keys[0], signed: manifestDigest, trusted: keys},
+		{name: "rsa", key: keys[1], signed: manifestDigest, trusted: keys},
+		{name: "ed25519", key: keys[2], signed: manifestDigest, trusted: keys},
+		{name: "untrusted key", key: untrusted, signed: manifestDigest, trusted: keys, err: "is not signed by a trusted key"},
+		{name: "only another key is trusted", key: keys[0], signed: manifestDigest, trusted: keys[1:], err: "is not signed by a trusted key"},
+		// a valid signature of another manifest copied to this manifest's tag
+		{name: "wrong digest", key: keys[0], signed: otherDigest, trusted: keys, err: "is not signed by a trusted key"},
+		{name: "unsigned", trusted: keys, err: "is not signed, could not find"},
+		{name: "no keys", key: keys[0], signed: manifestDigest, err: "requires --cosign-key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &testRegistry{tags: map[string][]byte{}, blobs: map[string][]byte{}}
+			if test.signed != "" {
+				payload := cosignTestPayload(test.signed)
+				registry.addSignature(t, manifestDigest, payload, test.key.sign(t, payload))
+			}
+
+			server := httptest.NewServer(registry)
+			t.Cleanup(server.Close)
+
+			keyPaths := make([]string, 0)
+			for _, key := range test.trusted {
+				keyPaths = append(keyPaths, key.keyPath)
+			}
+
+			ou := &OpenUnisonDeployment{
+				registryOptions:   RegistryOptions{PlainHTTP: true, ConfigPath: registryConfig},
+				chartVerification: ChartVerification{Verify: true, CosignKeys: keyPaths},
+			}
+
+			chartName := "oci://" + strings.TrimPrefix(server.URL, "http://") + "/charts/orchestra"
+
+			err := ou.verifyCosignSignature(chartName, manifestDigest, cli.New())
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}